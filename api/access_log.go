@@ -0,0 +1,63 @@
+package api
+
+import (
+	"kiln-tezos-delegation/logging"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// RequestIDHeader is the header holding the ID of requests, echoed in responses.
+	RequestIDHeader = "X-Request-Id"
+	// maxRequestIDLength is the maximum length of request IDs passed by clients.
+	maxRequestIDLength = 128
+)
+
+// accessLog wraps the handler to log every request once responded to, at error level
+// for HTTP-5xx responses and at info level otherwise. Requests are identified by the
+// ID passed by clients in the RequestIDHeader header, or by a generated one, which is
+// echoed in the response and attached to every line logged while handling them.
+// The given logger is made available to handlers with logging.FromContext.
+func accessLog(logger *slog.Logger, hdl http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+
+		id := request.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = logging.NewID()
+		}
+		writer.Header().Set(RequestIDHeader, id)
+
+		ctx := logging.With(request.Context(), "request_id", id)
+		ctx = logging.NewContext(ctx, logger)
+		rec := &statusRecorder{ResponseWriter: writer}
+
+		hdl.ServeHTTP(rec, request.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.Log(ctx, level, "request handled",
+			"method", request.Method, "path", request.URL.Path, "status", rec.status,
+			"bytes", rec.bytes, "duration", time.Since(start))
+	})
+}
+
+// validRequestID returns true if the given request ID is not empty, not too long,
+// and made of printable ASCII characters only, so that it is safe to log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+	"kiln-tezos-delegation/repository"
+	"time"
+)
+
+type BakerRepository interface {
+	GetBakerStats(context.Context, string, time.Time, time.Time, int) (repository.BakerStats, error)
+}
+
+type BakerController struct {
+	repo BakerRepository
+}
+
+func NewBakerController(repo BakerRepository) BakerController {
+	return BakerController{
+		repo: repo,
+	}
+}
+
+// GetBakerStats gets aggregate statistics of the delegations to the given baker,
+// with flows over the [from, to[ period and at most top delegators.
+// Returns a *ValidationError if the period is empty.
+func (c BakerController) GetBakerStats(ctx context.Context, baker string, from, to time.Time, top int) (repository.BakerStats, error) {
+	if !from.Before(to) {
+		verr := &ValidationError{}
+		verr.Add("from", "must be before to")
+		return repository.BakerStats{}, verr
+	}
+	return c.repo.GetBakerStats(ctx, baker, from, to, top)
+}
@@ -0,0 +1,61 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bakerRepoMock struct {
+	GetBakerStatsRet   repository.BakerStats
+	GetBakerStatsErr   error
+	GetBakerStatsCount int
+	GetBakerStatsIn    string
+}
+
+func (m *bakerRepoMock) GetBakerStats(_ context.Context, baker string, _, _ time.Time, _ int) (repository.BakerStats, error) {
+	m.GetBakerStatsIn = baker
+	m.GetBakerStatsCount++
+	return m.GetBakerStatsRet, m.GetBakerStatsErr
+}
+
+func TestGetBakerStats(t *testing.T) {
+	to := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+	from := to.Add(-time.Hour)
+
+	t.Run("returns stats", func(t *testing.T) {
+		mock := bakerRepoMock{
+			GetBakerStatsRet: repository.BakerStats{DelegatorCount: 42},
+		}
+		ctl := api.NewBakerController(&mock)
+		stats, err := ctl.GetBakerStats(context.Background(), "baker1", from, to, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(42), stats.DelegatorCount)
+		assert.Equal(t, "baker1", mock.GetBakerStatsIn)
+	})
+
+	t.Run("validation error on empty period", func(t *testing.T) {
+		mock := bakerRepoMock{}
+		ctl := api.NewBakerController(&mock)
+		_, err := ctl.GetBakerStats(context.Background(), "baker1", to, from, 10)
+
+		var verr *api.ValidationError
+		require.ErrorAs(t, err, &verr)
+		assert.Equal(t, 0, mock.GetBakerStatsCount)
+	})
+
+	t.Run("repository error", func(t *testing.T) {
+		mock := bakerRepoMock{
+			GetBakerStatsErr: errors.New("fake database error"),
+		}
+		ctl := api.NewBakerController(&mock)
+		_, err := ctl.GetBakerStats(context.Background(), "baker1", from, to, 10)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kiln-tezos-delegation/repository"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultStatsPeriod is the period over which flows are computed when not specified.
+	DefaultStatsPeriod = 30 * 24 * time.Hour
+	// DefaultTopDelegators is the number of top delegators returned when not specified.
+	DefaultTopDelegators = 10
+	// MaxTopDelegators is the maximum number of top delegators returned.
+	MaxTopDelegators = 100
+)
+
+type BakerStatsController interface {
+	GetBakerStats(context.Context, string, time.Time, time.Time, int) (repository.BakerStats, error)
+}
+
+// GetBakerStatsHandler handles GET requests to fetch aggregate statistics of the
+// delegations to the baker which address is the "address" path parameter.
+// Inflow and outflow are computed over the period set by the from (inclusive) and
+// to (exclusive) query parameters in RFC3339 format, the last 30 days by default.
+// The top query parameter sets the number of top delegators returned.
+// Responds with a specific HTTP status if method is invalid, and with HTTP-400 and a
+// body detailing every invalid parameter.
+func GetBakerStatsHandler(ctrl BakerStatsController) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		defer request.Body.Close()
+
+		if request.Method != http.MethodGet {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		verr := &ValidationError{}
+		address := request.PathValue("address")
+		if !isAddress(address) {
+			verr.Add("address", "must be a Tezos account address")
+		}
+
+		to := time.Now().UTC()
+		if val := request.URL.Query().Get("to"); val != "" {
+			ts, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				verr.Add("to", "must be in RFC3339 format")
+			}
+			to = ts
+		}
+		from := to.Add(-DefaultStatsPeriod)
+		if val := request.URL.Query().Get("from"); val != "" {
+			ts, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				verr.Add("from", "must be in RFC3339 format")
+			}
+			from = ts
+		}
+
+		top := DefaultTopDelegators
+		if val := request.URL.Query().Get("top"); val != "" {
+			var err error
+			top, err = strconv.Atoi(val)
+			if err != nil || top < 0 || top > MaxTopDelegators {
+				verr.Add("top", fmt.Sprintf("must be an integer between 0 and %d", MaxTopDelegators))
+			}
+		}
+
+		if err := verr.OrNil(); err != nil {
+			writeError(resp, request, err)
+			return
+		}
+
+		type Flow struct {
+			Count  int64  `json:"count"`
+			Amount string `json:"amount"`
+		}
+
+		type Delegator struct {
+			Address string `json:"address"`
+			Amount  string `json:"amount"`
+			Since   string `json:"since"`
+		}
+
+		type Response struct {
+			Baker            string      `json:"baker"`
+			DelegatorCount   int64       `json:"delegatorCount"`
+			DelegatedBalance string      `json:"delegatedBalance"`
+			From             string      `json:"from"`
+			To               string      `json:"to"`
+			Inflow           Flow        `json:"inflow"`
+			Outflow          Flow        `json:"outflow"`
+			TopDelegators    []Delegator `json:"topDelegators"`
+		}
+
+		stats, err := ctrl.GetBakerStats(request.Context(), address, from, to, top)
+
+		switch {
+		case errors.Is(err, nil):
+			data := Response{
+				Baker:            address,
+				DelegatorCount:   stats.DelegatorCount,
+				DelegatedBalance: strconv.FormatInt(stats.DelegatedBalance, 10),
+				From:             from.UTC().Format(time.RFC3339),
+				To:               to.UTC().Format(time.RFC3339),
+				Inflow:           Flow{Count: stats.Inflow.Count, Amount: strconv.FormatInt(stats.Inflow.Amount, 10)},
+				Outflow:          Flow{Count: stats.Outflow.Count, Amount: strconv.FormatInt(stats.Outflow.Amount, 10)},
+				TopDelegators:    make([]Delegator, len(stats.TopDelegators)),
+			}
+			for i, dlgr := range stats.TopDelegators {
+				data.TopDelegators[i] = Delegator{
+					Address: dlgr.Address,
+					Amount:  strconv.FormatInt(dlgr.Amount, 10),
+					Since:   dlgr.Since.UTC().Format(time.RFC3339),
+				}
+			}
+			resp.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(resp).Encode(data)
+		default:
+			writeError(resp, request, err)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const bakerAddr = "tz1aRoaRhSpRYvFdyvgWLL6TGyRoGF51wDjM"
+
+type bakerControllerMock struct {
+	GetBakerStatsRet     repository.BakerStats
+	GetBakerStatsErr     error
+	GetBakerStatsCount   int
+	GetBakerStatsInBaker string
+	GetBakerStatsInFrom  time.Time
+	GetBakerStatsInTo    time.Time
+	GetBakerStatsInTop   int
+}
+
+func (m *bakerControllerMock) GetBakerStats(_ context.Context, baker string, from, to time.Time, top int) (repository.BakerStats, error) {
+	m.GetBakerStatsCount++
+	m.GetBakerStatsInBaker = baker
+	m.GetBakerStatsInFrom = from
+	m.GetBakerStatsInTo = to
+	m.GetBakerStatsInTop = top
+	return m.GetBakerStatsRet, m.GetBakerStatsErr
+}
+
+// serveBakerStats serves the given request with the baker stats handler mounted on its route.
+func serveBakerStats(ctrl api.BakerStatsController, req *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle("/xtz/bakers/{address}/stats", api.GetBakerStatsHandler(ctrl))
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestGetBakerStatsHandler(t *testing.T) {
+	t.Run("successfully return data", func(t *testing.T) {
+		mock := bakerControllerMock{
+			GetBakerStatsRet: repository.BakerStats{
+				DelegatorCount:   2,
+				DelegatedBalance: 300,
+				Inflow:           repository.Flow{Count: 3, Amount: 400},
+				Outflow:          repository.Flow{Count: 1, Amount: 100},
+				TopDelegators: []repository.Delegator{
+					{Address: "addr1", Amount: 200, Since: time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)},
+					{Address: "addr2", Amount: 100, Since: time.Date(2024, 06, 25, 10, 02, 33, 0, time.UTC)},
+				},
+			},
+		}
+		req := httptest.NewRequest("GET", "/xtz/bakers/"+bakerAddr+"/stats?from=2024-06-01T00:00:00Z&to=2024-07-01T00:00:00Z&top=2", http.NoBody)
+
+		resp := serveBakerStats(&mock, req)
+
+		pld := struct {
+			Baker            string `json:"baker"`
+			DelegatorCount   int64  `json:"delegatorCount"`
+			DelegatedBalance string `json:"delegatedBalance"`
+			From             string `json:"from"`
+			To               string `json:"to"`
+			Inflow           struct {
+				Count  int64  `json:"count"`
+				Amount string `json:"amount"`
+			} `json:"inflow"`
+			Outflow struct {
+				Count  int64  `json:"count"`
+				Amount string `json:"amount"`
+			} `json:"outflow"`
+			TopDelegators []map[string]string `json:"topDelegators"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, bakerAddr, pld.Baker)
+		assert.Equal(t, int64(2), pld.DelegatorCount)
+		assert.Equal(t, "300", pld.DelegatedBalance)
+		assert.Equal(t, "2024-06-01T00:00:00Z", pld.From)
+		assert.Equal(t, "2024-07-01T00:00:00Z", pld.To)
+		assert.Equal(t, int64(3), pld.Inflow.Count)
+		assert.Equal(t, "400", pld.Inflow.Amount)
+		assert.Equal(t, int64(1), pld.Outflow.Count)
+		assert.Equal(t, "100", pld.Outflow.Amount)
+		require.Len(t, pld.TopDelegators, 2)
+		assert.Equal(t, "addr1", pld.TopDelegators[0]["address"])
+		assert.Equal(t, "200", pld.TopDelegators[0]["amount"])
+		assert.Equal(t, "2024-06-26T10:02:33Z", pld.TopDelegators[0]["since"])
+		assert.Equal(t, bakerAddr, mock.GetBakerStatsInBaker)
+		assert.Equal(t, 2, mock.GetBakerStatsInTop)
+	})
+
+	t.Run("defaults to last days and top delegators", func(t *testing.T) {
+		mock := bakerControllerMock{}
+		req := httptest.NewRequest("GET", "/xtz/bakers/"+bakerAddr+"/stats", http.NoBody)
+
+		resp := serveBakerStats(&mock, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.WithinDuration(t, time.Now(), mock.GetBakerStatsInTo, time.Second)
+		assert.Equal(t, api.DefaultStatsPeriod, mock.GetBakerStatsInTo.Sub(mock.GetBakerStatsInFrom))
+		assert.Equal(t, api.DefaultTopDelegators, mock.GetBakerStatsInTop)
+	})
+
+	t.Run("returns no top delegators when top is 0", func(t *testing.T) {
+		mock := bakerControllerMock{
+			GetBakerStatsRet: repository.BakerStats{DelegatorCount: 2, TopDelegators: []repository.Delegator{}},
+		}
+		req := httptest.NewRequest("GET", "/xtz/bakers/"+bakerAddr+"/stats?top=0", http.NoBody)
+
+		resp := serveBakerStats(&mock, req)
+
+		pld := struct {
+			DelegatorCount int64               `json:"delegatorCount"`
+			TopDelegators  []map[string]string `json:"topDelegators"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, 0, mock.GetBakerStatsInTop)
+		assert.Equal(t, int64(2), pld.DelegatorCount)
+		assert.NotNil(t, pld.TopDelegators)
+		assert.Empty(t, pld.TopDelegators)
+	})
+
+	t.Run("status code on bad parameters", func(t *testing.T) {
+		testCases := map[string]string{
+			"/xtz/bakers/abc/stats":                         "address",
+			"/xtz/bakers/" + bakerAddr + "/stats?from=2024": "from",
+			"/xtz/bakers/" + bakerAddr + "/stats?to=2024":   "to",
+			"/xtz/bakers/" + bakerAddr + "/stats?top=1000":  "top",
+			"/xtz/bakers/" + bakerAddr + "/stats?top=abc":   "top",
+			"/xtz/bakers/" + bakerAddr + "/stats?top=-1":    "top",
+		}
+		for target, param := range testCases {
+			mock := bakerControllerMock{ /* unused */ }
+			req := httptest.NewRequest("GET", target, http.NoBody)
+
+			resp := serveBakerStats(&mock, req)
+
+			pld := struct {
+				Details []api.FieldError `json:"details"`
+			}{}
+			err := json.NewDecoder(resp.Body).Decode(&pld)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, resp.Code, target)
+			require.Len(t, pld.Details, 1, target)
+			assert.Equal(t, param, pld.Details[0].Parameter, target)
+			assert.Equal(t, 0, mock.GetBakerStatsCount)
+		}
+	})
+
+	t.Run("status code on controller error", func(t *testing.T) {
+		mock := bakerControllerMock{
+			GetBakerStatsErr: errors.New("fake controller error"),
+		}
+		req := httptest.NewRequest("GET", "/xtz/bakers/"+bakerAddr+"/stats", http.NoBody)
+
+		resp := serveBakerStats(&mock, req)
+
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, 0, resp.Body.Len())
+	})
+
+	t.Run("status code on bad method", func(t *testing.T) {
+		mock := bakerControllerMock{}
+		req := httptest.NewRequest("POST", "/xtz/bakers/"+bakerAddr+"/stats", http.NoBody)
+
+		resp := serveBakerStats(&mock, req)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+		assert.Equal(t, 0, mock.GetBakerStatsCount)
+	})
+}
@@ -3,13 +3,53 @@ package api
 import (
 	"context"
 	"kiln-tezos-delegation/repository"
+	"strings"
+	"time"
 )
 
 const YearNotSpecified = 0
 
 type Repository interface {
-	GetDelegations(context.Context) ([]repository.Delegation, error)
-	GetDelegationsOfYear(context.Context, int) ([]repository.Delegation, error)
+	GetDelegations(context.Context, repository.DelegationFilter, repository.Page) ([]repository.Delegation, error)
+	GetDelegationHistogram(context.Context, repository.Interval, time.Time, time.Time) ([]repository.Bucket, error)
+}
+
+// DelegationPage is a page of delegations, with the cursor of the next page if there is one.
+type DelegationPage struct {
+	Delegations []repository.Delegation
+	Next        *repository.Cursor
+}
+
+// FieldError describes why the value of a query parameter is invalid.
+type FieldError struct {
+	Parameter string `json:"parameter"`
+	Message   string `json:"message"`
+}
+
+// ValidationError reports every invalid query parameter of a request.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i := range e.Fields {
+		msgs[i] = e.Fields[i].Parameter + ": " + e.Fields[i].Message
+	}
+	return "invalid parameters: " + strings.Join(msgs, ", ")
+}
+
+// Add records an invalid query parameter.
+func (e *ValidationError) Add(param, msg string) {
+	e.Fields = append(e.Fields, FieldError{Parameter: param, Message: msg})
+}
+
+// OrNil returns the validation error if any invalid parameter has been recorded, nil otherwise.
+func (e *ValidationError) OrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
 }
 
 type TezosController struct {
@@ -22,9 +62,71 @@ func NewController(repo Repository) TezosController {
 	}
 }
 
-func (c TezosController) GetDelegations(ctx context.Context, year int) ([]repository.Delegation, error) {
-	if year != YearNotSpecified {
-		return c.repo.GetDelegationsOfYear(ctx, year)
+// GetDelegations gets a page of delegations matching the given filter.
+// The cursor of the next page is set if more delegations are available.
+// Returns a *ValidationError if the filter criteria are inconsistent.
+func (c TezosController) GetDelegations(ctx context.Context, filter repository.DelegationFilter, page repository.Page) (DelegationPage, error) {
+	if err := validateFilter(filter); err != nil {
+		return DelegationPage{}, err
+	}
+
+	return getDelegationPage(ctx, c.repo.GetDelegations, filter, page)
+}
+
+// getDelegationPage gets a page of delegations matching the given filter with the
+// given getter, and sets the cursor of the next page if more delegations are available.
+func getDelegationPage(
+	ctx context.Context,
+	get func(context.Context, repository.DelegationFilter, repository.Page) ([]repository.Delegation, error),
+	filter repository.DelegationFilter,
+	page repository.Page,
+) (DelegationPage, error) {
+	// fetch one more delegation to know whether there is a next page
+	query := page
+	if page.Limit > 0 {
+		query.Limit = page.Limit + 1
+	}
+
+	dlgs, err := get(ctx, filter, query)
+	if err != nil {
+		return DelegationPage{}, err
+	}
+
+	ret := DelegationPage{Delegations: dlgs}
+	if page.Limit > 0 && len(dlgs) > page.Limit {
+		ret.Delegations = dlgs[:page.Limit]
+		last := ret.Delegations[page.Limit-1]
+		ret.Next = &repository.Cursor{
+			BlockTimestamp: last.BlockTimestamp,
+			OperationID:    last.OperationID,
+		}
+	}
+
+	return ret, nil
+}
+
+// GetDelegationHistogram counts and sums the amounts of applied delegations within
+// [from, to[ by time interval. Returns a *ValidationError if the period is empty.
+func (c TezosController) GetDelegationHistogram(ctx context.Context, interval repository.Interval, from, to time.Time) ([]repository.Bucket, error) {
+	if !from.Before(to) {
+		verr := &ValidationError{}
+		verr.Add("from", "must be before to")
+		return []repository.Bucket{}, verr
+	}
+	return c.repo.GetDelegationHistogram(ctx, interval, from, to)
+}
+
+// validateFilter checks that the ranges of the filter are not empty.
+func validateFilter(filter repository.DelegationFilter) error {
+	verr := &ValidationError{}
+	if filter.MinLevel != nil && filter.MaxLevel != nil && *filter.MinLevel > *filter.MaxLevel {
+		verr.Add("minLevel", "must be lower or equal to maxLevel")
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		verr.Add("from", "must be before to")
+	}
+	if filter.MinAmount != nil && filter.MaxAmount != nil && *filter.MinAmount > *filter.MaxAmount {
+		verr.Add("minAmount", "must be lower or equal to maxAmount")
 	}
-	return c.repo.GetDelegations(ctx)
+	return verr.OrNil()
 }
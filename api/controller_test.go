@@ -6,80 +6,172 @@ import (
 	"kiln-tezos-delegation/api"
 	"kiln-tezos-delegation/repository"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type repoMock struct {
-	GetDelegationsRet         []repository.Delegation
-	GetDelegationsErr         error
-	GetDelegationsCount       int
-	GetDelegationsOfYearRet   []repository.Delegation
-	GetDelegationsOfYearErr   error
-	GetDelegationsOfYearCount int
-	GetDelegationsOfYearIn    int
+	GetDelegationsRet    []repository.Delegation
+	GetDelegationsErr    error
+	GetDelegationsCount  int
+	GetDelegationsIn     repository.DelegationFilter
+	GetDelegationsPageIn repository.Page
+
+	GetDelegationHistogramRet   []repository.Bucket
+	GetDelegationHistogramErr   error
+	GetDelegationHistogramCount int
+	GetDelegationHistogramIn    repository.Interval
 }
 
-func (m *repoMock) GetDelegations(context.Context) ([]repository.Delegation, error) {
+func (m *repoMock) GetDelegations(_ context.Context, filter repository.DelegationFilter, page repository.Page) ([]repository.Delegation, error) {
+	m.GetDelegationsIn = filter
+	m.GetDelegationsPageIn = page
 	m.GetDelegationsCount++
 	return m.GetDelegationsRet, m.GetDelegationsErr
 }
 
-func (m *repoMock) GetDelegationsOfYear(_ context.Context, year int) ([]repository.Delegation, error) {
-	m.GetDelegationsOfYearIn = year
-	m.GetDelegationsOfYearCount++
-	return m.GetDelegationsOfYearRet, m.GetDelegationsOfYearErr
+func (m *repoMock) GetDelegationHistogram(_ context.Context, interval repository.Interval, _, _ time.Time) ([]repository.Bucket, error) {
+	m.GetDelegationHistogramIn = interval
+	m.GetDelegationHistogramCount++
+	return m.GetDelegationHistogramRet, m.GetDelegationHistogramErr
 }
 
 func TestGetDelegations(t *testing.T) {
-	t.Run("no year filter", func(t *testing.T) {
+	t.Run("no filter", func(t *testing.T) {
 		mock := repoMock{
 			GetDelegationsRet: []repository.Delegation{
 				{OperationID: 42}, {OperationID: 43},
 			},
 		}
 		ctl := api.NewController(&mock)
-		dlgs, err := ctl.GetDelegations(context.Background(), api.YearNotSpecified)
+		res, err := ctl.GetDelegations(context.Background(), repository.DelegationFilter{}, repository.Page{})
 		assert.NoError(t, err)
-		assert.Len(t, dlgs, 2)
-		assert.Equal(t, int64(42), dlgs[0].OperationID)
-		assert.Equal(t, int64(43), dlgs[1].OperationID)
+		assert.Len(t, res.Delegations, 2)
+		assert.Equal(t, int64(42), res.Delegations[0].OperationID)
+		assert.Equal(t, int64(43), res.Delegations[1].OperationID)
+		assert.Nil(t, res.Next)
 		assert.Equal(t, 1, mock.GetDelegationsCount)
-		assert.Equal(t, 0, mock.GetDelegationsOfYearCount)
 	})
 
-	t.Run("with year filter", func(t *testing.T) {
+	t.Run("with filter", func(t *testing.T) {
 		mock := repoMock{
-			GetDelegationsOfYearRet: []repository.Delegation{
+			GetDelegationsRet: []repository.Delegation{
 				{OperationID: 42}, {OperationID: 43},
 			},
 		}
+		minLevel, maxLevel := int32(10), int32(10)
+		filter := repository.DelegationFilter{
+			Year:      2024,
+			Delegator: "addr1",
+			MinLevel:  &minLevel,
+			MaxLevel:  &maxLevel,
+		}
 		ctl := api.NewController(&mock)
-		dlgs, err := ctl.GetDelegations(context.Background(), 2024)
+		res, err := ctl.GetDelegations(context.Background(), filter, repository.Page{})
 		assert.NoError(t, err)
-		assert.Len(t, dlgs, 2)
-		assert.Equal(t, int64(42), dlgs[0].OperationID)
-		assert.Equal(t, int64(43), dlgs[1].OperationID)
+		assert.Len(t, res.Delegations, 2)
+		assert.Equal(t, 1, mock.GetDelegationsCount)
+		assert.Equal(t, filter, mock.GetDelegationsIn)
+	})
+
+	t.Run("validation error on empty ranges", func(t *testing.T) {
+		mock := repoMock{}
+		minLevel, maxLevel := int32(11), int32(10)
+		minAmount, maxAmount := int64(11), int64(10)
+		ts := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+		filter := repository.DelegationFilter{
+			MinLevel:  &minLevel,
+			MaxLevel:  &maxLevel,
+			From:      ts,
+			To:        ts,
+			MinAmount: &minAmount,
+			MaxAmount: &maxAmount,
+		}
+		ctl := api.NewController(&mock)
+		_, err := ctl.GetDelegations(context.Background(), filter, repository.Page{})
+
+		var verr *api.ValidationError
+		require.ErrorAs(t, err, &verr)
+		assert.Len(t, verr.Fields, 3)
 		assert.Equal(t, 0, mock.GetDelegationsCount)
-		assert.Equal(t, 1, mock.GetDelegationsOfYearCount)
-		assert.Equal(t, 2024, mock.GetDelegationsOfYearIn)
 	})
 
-	t.Run("handler error without year", func(t *testing.T) {
+	t.Run("handler error", func(t *testing.T) {
 		mock := repoMock{
 			GetDelegationsErr: errors.New("fake database error"),
 		}
 		ctl := api.NewController(&mock)
-		_, err := ctl.GetDelegations(context.Background(), api.YearNotSpecified)
+		_, err := ctl.GetDelegations(context.Background(), repository.DelegationFilter{Year: 2024}, repository.Page{})
 		assert.Error(t, err)
 	})
 
-	t.Run("handler error with year", func(t *testing.T) {
+	t.Run("sets next cursor when more delegations are available", func(t *testing.T) {
+		ts := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+		mock := repoMock{
+			GetDelegationsRet: []repository.Delegation{
+				{OperationID: 44, BlockTimestamp: ts.Add(time.Second)}, {OperationID: 43, BlockTimestamp: ts}, {OperationID: 42},
+			},
+		}
+		after := &repository.Cursor{BlockTimestamp: ts.Add(time.Hour), OperationID: 45}
+		ctl := api.NewController(&mock)
+		res, err := ctl.GetDelegations(context.Background(), repository.DelegationFilter{}, repository.Page{Limit: 2, After: after})
+		assert.NoError(t, err)
+		// one more delegation than the limit has been requested
+		assert.Equal(t, 3, mock.GetDelegationsPageIn.Limit)
+		assert.Equal(t, after, mock.GetDelegationsPageIn.After)
+		// only the limit is returned, and next page starts after the last one
+		assert.Len(t, res.Delegations, 2)
+		require.NotNil(t, res.Next)
+		assert.Equal(t, repository.Cursor{BlockTimestamp: ts, OperationID: 43}, *res.Next)
+	})
+
+	t.Run("no next cursor on last page", func(t *testing.T) {
+		mock := repoMock{
+			GetDelegationsRet: []repository.Delegation{
+				{OperationID: 43}, {OperationID: 42},
+			},
+		}
+		ctl := api.NewController(&mock)
+		res, err := ctl.GetDelegations(context.Background(), repository.DelegationFilter{Year: 2024}, repository.Page{Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, res.Delegations, 2)
+		assert.Nil(t, res.Next)
+	})
+}
+
+func TestGetDelegationHistogram(t *testing.T) {
+	to := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+	from := to.Add(-time.Hour)
+
+	t.Run("returns buckets", func(t *testing.T) {
+		mock := repoMock{
+			GetDelegationHistogramRet: []repository.Bucket{{Count: 1}, {Count: 2}},
+		}
+		ctl := api.NewController(&mock)
+		bkts, err := ctl.GetDelegationHistogram(context.Background(), repository.IntervalWeek, from, to)
+		assert.NoError(t, err)
+		assert.Len(t, bkts, 2)
+		assert.Equal(t, repository.IntervalWeek, mock.GetDelegationHistogramIn)
+	})
+
+	t.Run("validation error on empty period", func(t *testing.T) {
+		mock := repoMock{}
+		ctl := api.NewController(&mock)
+		_, err := ctl.GetDelegationHistogram(context.Background(), repository.IntervalDay, to, to)
+
+		var verr *api.ValidationError
+		require.ErrorAs(t, err, &verr)
+		assert.Equal(t, 0, mock.GetDelegationHistogramCount)
+	})
+
+	t.Run("repository error", func(t *testing.T) {
 		mock := repoMock{
-			GetDelegationsOfYearErr: errors.New("fake database error"),
+			GetDelegationHistogramErr: errors.New("fake database error"),
 		}
 		ctl := api.NewController(&mock)
-		_, err := ctl.GetDelegations(context.Background(), 2024)
+		_, err := ctl.GetDelegationHistogram(context.Background(), repository.IntervalDay, from, to)
 		assert.Error(t, err)
 	})
 }
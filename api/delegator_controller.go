@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"kiln-tezos-delegation/repository"
+)
+
+type DelegatorRepository interface {
+	GetCurrentDelegation(context.Context, string) (repository.CurrentDelegation, error)
+	GetDelegations(context.Context, repository.DelegationFilter, repository.Page) ([]repository.Delegation, error)
+}
+
+// DelegatorHistory is the current delegation state of an account, with a page of
+// its delegations.
+type DelegatorHistory struct {
+	Current repository.CurrentDelegation
+	History DelegationPage
+}
+
+type DelegatorController struct {
+	repo DelegatorRepository
+}
+
+func NewDelegatorController(repo DelegatorRepository) DelegatorController {
+	return DelegatorController{
+		repo: repo,
+	}
+}
+
+// GetDelegator gets the current delegation state of the given account, and a page of
+// its delegations, most recent first. Returns repository.ErrNotFound if the account
+// has no applied delegation.
+func (c DelegatorController) GetDelegator(ctx context.Context, delegator string, page repository.Page) (DelegatorHistory, error) {
+	cur, err := c.repo.GetCurrentDelegation(ctx, delegator)
+	if err != nil {
+		return DelegatorHistory{}, err
+	}
+
+	filter := repository.DelegationFilter{Year: YearNotSpecified, Delegator: delegator}
+	history, err := getDelegationPage(ctx, c.repo.GetDelegations, filter, page)
+	if err != nil {
+		return DelegatorHistory{}, err
+	}
+
+	return DelegatorHistory{Current: cur, History: history}, nil
+}
@@ -0,0 +1,79 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type delegatorRepoMock struct {
+	GetCurrentDelegationRet repository.CurrentDelegation
+	GetCurrentDelegationErr error
+	GetDelegationsRet       []repository.Delegation
+	GetDelegationsErr       error
+	GetDelegationsCount     int
+	GetDelegationsInFilter  repository.DelegationFilter
+	GetDelegationsInPage    repository.Page
+}
+
+func (m *delegatorRepoMock) GetCurrentDelegation(context.Context, string) (repository.CurrentDelegation, error) {
+	return m.GetCurrentDelegationRet, m.GetCurrentDelegationErr
+}
+
+func (m *delegatorRepoMock) GetDelegations(_ context.Context, filter repository.DelegationFilter, page repository.Page) ([]repository.Delegation, error) {
+	m.GetDelegationsCount++
+	m.GetDelegationsInFilter = filter
+	m.GetDelegationsInPage = page
+	return m.GetDelegationsRet, m.GetDelegationsErr
+}
+
+func TestGetDelegator(t *testing.T) {
+	ts := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+
+	t.Run("returns current delegation and history", func(t *testing.T) {
+		mock := delegatorRepoMock{
+			GetCurrentDelegationRet: repository.CurrentDelegation{Delegator: "addr1", Delegate: "baker1"},
+			GetDelegationsRet: []repository.Delegation{
+				{OperationID: 3, BlockTimestamp: ts},
+				{OperationID: 2, BlockTimestamp: ts.Add(-time.Hour)},
+				{OperationID: 1, BlockTimestamp: ts.Add(-2 * time.Hour)},
+			},
+		}
+		ctl := api.NewDelegatorController(&mock)
+		res, err := ctl.GetDelegator(context.Background(), "addr1", repository.Page{Limit: 2})
+		require.NoError(t, err)
+
+		assert.Equal(t, "baker1", res.Current.Delegate)
+		assert.Len(t, res.History.Delegations, 2)
+		require.NotNil(t, res.History.Next)
+		assert.Equal(t, int64(2), res.History.Next.OperationID)
+		assert.Equal(t, "addr1", mock.GetDelegationsInFilter.Delegator)
+		assert.Equal(t, 3, mock.GetDelegationsInPage.Limit)
+	})
+
+	t.Run("not found error on unknown delegator", func(t *testing.T) {
+		mock := delegatorRepoMock{
+			GetCurrentDelegationErr: repository.ErrNotFound,
+		}
+		ctl := api.NewDelegatorController(&mock)
+		_, err := ctl.GetDelegator(context.Background(), "addr1", repository.Page{Limit: 2})
+
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+		assert.Equal(t, 0, mock.GetDelegationsCount)
+	})
+
+	t.Run("repository error", func(t *testing.T) {
+		mock := delegatorRepoMock{
+			GetDelegationsErr: errors.New("fake database error"),
+		}
+		ctl := api.NewDelegatorController(&mock)
+		_, err := ctl.GetDelegator(context.Background(), "addr1", repository.Page{Limit: 2})
+		assert.Error(t, err)
+	})
+}
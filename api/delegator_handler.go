@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kiln-tezos-delegation/repository"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type DelegatorHistoryController interface {
+	GetDelegator(context.Context, string, repository.Page) (DelegatorHistory, error)
+}
+
+// GetDelegatorHandler handles GET requests to fetch the current baker of the account
+// which address is the "address" path parameter, along with a page of its delegation
+// history, most recent first. The limit and cursor query parameters page the history
+// as for delegations.
+// Responds with a specific HTTP status if method is invalid, with HTTP-400 and a body
+// detailing every invalid parameter, and with HTTP-404 if the account never delegated.
+func GetDelegatorHandler(ctrl DelegatorHistoryController) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		defer request.Body.Close()
+
+		if request.Method != http.MethodGet {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		verr := &ValidationError{}
+		address := request.PathValue("address")
+		if !isAddress(address) {
+			verr.Add("address", "must be a Tezos account address")
+		}
+		page := parsePage(request.URL.Query(), verr)
+
+		if err := verr.OrNil(); err != nil {
+			writeError(resp, request, err)
+			return
+		}
+
+		type Response struct {
+			Address  string       `json:"address"`
+			Delegate *string      `json:"delegate"`
+			Since    string       `json:"since"`
+			Level    string       `json:"level"`
+			History  []delegation `json:"history"`
+			Next     *string      `json:"next"`
+		}
+
+		res, err := ctrl.GetDelegator(request.Context(), address, page)
+
+		switch {
+		case errors.Is(err, nil):
+			resp.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(resp).Encode(Response{
+				Address:  address,
+				Delegate: nullableString(res.Current.Delegate),
+				Since:    res.Current.Since.UTC().Format(time.RFC3339),
+				Level:    strconv.Itoa(int(res.Current.Level)),
+				History:  toDelegations(res.History.Delegations),
+				Next:     nextLink(request, res.History.Next),
+			})
+		default:
+			writeError(resp, request, err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const delegatorAddr = "tz1Wit2PqodvPeuRRhdQXmkrtU8e8bRYZecd"
+
+type delegatorControllerMock struct {
+	GetDelegatorRet    api.DelegatorHistory
+	GetDelegatorErr    error
+	GetDelegatorCount  int
+	GetDelegatorInAddr string
+	GetDelegatorInPage repository.Page
+}
+
+func (m *delegatorControllerMock) GetDelegator(_ context.Context, address string, page repository.Page) (api.DelegatorHistory, error) {
+	m.GetDelegatorCount++
+	m.GetDelegatorInAddr = address
+	m.GetDelegatorInPage = page
+	return m.GetDelegatorRet, m.GetDelegatorErr
+}
+
+// serveDelegator serves the given request with the delegator handler mounted on its route.
+func serveDelegator(ctrl api.DelegatorHistoryController, req *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle("/xtz/delegators/{address}", api.GetDelegatorHandler(ctrl))
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestGetDelegatorHandler(t *testing.T) {
+	ts := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+
+	t.Run("successfully return data", func(t *testing.T) {
+		mock := delegatorControllerMock{
+			GetDelegatorRet: api.DelegatorHistory{
+				Current: repository.CurrentDelegation{Delegator: delegatorAddr, Delegate: bakerAddr, Level: 42, Since: ts},
+				History: api.DelegationPage{
+					Delegations: []repository.Delegation{
+						{BlockTimestamp: ts, OperationID: 2, Amount: 100, Level: 42, Sender: delegatorAddr, NewDelegate: bakerAddr},
+					},
+					Next: &repository.Cursor{BlockTimestamp: ts, OperationID: 2},
+				},
+			},
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegators/"+delegatorAddr+"?limit=1", http.NoBody)
+
+		resp := serveDelegator(&mock, req)
+
+		pld := struct {
+			Address  string           `json:"address"`
+			Delegate *string          `json:"delegate"`
+			Since    string           `json:"since"`
+			Level    string           `json:"level"`
+			History  []map[string]any `json:"history"`
+			Next     *string          `json:"next"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, delegatorAddr, pld.Address)
+		require.NotNil(t, pld.Delegate)
+		assert.Equal(t, bakerAddr, *pld.Delegate)
+		assert.Equal(t, "2024-06-26T10:02:33Z", pld.Since)
+		assert.Equal(t, "42", pld.Level)
+		require.Len(t, pld.History, 1)
+		assert.Equal(t, "100", pld.History[0]["amount"])
+		assert.Equal(t, bakerAddr, pld.History[0]["newDelegate"])
+		require.NotNil(t, pld.Next)
+		assert.Contains(t, *pld.Next, "/xtz/delegators/"+delegatorAddr+"?cursor=")
+		assert.Equal(t, delegatorAddr, mock.GetDelegatorInAddr)
+		assert.Equal(t, 1, mock.GetDelegatorInPage.Limit)
+	})
+
+	t.Run("null delegate when undelegated", func(t *testing.T) {
+		mock := delegatorControllerMock{
+			GetDelegatorRet: api.DelegatorHistory{
+				Current: repository.CurrentDelegation{Delegator: delegatorAddr, Since: ts},
+			},
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegators/"+delegatorAddr, http.NoBody)
+
+		resp := serveDelegator(&mock, req)
+
+		pld := map[string]any{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Nil(t, pld["delegate"])
+		assert.Equal(t, []any{}, pld["history"])
+		assert.Equal(t, api.DefaultLimit, mock.GetDelegatorInPage.Limit)
+	})
+
+	t.Run("status code on bad parameters", func(t *testing.T) {
+		testCases := map[string]string{
+			"/xtz/delegators/abc":                             "address",
+			"/xtz/delegators/" + delegatorAddr + "?limit=0":   "limit",
+			"/xtz/delegators/" + delegatorAddr + "?cursor=$$": "cursor",
+		}
+		for target, param := range testCases {
+			mock := delegatorControllerMock{ /* unused */ }
+			req := httptest.NewRequest("GET", target, http.NoBody)
+
+			resp := serveDelegator(&mock, req)
+
+			pld := struct {
+				Details []api.FieldError `json:"details"`
+			}{}
+			err := json.NewDecoder(resp.Body).Decode(&pld)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, resp.Code, target)
+			require.Len(t, pld.Details, 1, target)
+			assert.Equal(t, param, pld.Details[0].Parameter, target)
+			assert.Equal(t, 0, mock.GetDelegatorCount)
+		}
+	})
+
+	t.Run("status code on unknown delegator", func(t *testing.T) {
+		mock := delegatorControllerMock{
+			GetDelegatorErr: repository.ErrNotFound,
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegators/"+delegatorAddr, http.NoBody)
+
+		resp := serveDelegator(&mock, req)
+
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+		assert.Equal(t, 0, resp.Body.Len())
+	})
+
+	t.Run("status code on controller error", func(t *testing.T) {
+		mock := delegatorControllerMock{
+			GetDelegatorErr: errors.New("fake controller error"),
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegators/"+delegatorAddr, http.NoBody)
+
+		resp := serveDelegator(&mock, req)
+
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, 0, resp.Body.Len())
+	})
+
+	t.Run("status code on bad method", func(t *testing.T) {
+		mock := delegatorControllerMock{}
+		req := httptest.NewRequest("POST", "/xtz/delegators/"+delegatorAddr, http.NoBody)
+
+		resp := serveDelegator(&mock, req)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+		assert.Equal(t, 0, mock.GetDelegatorCount)
+	})
+}
@@ -2,23 +2,43 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"kiln-tezos-delegation/logging"
 	"kiln-tezos-delegation/repository"
-	"log"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// DefaultLimit is the number of delegations returned per page when not specified.
+	DefaultLimit = 100
+	// MaxLimit is the maximum number of delegations returned per page.
+	MaxLimit = 10000
+)
+
 type Controller interface {
-	GetDelegations(context.Context, int) ([]repository.Delegation, error)
+	GetDelegations(context.Context, repository.DelegationFilter, repository.Page) (DelegationPage, error)
 }
 
-// GetDelegationHandler handles GET requests to fetch delegations, possibly filtered
-// for a given year. The year query parameter must be in YYYY format.
-// Responds with a specific HTTP status if method or year query parameter are invalid.
+// GetDelegationHandler handles GET requests to fetch a page of delegations, possibly
+// filtered by any combination of the following query parameters:
+//   - year, in YYYY format
+//   - delegator and baker, as account addresses
+//   - minLevel and maxLevel, inclusive
+//   - from (inclusive) and to (exclusive), in RFC3339 format
+//   - minAmount and maxAmount, inclusive, in mutez
+//
+// The limit query parameter sets the page size, and the cursor query parameter is the
+// opaque value locating the page, as given in the "next" link of the previous page.
+// Responds with a specific HTTP status if method is invalid, and with HTTP-400 and a
+// body detailing every invalid query parameter.
 func GetDelegationHandler(ctrl Controller) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
 		defer request.Body.Close()
@@ -28,45 +48,241 @@ func GetDelegationHandler(ctrl Controller) http.Handler {
 			return
 		}
 
-		yearParam := YearNotSpecified
-		if val := request.URL.Query().Get("year"); val != "" {
-			_, err := fmt.Sscanf(val, "%4d", &yearParam)
-			if err != nil || len(val) != 4 {
-				resp.WriteHeader(http.StatusBadRequest)
-				return
-			}
-		}
-
-		type Delegation struct {
-			Timestamp string `json:"timestamp"`
-			Amount    string `json:"amount"`
-			Delegator string `json:"delegator"`
-			Level     string `json:"level"`
+		filter, page, err := parseDelegationQuery(request.URL.Query())
+		if err != nil {
+			writeError(resp, request, err)
+			return
 		}
 
 		type Response struct {
-			Data []Delegation `json:"data"`
+			Data []delegation `json:"data"`
+			Next *string      `json:"next"`
 		}
 
-		dlgs, err := ctrl.GetDelegations(request.Context(), yearParam)
-
-		data := make([]Delegation, len(dlgs))
-		for i := range dlgs {
-			data[i].Timestamp = dlgs[i].BlockTimestamp.UTC().Format(time.RFC3339)
-			data[i].Amount = strconv.Itoa(int(dlgs[i].Amount))
-			data[i].Delegator = dlgs[i].Sender
-			data[i].Level = strconv.Itoa(int(dlgs[i].Level))
-		}
+		res, err := ctrl.GetDelegations(request.Context(), filter, page)
 
 		switch {
 		case errors.Is(err, nil):
 			resp.WriteHeader(http.StatusOK)
 			_ = json.NewEncoder(resp).Encode(Response{
-				Data: data,
+				Data: toDelegations(res.Delegations),
+				Next: nextLink(request, res.Next),
 			})
 		default:
-			resp.WriteHeader(http.StatusInternalServerError)
-			log.Default().Println("api handler error: ", err.Error())
+			writeError(resp, request, err)
+		}
+	})
+}
+
+// delegation is the JSON representation of a delegation in responses.
+type delegation struct {
+	Timestamp     string  `json:"timestamp"`
+	Amount        string  `json:"amount"`
+	Delegator     string  `json:"delegator"`
+	Level         string  `json:"level"`
+	NewDelegate   *string `json:"newDelegate"`
+	PrevDelegate  *string `json:"prevDelegate"`
+	OperationHash string  `json:"operationHash"`
+	Status        string  `json:"status"`
+	Fee           string  `json:"fee"`
+}
+
+// toDelegations converts delegations to their JSON representation.
+func toDelegations(dlgs []repository.Delegation) []delegation {
+	data := make([]delegation, len(dlgs))
+	for i := range dlgs {
+		data[i].Timestamp = dlgs[i].BlockTimestamp.UTC().Format(time.RFC3339)
+		data[i].Amount = strconv.Itoa(int(dlgs[i].Amount))
+		data[i].Delegator = dlgs[i].Sender
+		data[i].Level = strconv.Itoa(int(dlgs[i].Level))
+		data[i].NewDelegate = nullableString(dlgs[i].NewDelegate)
+		data[i].PrevDelegate = nullableString(dlgs[i].PrevDelegate)
+		data[i].OperationHash = dlgs[i].OperationHash
+		data[i].Status = dlgs[i].Status
+		data[i].Fee = strconv.FormatInt(dlgs[i].Fee, 10)
+	}
+	return data
+}
+
+// writeError responds with HTTP-400 and a body detailing the invalid parameters on
+// validation errors, with HTTP-404 and no body when the resource does not exist, or
+// with HTTP-500 and no body otherwise, logging the error.
+func writeError(resp http.ResponseWriter, request *http.Request, err error) {
+	if errors.Is(err, repository.ErrNotFound) {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		resp.WriteHeader(http.StatusInternalServerError)
+		ctx := request.Context()
+		logging.FromContext(ctx).ErrorContext(ctx, "api handler error", "error", err)
+		return
+	}
+
+	type Response struct {
+		Error   string       `json:"error"`
+		Details []FieldError `json:"details"`
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(resp).Encode(Response{
+		Error:   "invalid query parameters",
+		Details: verr.Fields,
+	})
+}
+
+// parseDelegationQuery parses the filter and page query parameters of delegation requests.
+// Returns a *ValidationError detailing every invalid parameter.
+func parseDelegationQuery(query url.Values) (repository.DelegationFilter, repository.Page, error) {
+	verr := &ValidationError{}
+	filter := repository.DelegationFilter{Year: YearNotSpecified}
+
+	if val := query.Get("year"); val != "" {
+		_, err := fmt.Sscanf(val, "%4d", &filter.Year)
+		if err != nil || len(val) != 4 {
+			verr.Add("year", "must be in YYYY format")
+		}
+	}
+
+	for param, dst := range map[string]*string{"delegator": &filter.Delegator, "baker": &filter.Baker} {
+		if val := query.Get(param); val != "" {
+			if !isAddress(val) {
+				verr.Add(param, "must be a Tezos account address")
+			}
+			*dst = val
+		}
+	}
+
+	for param, dst := range map[string]**int32{"minLevel": &filter.MinLevel, "maxLevel": &filter.MaxLevel} {
+		if val := query.Get(param); val != "" {
+			level, err := strconv.ParseInt(val, 10, 32)
+			if err != nil || level < 0 {
+				verr.Add(param, "must be a positive integer")
+				continue
+			}
+			lvl := int32(level)
+			*dst = &lvl
+		}
+	}
+
+	for param, dst := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if val := query.Get(param); val != "" {
+			ts, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				verr.Add(param, "must be in RFC3339 format")
+				continue
+			}
+			*dst = ts
+		}
+	}
+
+	for param, dst := range map[string]**int64{"minAmount": &filter.MinAmount, "maxAmount": &filter.MaxAmount} {
+		if val := query.Get(param); val != "" {
+			amount, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || amount < 0 {
+				verr.Add(param, "must be a positive integer")
+				continue
+			}
+			*dst = &amount
 		}
+	}
+
+	page := parsePage(query, verr)
+
+	// sort details since maps are iterated in random order
+	slices.SortFunc(verr.Fields, func(a, b FieldError) int {
+		return strings.Compare(a.Parameter, b.Parameter)
 	})
+
+	return filter, page, verr.OrNil()
+}
+
+// parsePage parses the limit and cursor query parameters, recording invalid ones.
+func parsePage(query url.Values, verr *ValidationError) repository.Page {
+	page := repository.Page{Limit: DefaultLimit}
+	if val := query.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			verr.Add("limit", fmt.Sprintf("must be an integer between 1 and %d", MaxLimit))
+		}
+		page.Limit = limit
+	}
+	if val := query.Get("cursor"); val != "" {
+		cursor, err := decodeCursor(val)
+		if err != nil {
+			verr.Add("cursor", "must be a value given in a next link")
+		}
+		page.After = &cursor
+	}
+	return page
+}
+
+// isAddress returns true if the given value looks like a Tezos account address.
+func isAddress(val string) bool {
+	if len(val) != 36 {
+		return false
+	}
+	for _, prefix := range []string{"tz1", "tz2", "tz3", "tz4", "KT1"} {
+		if strings.HasPrefix(val, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// nullableString returns nil for an empty string, or a pointer to it otherwise,
+// so that missing values are encoded as JSON null.
+func nullableString(val string) *string {
+	if val == "" {
+		return nil
+	}
+	return &val
+}
+
+// nextLink returns the link to the page located by the given cursor, keeping the
+// query parameters of the request. Returns nil if there is no cursor.
+func nextLink(request *http.Request, cursor *repository.Cursor) *string {
+	if cursor == nil {
+		return nil
+	}
+	query := request.URL.Query()
+	query.Set("cursor", encodeCursor(*cursor))
+	link := request.URL.Path + "?" + query.Encode()
+	return &link
+}
+
+// encodeCursor encodes a cursor into an opaque URL-safe value.
+func encodeCursor(cursor repository.Cursor) string {
+	raw := strconv.FormatInt(cursor.BlockTimestamp.UnixNano(), 10) + "_" + strconv.FormatInt(cursor.OperationID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor decodes a cursor encoded with encodeCursor.
+func decodeCursor(val string) (repository.Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return repository.Cursor{}, err
+	}
+
+	ts, id, found := strings.Cut(string(raw), "_")
+	if !found {
+		return repository.Cursor{}, errors.New("invalid cursor")
+	}
+
+	nanos, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return repository.Cursor{}, err
+	}
+	opID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return repository.Cursor{}, err
+	}
+
+	return repository.Cursor{
+		BlockTimestamp: time.Unix(0, nanos).UTC(),
+		OperationID:    opID,
+	}, nil
 }
@@ -8,6 +8,8 @@ import (
 	"kiln-tezos-delegation/repository"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,13 +20,19 @@ import (
 type controllerMock struct {
 	GetDelegationHandlerRet   []repository.Delegation
 	GetDelegationHandlerErr   error
-	GetDelegationHandlerIn    int
+	GetDelegationHandlerNext  *repository.Cursor
+	GetDelegationHandlerIn    repository.DelegationFilter
+	GetDelegationHandlerPage  repository.Page
 	GetDelegationHandlerCount int
 }
 
-func (m *controllerMock) GetDelegations(_ context.Context, year int) ([]repository.Delegation, error) {
-	m.GetDelegationHandlerIn = year
-	return m.GetDelegationHandlerRet, m.GetDelegationHandlerErr
+func (m *controllerMock) GetDelegations(_ context.Context, filter repository.DelegationFilter, page repository.Page) (api.DelegationPage, error) {
+	m.GetDelegationHandlerIn = filter
+	m.GetDelegationHandlerPage = page
+	return api.DelegationPage{
+		Delegations: m.GetDelegationHandlerRet,
+		Next:        m.GetDelegationHandlerNext,
+	}, m.GetDelegationHandlerErr
 }
 
 func TestGetDelegationHandler(t *testing.T) {
@@ -36,6 +44,11 @@ func TestGetDelegationHandler(t *testing.T) {
 					Sender:         "addr1",
 					Level:          142,
 					Amount:         242,
+					OperationHash:  "op1",
+					Status:         "applied",
+					Fee:            342,
+					PrevDelegate:   "baker1",
+					NewDelegate:    "baker2",
 				},
 			},
 		}
@@ -55,7 +68,36 @@ func TestGetDelegationHandler(t *testing.T) {
 		assert.Equal(t, "addr1", pld["data"][0]["delegator"])
 		assert.Equal(t, "142", pld["data"][0]["level"])
 		assert.Equal(t, "242", pld["data"][0]["amount"])
-		assert.Equal(t, api.YearNotSpecified, mock.GetDelegationHandlerIn)
+		assert.Equal(t, "op1", pld["data"][0]["operationHash"])
+		assert.Equal(t, "applied", pld["data"][0]["status"])
+		assert.Equal(t, "342", pld["data"][0]["fee"])
+		assert.Equal(t, "baker1", pld["data"][0]["prevDelegate"])
+		assert.Equal(t, "baker2", pld["data"][0]["newDelegate"])
+		assert.Equal(t, repository.DelegationFilter{Year: api.YearNotSpecified}, mock.GetDelegationHandlerIn)
+		assert.Equal(t, repository.Page{Limit: api.DefaultLimit}, mock.GetDelegationHandlerPage)
+	})
+
+	t.Run("returns null delegates when missing", func(t *testing.T) {
+		mock := controllerMock{
+			GetDelegationHandlerRet: []repository.Delegation{
+				{Sender: "addr1", PrevDelegate: "baker1"}, // undelegation
+			},
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegations", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		pld := make(map[string][]map[string]any)
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, resp.Code, http.StatusOK)
+		require.Len(t, pld["data"], 1)
+		assert.Contains(t, pld["data"][0], "newDelegate")
+		assert.Nil(t, pld["data"][0]["newDelegate"])
+		assert.Equal(t, "baker1", pld["data"][0]["prevDelegate"])
 	})
 
 	t.Run("handles year query parameter", func(t *testing.T) {
@@ -81,7 +123,7 @@ func TestGetDelegationHandler(t *testing.T) {
 
 		assert.Equal(t, resp.Code, http.StatusOK)
 		assert.Len(t, pld["data"], 1)
-		assert.Equal(t, 2024, mock.GetDelegationHandlerIn)
+		assert.Equal(t, 2024, mock.GetDelegationHandlerIn.Year)
 	})
 
 	t.Run("keeps delegations ordered", func(t *testing.T) {
@@ -116,8 +158,142 @@ func TestGetDelegationHandler(t *testing.T) {
 			hdl := api.GetDelegationHandler(&mock)
 			hdl.ServeHTTP(resp, req)
 
+			pld := struct {
+				Details []api.FieldError `json:"details"`
+			}{}
+			err := json.NewDecoder(resp.Body).Decode(&pld)
+			require.NoError(t, err)
+
 			assert.Equal(t, resp.Code, http.StatusBadRequest)
-			assert.Equal(t, 0, resp.Body.Len())
+			assert.Equal(t, []api.FieldError{{Parameter: "year", Message: "must be in YYYY format"}}, pld.Details)
+			assert.Equal(t, 0, mock.GetDelegationHandlerCount)
+		}
+	})
+
+	t.Run("handles filter query parameters", func(t *testing.T) {
+		mock := controllerMock{}
+		req := httptest.NewRequest("GET", "/xtz/delegations?delegator=tz1a1SAaXRt9yoGMx29rh9FsBF4UzmvojdTL"+
+			"&baker=tz1aRoaRhSpRYvFdyvgWLL6TGyRoGF51wDjM&minLevel=100&maxLevel=200"+
+			"&from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00%2B01:00&minAmount=0&maxAmount=1000", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		minLevel, maxLevel := int32(100), int32(200)
+		minAmount, maxAmount := int64(0), int64(1000)
+		assert.Equal(t, resp.Code, http.StatusOK)
+		assert.Equal(t, repository.DelegationFilter{
+			Delegator: "tz1a1SAaXRt9yoGMx29rh9FsBF4UzmvojdTL",
+			Baker:     "tz1aRoaRhSpRYvFdyvgWLL6TGyRoGF51wDjM",
+			MinLevel:  &minLevel,
+			MaxLevel:  &maxLevel,
+			From:      time.Date(2024, 01, 01, 0, 0, 0, 0, time.UTC),
+			To:        time.Date(2024, 02, 01, 0, 0, 0, 0, time.FixedZone("", 3600)),
+			MinAmount: &minAmount,
+			MaxAmount: &maxAmount,
+		}, mock.GetDelegationHandlerIn)
+	})
+
+	t.Run("details every bad filter query parameter", func(t *testing.T) {
+		mock := controllerMock{ /* unused */ }
+		req := httptest.NewRequest("GET", "/xtz/delegations?delegator=abc&baker=tz1&minLevel=-1&maxLevel=x"+
+			"&from=2024-01-01&to=yesterday&minAmount=1.5&maxAmount=-3", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		pld := struct {
+			Error   string           `json:"error"`
+			Details []api.FieldError `json:"details"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, resp.Code, http.StatusBadRequest)
+		assert.NotEmpty(t, pld.Error)
+		params := []string{}
+		for _, detail := range pld.Details {
+			params = append(params, detail.Parameter)
+		}
+		assert.Equal(t, []string{"baker", "delegator", "from", "maxAmount", "maxLevel", "minAmount", "minLevel", "to"}, params)
+		assert.Equal(t, 0, mock.GetDelegationHandlerCount)
+	})
+
+	t.Run("status code on controller validation error", func(t *testing.T) {
+		verr := &api.ValidationError{}
+		verr.Add("from", "must be before to")
+		mock := controllerMock{
+			GetDelegationHandlerErr: verr,
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegations", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		pld := struct {
+			Details []api.FieldError `json:"details"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, resp.Code, http.StatusBadRequest)
+		assert.Equal(t, verr.Fields, pld.Details)
+	})
+
+	t.Run("returns next link with cursor", func(t *testing.T) {
+		mock := controllerMock{
+			GetDelegationHandlerRet: []repository.Delegation{{Sender: "addr1"}},
+			GetDelegationHandlerNext: &repository.Cursor{
+				BlockTimestamp: time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC),
+				OperationID:    42,
+			},
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegations?year=2024&limit=1", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		pld := struct {
+			Next *string `json:"next"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, resp.Code, http.StatusOK)
+		assert.Equal(t, 1, mock.GetDelegationHandlerPage.Limit)
+		assert.Nil(t, mock.GetDelegationHandlerPage.After)
+		require.NotNil(t, pld.Next)
+		next, err := url.Parse(*pld.Next)
+		require.NoError(t, err)
+		assert.Equal(t, "/xtz/delegations", next.Path)
+		assert.Equal(t, "2024", next.Query().Get("year"))
+		assert.Equal(t, "1", next.Query().Get("limit"))
+
+		// following the next link requests the page after the cursor
+		req = httptest.NewRequest("GET", *pld.Next, http.NoBody)
+		resp = httptest.NewRecorder()
+		hdl.ServeHTTP(resp, req)
+
+		assert.Equal(t, resp.Code, http.StatusOK)
+		assert.Equal(t, mock.GetDelegationHandlerNext, mock.GetDelegationHandlerPage.After)
+	})
+
+	t.Run("status code on bad pagination query parameters", func(t *testing.T) {
+		testCases := []string{"limit=0", "limit=abc", "limit=10001", "cursor=abc", "cursor=!!!"}
+		for _, val := range testCases {
+			mock := controllerMock{ /* unused */ }
+			req := httptest.NewRequest("GET", "/xtz/delegations?"+val, http.NoBody)
+			resp := httptest.NewRecorder()
+
+			hdl := api.GetDelegationHandler(&mock)
+			hdl.ServeHTTP(resp, req)
+
+			assert.Equal(t, resp.Code, http.StatusBadRequest, val)
+			assert.Contains(t, resp.Body.String(), strings.Split(val, "=")[0], val)
 			assert.Equal(t, 0, mock.GetDelegationHandlerCount)
 		}
 	})
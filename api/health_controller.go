@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultMaxReadyLag is the number of levels ingestion may lag behind the chain
+	// head before the service is reported as not ready, unless configured otherwise.
+	DefaultMaxReadyLag = 10
+	// readinessTimeout bounds the duration of readiness checks.
+	readinessTimeout = 2 * time.Second
+)
+
+type HealthRepository interface {
+	Ping(context.Context) error
+}
+
+// IngestionMonitor reports the progress of delegation ingestion.
+type IngestionMonitor interface {
+	// LastSuccess returns the end time of the last successful ingestion cycle, zero if none
+	LastSuccess() time.Time
+	// Lag returns the number of levels between the chain head and the level up to
+	// which every delegation is stored, false if unknown
+	Lag() (int32, bool)
+}
+
+// Readiness is the state of the components the service depends on.
+type Readiness struct {
+	// Failure of the database check, nil if the database is reachable
+	Database error
+	// Ingestion progress, nil if ingestion does not run in this process
+	Ingestion *IngestionReadiness
+}
+
+// IngestionReadiness is the progress of delegation ingestion.
+type IngestionReadiness struct {
+	// End time of the last successful ingestion cycle, zero if none
+	LastSuccess time.Time
+	// Number of levels behind the chain head, when known
+	Lag      int32
+	LagKnown bool
+	// Maximum lag for the service to be ready
+	MaxLag int32
+}
+
+// Lagging returns true if ingestion is known to lag further than allowed.
+func (r IngestionReadiness) Lagging() bool {
+	return r.LagKnown && r.Lag > r.MaxLag
+}
+
+// Ready returns true if every component is ready.
+func (r Readiness) Ready() bool {
+	return r.Database == nil && (r.Ingestion == nil || !r.Ingestion.Lagging())
+}
+
+type HealthController struct {
+	repo      HealthRepository
+	ingestion IngestionMonitor
+	maxLag    int32
+}
+
+// NewHealthController creates a controller checking the given repository, and the
+// lag of the given ingestion against the given maximum. The ingestion monitor may be
+// nil when ingestion does not run in this process.
+func NewHealthController(repo HealthRepository, ingestion IngestionMonitor, maxLag int32) HealthController {
+	return HealthController{
+		repo:      repo,
+		ingestion: ingestion,
+		maxLag:    maxLag,
+	}
+}
+
+// GetReadiness pings the database and gets the ingestion progress. The database check
+// is bounded by a short timeout, so that an unresponsive database fails it.
+func (c HealthController) GetReadiness(ctx context.Context) Readiness {
+	cctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	res := Readiness{Database: c.repo.Ping(cctx)}
+	if c.ingestion != nil {
+		lag, ok := c.ingestion.Lag()
+		res.Ingestion = &IngestionReadiness{
+			LastSuccess: c.ingestion.LastSuccess(),
+			Lag:         lag,
+			LagKnown:    ok,
+			MaxLag:      c.maxLag,
+		}
+	}
+	return res
+}
@@ -0,0 +1,92 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/api"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type healthRepositoryMock struct {
+	PingErr   error
+	PingCount int
+}
+
+func (m *healthRepositoryMock) Ping(context.Context) error {
+	m.PingCount++
+	return m.PingErr
+}
+
+type ingestionMonitorMock struct {
+	LastSuccessRet time.Time
+	LagRet         int32
+	LagOk          bool
+}
+
+func (m ingestionMonitorMock) LastSuccess() time.Time {
+	return m.LastSuccessRet
+}
+
+func (m ingestionMonitorMock) Lag() (int32, bool) {
+	return m.LagRet, m.LagOk
+}
+
+func TestHealthController(t *testing.T) {
+	ts := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+
+	t.Run("ready when database is reachable and ingestion is up to date", func(t *testing.T) {
+		repo := healthRepositoryMock{}
+		ctrl := api.NewHealthController(&repo, ingestionMonitorMock{LastSuccessRet: ts, LagRet: 10, LagOk: true}, 10)
+
+		res := ctrl.GetReadiness(context.Background())
+
+		assert.True(t, res.Ready())
+		assert.Equal(t, 1, repo.PingCount)
+		require.NotNil(t, res.Ingestion)
+		assert.Equal(t, api.IngestionReadiness{LastSuccess: ts, Lag: 10, LagKnown: true, MaxLag: 10}, *res.Ingestion)
+	})
+
+	t.Run("not ready when database is unreachable", func(t *testing.T) {
+		repo := healthRepositoryMock{PingErr: errors.New("fake database error")}
+		ctrl := api.NewHealthController(&repo, ingestionMonitorMock{LagOk: true}, 10)
+
+		res := ctrl.GetReadiness(context.Background())
+
+		assert.False(t, res.Ready())
+		assert.Error(t, res.Database)
+	})
+
+	t.Run("not ready when ingestion lags too far behind", func(t *testing.T) {
+		repo := healthRepositoryMock{}
+		ctrl := api.NewHealthController(&repo, ingestionMonitorMock{LastSuccessRet: ts, LagRet: 11, LagOk: true}, 10)
+
+		res := ctrl.GetReadiness(context.Background())
+
+		assert.False(t, res.Ready())
+		require.NotNil(t, res.Ingestion)
+		assert.True(t, res.Ingestion.Lagging())
+	})
+
+	t.Run("ready when ingestion lag is unknown", func(t *testing.T) {
+		repo := healthRepositoryMock{}
+		ctrl := api.NewHealthController(&repo, ingestionMonitorMock{}, 10)
+
+		res := ctrl.GetReadiness(context.Background())
+
+		assert.True(t, res.Ready())
+	})
+
+	t.Run("ready without ingestion", func(t *testing.T) {
+		repo := healthRepositoryMock{}
+		ctrl := api.NewHealthController(&repo, nil, 10)
+
+		res := ctrl.GetReadiness(context.Background())
+
+		assert.True(t, res.Ready())
+		assert.Nil(t, res.Ingestion)
+	})
+}
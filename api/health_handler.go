@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type ReadinessController interface {
+	GetReadiness(context.Context) Readiness
+}
+
+// GetHealthHandler handles requests to check the process is alive, without checking
+// any dependency. Always responds with HTTP-200.
+func GetHealthHandler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		defer request.Body.Close()
+
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		_, _ = resp.Write([]byte(`{"status":"ok"}` + "\n"))
+	})
+}
+
+// GetReadinessHandler handles requests to check the service is ready: the database
+// is reachable, and ingestion does not lag behind the chain head further than allowed.
+// Responds with HTTP-200 if so, with HTTP-503 otherwise, and a body detailing the
+// state of each component either way.
+func GetReadinessHandler(ctrl ReadinessController) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		defer request.Body.Close()
+
+		type Component struct {
+			Status      string  `json:"status"`
+			Error       *string `json:"error,omitempty"`
+			LastSuccess *string `json:"lastSuccess,omitempty"`
+			Lag         *int32  `json:"lag,omitempty"`
+			MaxLag      *int32  `json:"maxLag,omitempty"`
+		}
+		type Response struct {
+			Status     string               `json:"status"`
+			Components map[string]Component `json:"components"`
+		}
+
+		res := ctrl.GetReadiness(request.Context())
+
+		body := Response{Status: "ready", Components: map[string]Component{}}
+		status := http.StatusOK
+		if !res.Ready() {
+			body.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+
+		db := Component{Status: "up"}
+		if res.Database != nil {
+			db.Status = "down"
+			msg := res.Database.Error()
+			db.Error = &msg
+		}
+		body.Components["database"] = db
+
+		if res.Ingestion != nil {
+			ing := Component{Status: "up", MaxLag: &res.Ingestion.MaxLag}
+			switch {
+			case !res.Ingestion.LagKnown:
+				ing.Status = "unknown"
+			case res.Ingestion.Lagging():
+				ing.Status = "lagging"
+			}
+			if res.Ingestion.LagKnown {
+				ing.Lag = &res.Ingestion.Lag
+			}
+			if !res.Ingestion.LastSuccess.IsZero() {
+				last := res.Ingestion.LastSuccess.UTC().Format(time.RFC3339)
+				ing.LastSuccess = &last
+			}
+			body.Components["ingestion"] = ing
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(status)
+		_ = json.NewEncoder(resp).Encode(body)
+	})
+}
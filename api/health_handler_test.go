@@ -0,0 +1,119 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type readinessControllerMock struct {
+	GetReadinessRet   api.Readiness
+	GetReadinessCount int
+}
+
+func (m *readinessControllerMock) GetReadiness(context.Context) api.Readiness {
+	m.GetReadinessCount++
+	return m.GetReadinessRet
+}
+
+func TestGetHealthHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "/healthz", http.NoBody)
+	resp := httptest.NewRecorder()
+
+	api.GetHealthHandler().ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, resp.Body.String())
+}
+
+func TestGetReadinessHandler(t *testing.T) {
+	ts := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+
+	t.Run("ok when ready", func(t *testing.T) {
+		mock := readinessControllerMock{
+			GetReadinessRet: api.Readiness{
+				Ingestion: &api.IngestionReadiness{LastSuccess: ts, Lag: 0, LagKnown: true, MaxLag: 10},
+			},
+		}
+		req := httptest.NewRequest("GET", "/readyz", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		api.GetReadinessHandler(&mock).ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, 1, mock.GetReadinessCount)
+		assert.JSONEq(t, `{
+			"status": "ready",
+			"components": {
+				"database": {"status": "up"},
+				"ingestion": {"status": "up", "lastSuccess": "2024-06-26T10:02:33Z", "lag": 0, "maxLag": 10}
+			}
+		}`, resp.Body.String())
+	})
+
+	t.Run("ok when ingestion lag is unknown", func(t *testing.T) {
+		mock := readinessControllerMock{
+			GetReadinessRet: api.Readiness{
+				Ingestion: &api.IngestionReadiness{MaxLag: 10},
+			},
+		}
+		req := httptest.NewRequest("GET", "/readyz", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		api.GetReadinessHandler(&mock).ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.JSONEq(t, `{
+			"status": "ready",
+			"components": {
+				"database": {"status": "up"},
+				"ingestion": {"status": "unknown", "maxLag": 10}
+			}
+		}`, resp.Body.String())
+	})
+
+	t.Run("service unavailable when ingestion lags", func(t *testing.T) {
+		mock := readinessControllerMock{
+			GetReadinessRet: api.Readiness{
+				Ingestion: &api.IngestionReadiness{LastSuccess: ts, Lag: 42, LagKnown: true, MaxLag: 10},
+			},
+		}
+		req := httptest.NewRequest("GET", "/readyz", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		api.GetReadinessHandler(&mock).ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+		assert.JSONEq(t, `{
+			"status": "unavailable",
+			"components": {
+				"database": {"status": "up"},
+				"ingestion": {"status": "lagging", "lastSuccess": "2024-06-26T10:02:33Z", "lag": 42, "maxLag": 10}
+			}
+		}`, resp.Body.String())
+	})
+
+	t.Run("service unavailable when database is down", func(t *testing.T) {
+		mock := readinessControllerMock{
+			GetReadinessRet: api.Readiness{Database: errors.New("connection refused")},
+		}
+		req := httptest.NewRequest("GET", "/readyz", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		api.GetReadinessHandler(&mock).ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+		assert.JSONEq(t, `{
+			"status": "unavailable",
+			"components": {
+				"database": {"status": "down", "error": "connection refused"}
+			}
+		}`, resp.Body.String())
+	})
+}
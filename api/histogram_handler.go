@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kiln-tezos-delegation/repository"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultHistogramPeriod is the period of the histogram when not specified.
+const DefaultHistogramPeriod = 365 * 24 * time.Hour
+
+type HistogramController interface {
+	GetDelegationHistogram(context.Context, repository.Interval, time.Time, time.Time) ([]repository.Bucket, error)
+}
+
+// GetDelegationHistogramHandler handles GET requests to fetch the number and summed
+// amount of applied delegations by time bucket. The interval query parameter sets the bucket
+// size to "day" (default), "week" or "month". The period is set by the from (inclusive)
+// and to (exclusive) query parameters in RFC3339 format, the last 365 days by default.
+// Only non-empty buckets are returned, oldest first.
+// Responds with a specific HTTP status if method is invalid, and with HTTP-400 and a
+// body detailing every invalid query parameter.
+func GetDelegationHistogramHandler(ctrl HistogramController) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		defer request.Body.Close()
+
+		if request.Method != http.MethodGet {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		verr := &ValidationError{}
+		interval := repository.IntervalDay
+		if val := request.URL.Query().Get("interval"); val != "" {
+			interval = repository.Interval(val)
+			switch interval {
+			case repository.IntervalDay, repository.IntervalWeek, repository.IntervalMonth:
+			default:
+				verr.Add("interval", "must be one of day, week or month")
+			}
+		}
+
+		to := time.Now().UTC()
+		if val := request.URL.Query().Get("to"); val != "" {
+			ts, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				verr.Add("to", "must be in RFC3339 format")
+			}
+			to = ts
+		}
+		from := to.Add(-DefaultHistogramPeriod)
+		if val := request.URL.Query().Get("from"); val != "" {
+			ts, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				verr.Add("from", "must be in RFC3339 format")
+			}
+			from = ts
+		}
+
+		if err := verr.OrNil(); err != nil {
+			writeError(resp, request, err)
+			return
+		}
+
+		type Bucket struct {
+			Start  string `json:"start"`
+			Count  int64  `json:"count"`
+			Amount string `json:"amount"`
+		}
+
+		type Response struct {
+			Interval string   `json:"interval"`
+			Data     []Bucket `json:"data"`
+		}
+
+		bkts, err := ctrl.GetDelegationHistogram(request.Context(), interval, from, to)
+
+		switch {
+		case errors.Is(err, nil):
+			data := make([]Bucket, len(bkts))
+			for i := range bkts {
+				data[i].Start = bkts[i].Start.UTC().Format(time.RFC3339)
+				data[i].Count = bkts[i].Count
+				data[i].Amount = strconv.FormatInt(bkts[i].Amount, 10)
+			}
+			resp.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(resp).Encode(Response{
+				Interval: string(interval),
+				Data:     data,
+			})
+		default:
+			writeError(resp, request, err)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/repository"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type histogramControllerMock struct {
+	GetDelegationHistogramRet        []repository.Bucket
+	GetDelegationHistogramErr        error
+	GetDelegationHistogramCount      int
+	GetDelegationHistogramInInterval repository.Interval
+	GetDelegationHistogramInFrom     time.Time
+	GetDelegationHistogramInTo       time.Time
+}
+
+func (m *histogramControllerMock) GetDelegationHistogram(_ context.Context, interval repository.Interval, from, to time.Time) ([]repository.Bucket, error) {
+	m.GetDelegationHistogramCount++
+	m.GetDelegationHistogramInInterval = interval
+	m.GetDelegationHistogramInFrom = from
+	m.GetDelegationHistogramInTo = to
+	return m.GetDelegationHistogramRet, m.GetDelegationHistogramErr
+}
+
+func TestGetDelegationHistogramHandler(t *testing.T) {
+	t.Run("successfully return data", func(t *testing.T) {
+		mock := histogramControllerMock{
+			GetDelegationHistogramRet: []repository.Bucket{
+				{Start: time.Date(2024, 05, 01, 0, 0, 0, 0, time.UTC), Count: 3, Amount: 300},
+				{Start: time.Date(2024, 06, 01, 0, 0, 0, 0, time.UTC), Count: 1, Amount: 100},
+			},
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegations/histogram?interval=month&from=2024-05-01T00:00:00Z&to=2024-07-01T00:00:00Z", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHistogramHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		pld := struct {
+			Interval string `json:"interval"`
+			Data     []struct {
+				Start  string `json:"start"`
+				Count  int64  `json:"count"`
+				Amount string `json:"amount"`
+			} `json:"data"`
+		}{}
+		err := json.NewDecoder(resp.Body).Decode(&pld)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "month", pld.Interval)
+		require.Len(t, pld.Data, 2)
+		assert.Equal(t, "2024-05-01T00:00:00Z", pld.Data[0].Start)
+		assert.Equal(t, int64(3), pld.Data[0].Count)
+		assert.Equal(t, "300", pld.Data[0].Amount)
+		assert.Equal(t, repository.IntervalMonth, mock.GetDelegationHistogramInInterval)
+		assert.Equal(t, time.Date(2024, 05, 01, 0, 0, 0, 0, time.UTC), mock.GetDelegationHistogramInFrom)
+		assert.Equal(t, time.Date(2024, 07, 01, 0, 0, 0, 0, time.UTC), mock.GetDelegationHistogramInTo)
+	})
+
+	t.Run("defaults to daily buckets over last days", func(t *testing.T) {
+		mock := histogramControllerMock{}
+		req := httptest.NewRequest("GET", "/xtz/delegations/histogram", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHistogramHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, repository.IntervalDay, mock.GetDelegationHistogramInInterval)
+		assert.WithinDuration(t, time.Now(), mock.GetDelegationHistogramInTo, time.Second)
+		assert.Equal(t, api.DefaultHistogramPeriod, mock.GetDelegationHistogramInTo.Sub(mock.GetDelegationHistogramInFrom))
+	})
+
+	t.Run("status code on bad query parameters", func(t *testing.T) {
+		testCases := map[string]string{
+			"interval=hour":  "interval",
+			"from=yesterday": "from",
+			"to=2024-01-01":  "to",
+		}
+		for query, param := range testCases {
+			mock := histogramControllerMock{ /* unused */ }
+			req := httptest.NewRequest("GET", "/xtz/delegations/histogram?"+query, http.NoBody)
+			resp := httptest.NewRecorder()
+
+			hdl := api.GetDelegationHistogramHandler(&mock)
+			hdl.ServeHTTP(resp, req)
+
+			pld := struct {
+				Details []api.FieldError `json:"details"`
+			}{}
+			err := json.NewDecoder(resp.Body).Decode(&pld)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusBadRequest, resp.Code, query)
+			require.Len(t, pld.Details, 1, query)
+			assert.Equal(t, param, pld.Details[0].Parameter, query)
+			assert.Equal(t, 0, mock.GetDelegationHistogramCount)
+		}
+	})
+
+	t.Run("status code on controller error", func(t *testing.T) {
+		mock := histogramControllerMock{
+			GetDelegationHistogramErr: errors.New("fake controller error"),
+		}
+		req := httptest.NewRequest("GET", "/xtz/delegations/histogram", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHistogramHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, 0, resp.Body.Len())
+	})
+
+	t.Run("status code on bad method", func(t *testing.T) {
+		mock := histogramControllerMock{}
+		req := httptest.NewRequest("POST", "/xtz/delegations/histogram", http.NoBody)
+		resp := httptest.NewRecorder()
+
+		hdl := api.GetDelegationHistogramHandler(&mock)
+		hdl.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+		assert.Equal(t, 0, mock.GetDelegationHistogramCount)
+	})
+}
@@ -2,32 +2,84 @@ package api
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
 	"time"
 )
 
 const GRACE_PERIOD = 10 * time.Second
 
+// VersionPrefix is the path prefix of the current version of the REST API.
+const VersionPrefix = "/v1"
+
 type Server struct {
 	http.Server
 }
 
-// NewServer returns a mono-endpoint REST API server listening to connections on the given
-// address, and binding the given handler with the given route to it. Requests on any
-// unsupported route will be responded to with HTTP-404.
-func NewServer(addr, route string, hdl http.Handler) *Server {
+// Middleware wraps a handler with additional behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Route binds a handler to requests with the given method on the given path pattern.
+type Route struct {
+	// HTTP method, any method if empty
+	Method string
+	// http.ServeMux path pattern, possibly holding path parameters, e.g. "/xtz/bakers/{address}"
+	Pattern string
+	Handler http.Handler
+	// Middlewares applied to the handler of this route only, the first one being the outermost
+	Middlewares []Middleware
+	// Unversioned mounts the route without the version prefix too, for clients
+	// which used the REST API before it was versioned
+	Unversioned bool
+	// Operational mounts the route without the version prefix only, for endpoints
+	// which are not part of the REST API, e.g. metrics
+	Operational bool
+}
+
+// NewServer returns a REST API server listening to connections on the given address,
+// and binding the given routes to it under the VersionPrefix path prefix. Routes
+// flagged as unversioned are bound without the prefix as well, and operational ones
+// without the prefix only. The given middlewares apply to every request, the first
+// one being the outermost. Requests on any unsupported route will be responded to
+// with HTTP-404, or HTTP-405 if only the method is unsupported.
+// The number and duration of requests are recorded as metrics by route, and every
+// request is logged with the given logger along with its ID.
+func NewServer(addr string, logger *slog.Logger, routes []Route, middlewares ...Middleware) *Server {
 	mux := http.NewServeMux()
-	mux.Handle(route, hdl)
+	for _, route := range routes {
+		hdl := instrument(route.Pattern, chain(route.Handler, route.Middlewares...))
+		method := ""
+		if route.Method != "" {
+			method = route.Method + " "
+		}
+		if route.Operational {
+			mux.Handle(method+route.Pattern, hdl)
+			continue
+		}
+		mux.Handle(method+VersionPrefix+route.Pattern, hdl)
+		if route.Unversioned {
+			mux.Handle(method+route.Pattern, hdl)
+		}
+	}
+
 	return &Server{
 		Server: http.Server{
 			Addr:         addr,
-			Handler:      mux,
+			Handler:      accessLog(logger, chain(mux, middlewares...)),
 			ReadTimeout:  10 * time.Second,
 			WriteTimeout: 10 * time.Second,
 		},
 	}
 }
 
+// chain wraps the handler with the given middlewares, the first one being the outermost.
+func chain(hdl http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		hdl = middlewares[i](hdl)
+	}
+	return hdl
+}
+
 // Start starts the server until the context is cancelled.
 // Ensures a grace period configured by GRACE_PERIOD to let
 // pending requests been processed with interruption.
@@ -1,86 +1,283 @@
 package api_test
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/logging"
+	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestServerRouting(t *testing.T) {
+	hdlMock := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write([]byte(request.PathValue("address")))
+	})
+
+	routes := []api.Route{
+		{Method: http.MethodGet, Pattern: "/xtz/delegations", Handler: hdlMock, Unversioned: true},
+		{Method: http.MethodGet, Pattern: "/xtz/bakers/{address}/stats", Handler: hdlMock},
+	}
+
 	t.Run("ok on supported endpoint route", func(t *testing.T) {
-		port, err := getFreePort()
+		baseURL := startServer(t, routes)
+
+		resp, err := http.Get(baseURL + "/v1/xtz/delegations")
 		require.NoError(t, err)
+		defer resp.Body.Close()
 
-		hdlMock := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			writer.WriteHeader(http.StatusOK)
-		})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
 
-		srv := api.NewServer(":"+strconv.Itoa(port), "/xtz/delegations", hdlMock)
+	t.Run("ok on unversioned endpoint route", func(t *testing.T) {
+		baseURL := startServer(t, routes)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+		resp, err := http.Get(baseURL + "/xtz/delegations")
+		require.NoError(t, err)
+		defer resp.Body.Close()
 
-		// warning: running server in a go routine might introduce a race condition
-		go func() {
-			err := srv.Start(ctx)
-			if err != nil {
-				t.Errorf("Could not start HTTP server: %s", err)
-			}
-		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
 
-		if ok := waitConnect(port, 5*time.Second); !ok {
-			t.Fatal("Connection timeout to localhost server")
-		}
+	t.Run("ko on versioned only endpoint route without version", func(t *testing.T) {
+		baseURL := startServer(t, routes)
 
-		resp, err := http.Get("http://localhost:" + strconv.Itoa(port) + "/xtz/delegations")
-		if err != nil {
-			t.Fatal(err)
-		}
+		resp, err := http.Get(baseURL + "/xtz/bakers/addr1/stats")
+		require.NoError(t, err)
 		defer resp.Body.Close()
 
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("passes path parameters", func(t *testing.T) {
+		baseURL := startServer(t, routes)
+
+		resp, err := http.Get(baseURL + "/v1/xtz/bakers/addr1/stats")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "addr1", string(body))
 	})
 
 	t.Run("ko on unsupported endpoint route", func(t *testing.T) {
-		port, err := getFreePort()
+		baseURL := startServer(t, routes)
+
+		resp, err := http.Get(baseURL + "/unsupported")
 		require.NoError(t, err)
+		defer resp.Body.Close()
 
-		hdlMock := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			writer.WriteHeader(http.StatusOK)
-		})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
 
-		srv := api.NewServer(":"+strconv.Itoa(port), "/xtz/delegations", hdlMock)
+	t.Run("ko on unsupported method", func(t *testing.T) {
+		baseURL := startServer(t, routes)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+		resp, err := http.Post(baseURL+"/v1/xtz/delegations", "application/json", http.NoBody)
+		require.NoError(t, err)
+		defer resp.Body.Close()
 
-		// warning: running server in a go routine might introduce a race condition
-		go func() {
-			err = srv.Start(ctx)
-			if err != nil {
-				t.Errorf("Could not start HTTP server: %s", err)
-			}
-		}()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
 
-		if ok := waitConnect(port, 5*time.Second); !ok {
-			t.Fatal("Connection timeout to localhost server")
+	t.Run("applies server then route middlewares in order", func(t *testing.T) {
+		calls := []string{}
+		middleware := func(name string) api.Middleware {
+			return func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+					calls = append(calls, name)
+					next.ServeHTTP(writer, request)
+				})
+			}
 		}
 
-		resp, err := http.Get("http://localhost:" + strconv.Itoa(port) + "/unsupported")
-		if err != nil {
-			t.Fatal(err)
-		}
+		baseURL := startServer(t, []api.Route{
+			{
+				Method:      http.MethodGet,
+				Pattern:     "/xtz/delegations",
+				Handler:     hdlMock,
+				Middlewares: []api.Middleware{middleware("route1"), middleware("route2")},
+			},
+		}, middleware("server1"), middleware("server2"))
+
+		resp, err := http.Get(baseURL + "/v1/xtz/delegations")
+		require.NoError(t, err)
 		defer resp.Body.Close()
 
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"server1", "server2", "route1", "route2"}, calls)
+	})
+
+	t.Run("ok on operational route without version only", func(t *testing.T) {
+		baseURL := startServer(t, []api.Route{
+			{Method: http.MethodGet, Pattern: "/metrics", Handler: hdlMock, Operational: true},
+		})
+
+		resp, err := http.Get(baseURL + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, err = http.Get(baseURL + "/v1/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
 		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 	})
+
+	t.Run("records request metrics by route", func(t *testing.T) {
+		baseURL := startServer(t, append(routes,
+			api.Route{Method: http.MethodGet, Pattern: "/metrics", Handler: promhttp.Handler(), Operational: true},
+		))
+
+		resp, err := http.Get(baseURL + "/v1/xtz/bakers/addr1/stats")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		resp, err = http.Get(baseURL + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), `tezos_delegation_http_requests_total{code="200",method="GET",route="/xtz/bakers/{address}/stats"}`)
+		assert.Contains(t, string(body), `tezos_delegation_http_request_duration_seconds_count{code="200",method="GET",route="/xtz/bakers/{address}/stats"}`)
+	})
+}
+
+func TestServerAccessLog(t *testing.T) {
+	routes := []api.Route{
+		{Method: http.MethodGet, Pattern: "/ok", Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			logging.FromContext(request.Context()).InfoContext(request.Context(), "handling")
+			_, _ = writer.Write([]byte("done"))
+		})},
+		{Method: http.MethodGet, Pattern: "/ko", Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusInternalServerError)
+		})},
+	}
+
+	t.Run("logs requests with generated ID", func(t *testing.T) {
+		logs := &syncBuffer{}
+		baseURL := startLoggedServer(t, logging.New(logs, slog.LevelInfo, logging.FormatText), routes)
+
+		resp, err := http.Get(baseURL + "/v1/ok")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		id := resp.Header.Get(api.RequestIDHeader)
+		assert.Regexp(t, `^[0-9a-f]{16}$`, id)
+		assert.Eventually(t, func() bool {
+			return strings.Contains(logs.String(), "msg=\"request handled\"")
+		}, time.Second, 10*time.Millisecond)
+		assert.Contains(t, logs.String(), "level=INFO msg=handling request_id="+id)
+		assert.Contains(t, logs.String(), "method=GET path=/v1/ok status=200 bytes=4")
+		assert.Contains(t, logs.String(), "request_id="+id+"\n")
+	})
+
+	t.Run("logs requests with passed ID", func(t *testing.T) {
+		logs := &syncBuffer{}
+		baseURL := startLoggedServer(t, logging.New(logs, slog.LevelInfo, logging.FormatText), routes)
+
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/v1/ok", nil)
+		require.NoError(t, err)
+		req.Header.Set(api.RequestIDHeader, "client-id-42")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, "client-id-42", resp.Header.Get(api.RequestIDHeader))
+		assert.Eventually(t, func() bool {
+			return strings.Contains(logs.String(), "request_id=client-id-42\n")
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("replaces invalid passed ID", func(t *testing.T) {
+		baseURL := startLoggedServer(t, logging.New(io.Discard, slog.LevelInfo, logging.FormatText), routes)
+
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/v1/ok", nil)
+		require.NoError(t, err)
+		req.Header.Set(api.RequestIDHeader, strings.Repeat("a", 200))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Regexp(t, `^[0-9a-f]{16}$`, resp.Header.Get(api.RequestIDHeader))
+	})
+
+	t.Run("logs server errors at error level", func(t *testing.T) {
+		logs := &syncBuffer{}
+		baseURL := startLoggedServer(t, logging.New(logs, slog.LevelInfo, logging.FormatText), routes)
+
+		resp, err := http.Get(baseURL + "/v1/ko")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Eventually(t, func() bool {
+			return strings.Contains(logs.String(), "level=ERROR msg=\"request handled\" method=GET path=/v1/ko status=500")
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+// syncBuffer is a buffer safe from concurrency, to read logs written by servers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startServer starts a server with the given routes and middlewares on a free port
+// until the end of the test, and returns its base URL.
+func startServer(t *testing.T, routes []api.Route, middlewares ...api.Middleware) string {
+	return startLoggedServer(t, slog.Default(), routes, middlewares...)
+}
+
+// startLoggedServer starts a server as startServer does, logging with the given logger.
+func startLoggedServer(t *testing.T, logger *slog.Logger, routes []api.Route, middlewares ...api.Middleware) string {
+	port, err := getFreePort()
+	require.NoError(t, err)
+
+	srv := api.NewServer(":"+strconv.Itoa(port), logger, routes, middlewares...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// warning: running server in a go routine might introduce a race condition
+	go func() {
+		err := srv.Start(ctx)
+		if err != nil {
+			t.Errorf("Could not start HTTP server: %s", err)
+		}
+	}()
+
+	if ok := waitConnect(port, 5*time.Second); !ok {
+		t.Fatal("Connection timeout to localhost server")
+	}
+
+	return "http://localhost:" + strconv.Itoa(port)
 }
 
 // getFreePort returns a random available port.
@@ -96,12 +293,17 @@ func getFreePort() (port int, err error) {
 	return
 }
 
-// waitConnect tries to connect to the localhost on the given port and returns true if it succeeded.
+// waitConnect tries to connect to the localhost on the given port until the timeout,
+// and returns true if it succeeded.
 func waitConnect(port int, timeout time.Duration) bool {
-	conn, err := net.DialTimeout("tcp", "localhost:"+strconv.Itoa(port), timeout)
-	if err == nil && conn != nil {
-		defer conn.Close()
-		return true
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", "localhost:"+strconv.Itoa(port), time.Until(deadline))
+		if err == nil && conn != nil {
+			conn.Close()
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 	return false
 }
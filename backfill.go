@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"kiln-tezos-delegation/tezos"
+	"time"
+)
+
+// runBackfill stores the delegations of a historical level range given by the
+// command-line arguments, then returns.
+func runBackfill(ctx context.Context, args []string) error {
+	var fromLevel, toLevel, workers, rangeSize int
+	var rate float64
+	conf, _, err := loadConfig("backfill", args, func(flags *flag.FlagSet) {
+		flags.IntVar(&fromLevel, "from-level", 0, "first level to backfill, inclusive")
+		flags.IntVar(&toLevel, "to-level", 0, "last level to backfill, exclusive")
+		flags.IntVar(&workers, "workers", tezos.DefaultBackfillWorkers, "number of ranges backfilled concurrently")
+		flags.IntVar(&rangeSize, "range-size", tezos.DefaultBackfillRangeSize, "number of levels per range")
+		flags.Float64Var(&rate, "rate", 10, "maximum number of TzKT API requests per second, 0 for no limit")
+	})
+	if err != nil {
+		return err
+	}
+	if fromLevel < 0 || toLevel <= fromLevel {
+		return errors.New("backfill: --to-level must be greater than --from-level")
+	}
+	if conf.DB.Driver == "memory" {
+		return errors.New("backfill: delegations stored in memory would be lost on exit")
+	}
+
+	logger := initLogger(conf)
+	repo := initStore(ctx, conf, logger)
+
+	// a single limiter for every TzKT instance, so that the rate is global
+	client := initTezosClient(conf, logger, tezos.WithRateLimiter(tezos.NewRateLimiter(rate)))
+
+	bf := tezos.NewBackfiller(client, repo, workers, int32(rangeSize), logger.With("component", "backfiller"))
+	report, err := bf.Run(ctx, int32(fromLevel), int32(toLevel))
+	logger.Info("backfill finished", "ranges", report.Ranges, "skipped", report.Skipped, "fetched", report.Fetched,
+		"inserted", report.Inserted, "elapsed", report.Elapsed.Round(time.Second), "throughput", report.Throughput())
+	if err != nil {
+		return fmt.Errorf("backfill error: %w", err)
+	}
+	return nil
+}
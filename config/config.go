@@ -0,0 +1,464 @@
+// Package config loads the configuration of the component from, by increasing
+// precedence, defaults, a YAML file, environment variables and command-line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/logging"
+	"kiln-tezos-delegation/tezos"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets when the configuration is printed.
+const redacted = "<redacted>"
+
+// Config is the configuration of the component.
+type Config struct {
+	API       API       `yaml:"api"`
+	DB        DB        `yaml:"db"`
+	Tezos     Tezos     `yaml:"tezos"`
+	Ingestion Ingestion `yaml:"ingestion"`
+	Log       Log       `yaml:"log"`
+}
+
+// API configures the REST API server.
+type API struct {
+	// Address listened to, e.g. "localhost:8080"
+	Addr string `yaml:"addr"`
+	// Number of levels ingestion may lag behind the chain head before readiness fails
+	ReadyMaxLag int `yaml:"readyMaxLag"`
+}
+
+// DB configures the storage of delegations.
+type DB struct {
+	// Either "postgres", "sqlite", or "memory" to keep delegations in memory, lost on exit
+	Driver string `yaml:"driver"`
+	// SQLite database file, created if needed
+	Path string `yaml:"path,omitempty"`
+	// Host name and port, e.g. "localhost:5432"
+	Host     string `yaml:"host"`
+	Database string `yaml:"database"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password,omitempty"`
+	// File the password is read from, instead of Password
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+	// Apply pending migrations at startup
+	Migrate bool `yaml:"migrate"`
+}
+
+// URL returns the connection URL of the PostgreSQL database.
+func (db DB) URL() string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(db.User, db.Password),
+		Host:   db.Host,
+		Path:   "/" + db.Database,
+	}
+	return u.String()
+}
+
+// Tezos configures the source of delegations.
+type Tezos struct {
+	// Either "tzkt" or "node"
+	Source string `yaml:"source"`
+	// Tezos node RPC URL, with the node source
+	NodeURL string `yaml:"nodeURL,omitempty"`
+	// TzKT API URLs, by decreasing priority, with the tzkt source
+	TzktBaseURLs []string `yaml:"tzktBaseURLs"`
+	// Number of levels a TzKT instance may lag behind the most advanced one
+	MaxLag int `yaml:"maxLag"`
+	// Cross-check every page of delegations against another TzKT instance
+	CrossCheck bool `yaml:"crossCheck"`
+	// Number of delegations fetched per request
+	PageSize int `yaml:"pageSize"`
+}
+
+// Ingestion configures how delegations are ingested.
+type Ingestion struct {
+	// Either "polling" or "streaming"
+	Mode string `yaml:"mode"`
+	// Time to start from instead of the stored checkpoint, zero if none
+	Since time.Time `yaml:"since,omitempty"`
+	// Whether instances elect a leader, the only one to ingest, so that replicas do not
+	// ingest the same delegations concurrently
+	LeaderElection bool `yaml:"leaderElection"`
+}
+
+// Log configures logging.
+type Log struct {
+	Level  slog.Level     `yaml:"level"`
+	Format logging.Format `yaml:"format"`
+}
+
+// Default returns the default configuration.
+func Default() Config {
+	return Config{
+		API: API{
+			Addr:        "localhost:8080",
+			ReadyMaxLag: api.DefaultMaxReadyLag,
+		},
+		Tezos: Tezos{
+			Source:       "tzkt",
+			TzktBaseURLs: []string{"https://api.tzkt.io/"},
+			MaxLag:       tezos.DefaultMaxLag,
+			PageSize:     tezos.DefaultPageSize,
+		},
+		DB:        DB{Driver: "postgres"},
+		Ingestion: Ingestion{Mode: "polling", LeaderElection: true},
+		Log:       Log{Level: slog.LevelInfo, Format: logging.FormatText},
+	}
+}
+
+// setting is a configuration entry which can be set by an environment variable and
+// a command-line flag.
+type setting struct {
+	// Key of the entry in the YAML file
+	key  string
+	env  string
+	flag string
+	// Usage of the flag
+	usage string
+	set   func(*Config, string) error
+}
+
+// settings are the configuration entries settable by environment variables and flags.
+var settings = []setting{
+	{"api.addr", "API_ADDR", "api-addr", "address listened to by the REST API server", func(c *Config, v string) error {
+		c.API.Addr = v
+		return nil
+	}},
+	{"api.readyMaxLag", "READY_MAX_LAG", "ready-max-lag", "number of levels ingestion may lag behind before readiness fails", func(c *Config, v string) error {
+		return parseInt(v, &c.API.ReadyMaxLag)
+	}},
+	{"db.driver", "DB_DRIVER", "db-driver", "storage backend, postgres, sqlite or memory", func(c *Config, v string) error {
+		c.DB.Driver = v
+		return nil
+	}},
+	{"db.path", "DB_PATH", "db-path", "SQLite database file, with the sqlite driver", func(c *Config, v string) error {
+		c.DB.Path = v
+		return nil
+	}},
+	{"db.host", "DB_HOST", "db-host", "database host name and port", func(c *Config, v string) error {
+		c.DB.Host = v
+		return nil
+	}},
+	{"db.database", "DB_DATABASE", "db-database", "database name", func(c *Config, v string) error {
+		c.DB.Database = v
+		return nil
+	}},
+	{"db.user", "DB_USER", "db-user", "database user", func(c *Config, v string) error {
+		c.DB.User = v
+		return nil
+	}},
+	{"db.password", "DB_PASSWORD", "", "", func(c *Config, v string) error {
+		c.DB.Password, c.DB.PasswordFile = v, ""
+		return nil
+	}},
+	{"db.passwordFile", "DB_PASSWORD_FILE", "db-password-file", "file holding the database password", func(c *Config, v string) error {
+		c.DB.Password, c.DB.PasswordFile = "", v
+		return nil
+	}},
+	{"db.migrate", "DB_MIGRATE", "db-migrate", "apply pending database migrations at startup", func(c *Config, v string) error {
+		return parseBool(v, &c.DB.Migrate)
+	}},
+	{"tezos.source", "TEZOS_SOURCE", "tezos-source", "source of delegations, tzkt or node", func(c *Config, v string) error {
+		c.Tezos.Source = v
+		return nil
+	}},
+	{"tezos.nodeURL", "TEZOS_NODE_URL", "tezos-node-url", "Tezos node RPC URL, with the node source", func(c *Config, v string) error {
+		c.Tezos.NodeURL = v
+		return nil
+	}},
+	{"tezos.tzktBaseURLs", "TZKT_BASE_URL", "tzkt-base-url", "comma-separated TzKT API URLs, by decreasing priority", func(c *Config, v string) error {
+		c.Tezos.TzktBaseURLs = []string{}
+		for _, baseURL := range strings.Split(v, ",") {
+			if baseURL = strings.TrimSpace(baseURL); baseURL != "" {
+				c.Tezos.TzktBaseURLs = append(c.Tezos.TzktBaseURLs, baseURL)
+			}
+		}
+		return nil
+	}},
+	{"tezos.maxLag", "TZKT_MAX_LAG", "tzkt-max-lag", "number of levels a TzKT instance may lag behind before failing over", func(c *Config, v string) error {
+		return parseInt(v, &c.Tezos.MaxLag)
+	}},
+	{"tezos.crossCheck", "TZKT_CROSS_CHECK", "tzkt-cross-check", "cross-check delegations against another TzKT instance", func(c *Config, v string) error {
+		return parseBool(v, &c.Tezos.CrossCheck)
+	}},
+	{"tezos.pageSize", "TZKT_PAGE_SIZE", "tzkt-page-size", "number of delegations fetched per request", func(c *Config, v string) error {
+		return parseInt(v, &c.Tezos.PageSize)
+	}},
+	{"ingestion.mode", "INGESTION_MODE", "ingestion-mode", "ingestion mode, polling or streaming", func(c *Config, v string) error {
+		c.Ingestion.Mode = v
+		return nil
+	}},
+	{"ingestion.since", "SCRAP_SINCE", "scrap-since", "time to start scraping from in RFC3339 format, instead of the checkpoint", func(c *Config, v string) error {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return err
+		}
+		c.Ingestion.Since = since
+		return nil
+	}},
+	{"ingestion.leaderElection", "LEADER_ELECTION", "leader-election", "ingest only while holding the leadership among instances", func(c *Config, v string) error {
+		return parseBool(v, &c.Ingestion.LeaderElection)
+	}},
+	{"log.level", "LOG_LEVEL", "log-level", "minimum level of logged lines, debug, info, warn or error", func(c *Config, v string) error {
+		level, err := logging.ParseLevel(v)
+		if err != nil {
+			return err
+		}
+		c.Log.Level = level
+		return nil
+	}},
+	{"log.format", "LOG_FORMAT", "log-format", "format of logged lines, text or json", func(c *Config, v string) error {
+		c.Log.Format = logging.Format(v)
+		return nil
+	}},
+}
+
+// Loader loads the configuration from the flags it registers on a flag set.
+type Loader struct {
+	path  *string
+	flags []flagValue
+}
+
+// flagValue is a value passed to a configuration flag.
+type flagValue struct {
+	setting *setting
+	value   string
+}
+
+// NewLoader registers the configuration flags on the given flag set: the -config flag
+// giving the path of the YAML file, and a flag per setting.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{
+		path: fs.String("config", "", "path of the YAML configuration file, CONFIG_FILE otherwise"),
+	}
+	for i := range settings {
+		s := &settings[i]
+		if s.flag == "" {
+			// secrets are not passed on the command line, where they would leak
+			continue
+		}
+		fs.Func(s.flag, s.usage+" ("+s.env+")", func(v string) error {
+			l.flags = append(l.flags, flagValue{setting: s, value: v})
+			return nil
+		})
+	}
+	return l
+}
+
+// Load returns the configuration once the flag set is parsed. Defaults are overridden
+// by the YAML file, if any, then by environment variables, then by flags, looked up
+// with the given function. The database password is read from its file, if any.
+// Returns a single error listing every invalid entry.
+func (l *Loader) Load(getenv func(string) string) (Config, error) {
+	conf := Default()
+
+	path := *l.path
+	if path == "" {
+		path = getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := loadFile(path, &conf); err != nil {
+			return Config{}, err
+		}
+	}
+
+	var errs []error
+	for i := range settings {
+		s := &settings[i]
+		if v := getenv(s.env); v != "" {
+			if err := s.set(&conf, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s (%s): %w", s.key, s.env, err))
+			}
+		}
+	}
+	for _, f := range l.flags {
+		if err := f.setting.set(&conf, f.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (-%s): %w", f.setting.key, f.setting.flag, err))
+		}
+	}
+
+	if conf.DB.PasswordFile != "" {
+		secret, err := os.ReadFile(conf.DB.PasswordFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("db.passwordFile: %w", err))
+		}
+		conf.DB.Password = strings.TrimRight(string(secret), "\r\n")
+	}
+
+	errs = append(errs, conf.validate()...)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i := range errs {
+			msgs[i] = errs[i].Error()
+		}
+		return Config{}, errors.New("invalid configuration: " + strings.Join(msgs, "; "))
+	}
+	return conf, nil
+}
+
+// loadFile overrides the given configuration with the YAML file at the given path.
+// Unknown entries are rejected.
+func loadFile(path string, conf *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("configuration file: %w", err)
+	}
+	defer file.Close()
+
+	dec := yaml.NewDecoder(file)
+	dec.KnownFields(true)
+	if err := dec.Decode(conf); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("configuration file %s: %w", path, err)
+	}
+	if conf.DB.Password != "" && conf.DB.PasswordFile != "" {
+		return fmt.Errorf("configuration file %s: db.password and db.passwordFile are mutually exclusive", path)
+	}
+	return nil
+}
+
+// validate normalises the configuration and returns every invalid entry.
+func (c *Config) validate() []error {
+	var errs []error
+	invalid := func(key, msg string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+msg, append([]any{key}, args...)...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.API.Addr); err != nil {
+		invalid("api.addr", "invalid address %q: %s", c.API.Addr, err)
+	}
+	if c.API.ReadyMaxLag < 0 {
+		invalid("api.readyMaxLag", "must not be negative")
+	}
+
+	switch c.DB.Driver {
+	case "postgres":
+		if c.DB.Host == "" {
+			invalid("db.host", "mandatory with postgres driver")
+		}
+		if c.DB.Database == "" {
+			invalid("db.database", "mandatory with postgres driver")
+		}
+		if c.DB.User == "" {
+			invalid("db.user", "mandatory with postgres driver")
+		}
+	case "sqlite":
+		if c.DB.Path == "" {
+			invalid("db.path", "mandatory with sqlite driver")
+		}
+	case "memory":
+	default:
+		invalid("db.driver", "unsupported driver %q", c.DB.Driver)
+	}
+
+	switch c.Tezos.Source {
+	case "tzkt":
+		if len(c.Tezos.TzktBaseURLs) == 0 {
+			invalid("tezos.tzktBaseURLs", "mandatory with tzkt source")
+		}
+		for i := range c.Tezos.TzktBaseURLs {
+			var err error
+			if c.Tezos.TzktBaseURLs[i], err = normaliseBaseURL(c.Tezos.TzktBaseURLs[i]); err != nil {
+				invalid("tezos.tzktBaseURLs", "%s", err)
+			}
+		}
+	case "node":
+		if c.Tezos.NodeURL == "" {
+			invalid("tezos.nodeURL", "mandatory with node source")
+		} else {
+			var err error
+			if c.Tezos.NodeURL, err = normaliseBaseURL(c.Tezos.NodeURL); err != nil {
+				invalid("tezos.nodeURL", "%s", err)
+			}
+		}
+	default:
+		invalid("tezos.source", "unsupported source %q", c.Tezos.Source)
+	}
+	if c.Tezos.MaxLag < 0 {
+		invalid("tezos.maxLag", "must not be negative")
+	}
+	if c.Tezos.PageSize < 1 || c.Tezos.PageSize > tezos.MaxPageSize {
+		invalid("tezos.pageSize", "must be within 1 and %d", tezos.MaxPageSize)
+	}
+
+	switch c.Ingestion.Mode {
+	case "polling":
+	case "streaming":
+		if c.Tezos.Source != "tzkt" {
+			invalid("ingestion.mode", "streaming is only supported with tzkt source")
+		}
+	default:
+		invalid("ingestion.mode", "unsupported mode %q", c.Ingestion.Mode)
+	}
+
+	format, err := logging.ParseFormat(string(c.Log.Format))
+	if err != nil {
+		invalid("log.format", "%s", err)
+	}
+	c.Log.Format = format
+
+	return errs
+}
+
+// normaliseBaseURL checks the given URL is an absolute HTTP(S) URL, and returns it
+// with a trailing slash.
+func normaliseBaseURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return raw, fmt.Errorf("%q is not an absolute HTTP(S) URL", raw)
+	}
+	if !strings.HasSuffix(raw, "/") {
+		raw += "/"
+	}
+	return raw, nil
+}
+
+// Print writes the configuration in YAML to the given writer, secrets redacted.
+func (c Config) Print(w io.Writer) error {
+	if c.DB.Password != "" {
+		c.DB.Password = redacted
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// parseInt parses the given value as a decimal integer into dst.
+func parseInt(v string, dst *int) error {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = i
+	return nil
+}
+
+// parseBool parses the given value as a boolean into dst.
+func parseBool(v string, dst *bool) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
@@ -0,0 +1,155 @@
+// Package leader elects a single instance among replicas to run a task, based on an
+// exclusive lock, with automatic takeover when the leader dies or loses its lock.
+package leader
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultInterval is the delay between two attempts to acquire the lock, and between
+	// two checks of the lock while leading, unless configured otherwise.
+	DefaultInterval = 5 * time.Second
+	// releaseTimeout is the timeout of lock releases.
+	releaseTimeout = 5 * time.Second
+)
+
+var (
+	isLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tezos_delegation",
+		Name:      "is_leader",
+		Help:      "Whether the instance is the leader running ingestion, 1 if so.",
+	})
+	leadershipAcquisitions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tezos_delegation",
+		Name:      "leadership_acquisitions_total",
+		Help:      "Number of times the instance became the leader.",
+	})
+	leadershipLosses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tezos_delegation",
+		Name:      "leadership_losses_total",
+		Help:      "Number of times the instance lost its lock while leading.",
+	})
+)
+
+// Lock is an exclusive lock held by the leader.
+type Lock interface {
+	// Check returns an error if the lock may have been lost.
+	Check(context.Context) error
+	// Release releases the lock.
+	Release(context.Context) error
+}
+
+// AcquireFunc tries to acquire the lock. Returns false if another instance holds it.
+type AcquireFunc func(context.Context) (Lock, bool, error)
+
+// Elector runs a task on the instance holding the lock only. Instances which do not
+// hold it try to acquire it regularly, so that one of them takes over once the leader
+// released it, died, or lost its connection to the lock holder.
+// It is safe from concurrency.
+type Elector struct {
+	acquire  AcquireFunc
+	interval time.Duration
+	logger   *slog.Logger
+	leading  atomic.Bool
+}
+
+// NewElector creates an elector acquiring the lock with the given function, trying
+// and checking the lock at the given interval, DefaultInterval if not positive.
+func NewElector(acquire AcquireFunc, interval time.Duration, logger *slog.Logger) *Elector {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Elector{
+		acquire:  acquire,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// Leading returns true while the instance is the leader.
+func (e *Elector) Leading() bool {
+	return e.leading.Load()
+}
+
+// Run calls the given function whenever the instance becomes the leader, until
+// context is cancelled or the function fails. When the lock is lost, the context
+// passed to the function is cancelled and the instance runs for election again once
+// the function returned. Returns the error of the function, or the context one.
+func (e *Elector) Run(ctx context.Context, fn func(context.Context) error) error {
+	for {
+		lock, ok, err := e.acquire(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			e.logger.WarnContext(ctx, "cannot run for leadership", "error", err)
+		case ok:
+			lost, err := e.lead(ctx, lock, fn)
+			if !lost {
+				return err
+			}
+			// run for election again right away, another instance may have not taken over
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+// lead calls the given function while holding the given lock, until it returns or the
+// lock is lost. Returns true if the lock was lost, and the error of the function
+// otherwise. The lock is released either way.
+func (e *Elector) lead(ctx context.Context, lock Lock, fn func(context.Context) error) (bool, error) {
+	e.logger.InfoContext(ctx, "became leader")
+	e.leading.Store(true)
+	isLeader.Set(1)
+	leadershipAcquisitions.Inc()
+	defer func() {
+		e.leading.Store(false)
+		isLeader.Set(0)
+		rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+		defer cancel()
+		if err := lock.Release(rctx); err != nil {
+			e.logger.WarnContext(ctx, "cannot release leadership", "error", err)
+		}
+	}()
+
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(lctx)
+	}()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			return false, err
+		case <-ticker.C:
+			if err := lock.Check(ctx); err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				e.logger.WarnContext(ctx, "lost leadership", "error", err)
+				leadershipLosses.Inc()
+				cancel()
+				<-done
+				return true, nil
+			}
+		}
+	}
+}
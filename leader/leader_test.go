@@ -0,0 +1,193 @@
+package leader_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/leader"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const interval = 10 * time.Millisecond
+
+// lockMock is an exclusive lock shared by electors, which can be broken to simulate
+// the loss of the connection of its holder.
+type lockMock struct {
+	mu           sync.Mutex
+	held         bool
+	broken       bool
+	AcquireErr   error
+	ReleaseCount int
+}
+
+func (m *lockMock) acquire(context.Context) (leader.Lock, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.AcquireErr != nil {
+		return nil, false, m.AcquireErr
+	}
+	if m.held {
+		return nil, false, nil
+	}
+	m.held = true
+	m.broken = false
+	return m, true, nil
+}
+
+func (m *lockMock) Check(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.broken {
+		return errors.New("connection lost")
+	}
+	return nil
+}
+
+func (m *lockMock) Release(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.held = false
+	m.ReleaseCount++
+	return nil
+}
+
+// breakLock makes the checks of the lock fail, then lets another elector acquire it.
+func (m *lockMock) breakLock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.broken = true
+	m.held = false
+}
+
+func (m *lockMock) releaseCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ReleaseCount
+}
+
+// runElector runs the given elector in the background until context is done, and
+// returns the channel receiving its error.
+func runElector(ctx context.Context, e *leader.Elector, fn func(context.Context) error) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- e.Run(ctx, fn)
+	}()
+	return errChan
+}
+
+// blockUntilDone returns a function signalling the given channel, then blocking until
+// its context is done.
+func blockUntilDone(started chan<- struct{}) func(context.Context) error {
+	return func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+}
+
+func TestElector(t *testing.T) {
+	t.Run("runs while leading until context is cancelled", func(t *testing.T) {
+		lock := &lockMock{}
+		e := leader.NewElector(lock.acquire, interval, slog.Default())
+		ctx, cancel := context.WithCancel(context.Background())
+		started := make(chan struct{}, 1)
+
+		errChan := runElector(ctx, e, blockUntilDone(started))
+		<-started
+		assert.True(t, e.Leading())
+		cancel()
+
+		assert.ErrorIs(t, <-errChan, context.Canceled)
+		assert.False(t, e.Leading())
+		assert.Equal(t, 1, lock.releaseCount())
+	})
+
+	t.Run("runs on one elector at a time and fails over", func(t *testing.T) {
+		lock := &lockMock{}
+		first := leader.NewElector(lock.acquire, interval, slog.Default())
+		second := leader.NewElector(lock.acquire, interval, slog.Default())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		firstStarted := make(chan struct{}, 1)
+		secondStarted := make(chan struct{}, 1)
+		firstCtx, stopFirst := context.WithCancel(ctx)
+
+		firstErr := runElector(firstCtx, first, blockUntilDone(firstStarted))
+		<-firstStarted
+		runElector(ctx, second, blockUntilDone(secondStarted))
+		time.Sleep(5 * interval)
+		assert.False(t, second.Leading())
+		assert.Empty(t, secondStarted)
+
+		stopFirst()
+		<-firstErr
+		select {
+		case <-secondStarted:
+		case <-time.After(time.Second):
+			require.Fail(t, "second elector did not take over")
+		}
+		assert.True(t, second.Leading())
+	})
+
+	t.Run("steps down when lock is lost and runs for election again", func(t *testing.T) {
+		lock := &lockMock{}
+		e := leader.NewElector(lock.acquire, interval, slog.Default())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		started := make(chan struct{}, 2)
+		stopped := make(chan struct{}, 1)
+
+		runElector(ctx, e, func(ctx context.Context) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			stopped <- struct{}{}
+			return ctx.Err()
+		})
+		<-started
+		lock.breakLock()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			require.Fail(t, "elector did not step down")
+		}
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			require.Fail(t, "elector was not elected again")
+		}
+		assert.Equal(t, 1, lock.releaseCount())
+	})
+
+	t.Run("keeps running for election on acquisition error", func(t *testing.T) {
+		lock := &lockMock{AcquireErr: errors.New("database unavailable")}
+		e := leader.NewElector(lock.acquire, interval, slog.Default())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*interval)
+		defer cancel()
+
+		err := e.Run(ctx, func(context.Context) error {
+			require.Fail(t, "should not run without the lock")
+			return nil
+		})
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.False(t, e.Leading())
+	})
+
+	t.Run("returns error of function and releases lock", func(t *testing.T) {
+		lock := &lockMock{}
+		e := leader.NewElector(lock.acquire, interval, slog.Default())
+		fnErr := errors.New("ingestion failed")
+
+		err := e.Run(context.Background(), func(context.Context) error { return fnErr })
+
+		assert.ErrorIs(t, err, fnErr)
+		assert.Equal(t, 1, lock.releaseCount())
+		assert.False(t, e.Leading())
+	})
+}
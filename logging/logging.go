@@ -0,0 +1,116 @@
+// Package logging configures structured logging with log/slog, and carries
+// contextual attributes, such as request and scraping cycle IDs, within contexts.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Format is the output format of log lines.
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// ParseLevel parses a log level name: debug, info, warn or error, case insensitive.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unsupported log level %q", name)
+	}
+	return level, nil
+}
+
+// ParseFormat parses a log format name: text or json, case insensitive.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported log format %q", name)
+	}
+}
+
+// New returns a logger writing lines of at least the given level to the given writer,
+// in the given format. Lines logged with a context also hold the attributes added to
+// it with With.
+func New(w io.Writer, level slog.Leveler, format Format) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var hdl slog.Handler
+	if format == FormatJSON {
+		hdl = slog.NewJSONHandler(w, opts)
+	} else {
+		hdl = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{Handler: hdl})
+}
+
+// attrsKey is the context key of the attributes added with With.
+type attrsKey struct{}
+
+// With returns a copy of the context holding the given attributes, as key-value pairs
+// or slog.Attr values, in addition to the ones it already holds.
+func With(ctx context.Context, args ...any) context.Context {
+	prev, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	attrs := make([]slog.Attr, len(prev), len(prev)+len(args))
+	copy(attrs, prev)
+
+	rec := slog.Record{}
+	rec.Add(args...)
+	rec.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// loggerKey is the context key of the logger added with NewContext.
+type loggerKey struct{}
+
+// NewContext returns a copy of the context holding the given logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger held by the context, or the default one if none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// NewID returns a random identifier, suitable to correlate log lines.
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextHandler is a handler adding the attributes held by the context of records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		rec.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,80 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"kiln-tezos-delegation/logging"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogging(t *testing.T) {
+	t.Run("parses levels", func(t *testing.T) {
+		level, err := logging.ParseLevel("DEBUG")
+		assert.NoError(t, err)
+		assert.Equal(t, slog.LevelDebug, level)
+
+		_, err = logging.ParseLevel("verbose")
+		assert.Error(t, err)
+	})
+
+	t.Run("parses formats", func(t *testing.T) {
+		format, err := logging.ParseFormat("JSON")
+		assert.NoError(t, err)
+		assert.Equal(t, logging.FormatJSON, format)
+
+		_, err = logging.ParseFormat("xml")
+		assert.Error(t, err)
+	})
+
+	t.Run("filters lines below level", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		logger := logging.New(&buf, slog.LevelInfo, logging.FormatText)
+
+		logger.Debug("hidden")
+		logger.Info("shown")
+
+		assert.NotContains(t, buf.String(), "hidden")
+		assert.Contains(t, buf.String(), "msg=shown")
+	})
+
+	t.Run("adds context attributes", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		logger := logging.New(&buf, slog.LevelInfo, logging.FormatJSON).With("component", "test")
+
+		ctx := logging.With(context.Background(), "request_id", "42")
+		ctx = logging.With(ctx, slog.Int("level", 242))
+		logger.InfoContext(ctx, "message", "count", 3)
+
+		line := map[string]any{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.Equal(t, "message", line["msg"])
+		assert.Equal(t, "test", line["component"])
+		assert.Equal(t, "42", line["request_id"])
+		assert.Equal(t, float64(242), line["level"])
+		assert.Equal(t, float64(3), line["count"])
+	})
+
+	t.Run("does not change parent context attributes", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		logger := logging.New(&buf, slog.LevelInfo, logging.FormatText)
+
+		parent := logging.With(context.Background(), "cycle_id", "1")
+		_ = logging.With(parent, "request_id", "2")
+		logger.InfoContext(parent, "message")
+
+		assert.Contains(t, buf.String(), "cycle_id=1")
+		assert.NotContains(t, buf.String(), "request_id")
+	})
+
+	t.Run("carries logger in context", func(t *testing.T) {
+		logger := logging.New(&bytes.Buffer{}, slog.LevelInfo, logging.FormatText)
+
+		assert.Same(t, logger, logging.FromContext(logging.NewContext(context.Background(), logger)))
+		assert.Same(t, slog.Default(), logging.FromContext(context.Background()))
+	})
+}
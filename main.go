@@ -2,109 +2,117 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"kiln-tezos-delegation/api"
-	"kiln-tezos-delegation/repository"
-	"kiln-tezos-delegation/tezos"
-	"log"
+	"kiln-tezos-delegation/config"
+	"kiln-tezos-delegation/logging"
+	"log/slog"
 	"os"
 	"os/signal"
-	"sync"
-	"time"
+	"strings"
 )
 
-type config struct {
-	apiAddr    string
-	dbHost     string
-	dbDatabase string
-	dbUser     string
-	dbPassword string
-	tzktHost   string
-	since      time.Time
+// command is a subcommand of the binary.
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+// commands are the subcommands of the binary, "all" being the default one.
+var commands = []command{
+	{"serve", "serve the REST API only", runServe},
+	{"scrape", "ingest delegations only, serving operational endpoints", runScrape},
+	{"all", "serve the REST API and ingest delegations (default)", runAll},
+	{"migrate", "apply (up), revert (down) or list (status) database migrations", runMigrate},
+	{"backfill", "store the delegations of a historical level range, then exit", runBackfill},
+	{"config", "print the effective configuration (print), secrets redacted", runConfig},
 }
 
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer cancel()
 
-	if err := run(ctx); err != nil {
-		log.Fatal("finished with error: ", err)
-		os.Exit(1)
+	err := dispatch(ctx, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("finished with error", "error", err)
 	}
 }
 
-func run(ctx context.Context) error {
-	conf := confFromEnv()
-	repo := initRepository(ctx, conf)
-	client := initTezosClient(conf)
-	svr := initAPI(conf, repo)
-
-	cctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	errChan := make(chan error, 2)
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer cancel()
-		defer wg.Done()
-		if err := svr.Start(cctx); err != nil {
-			errChan <- fmt.Errorf("api server error: %w", err)
-		}
-	}()
-
-	go func() {
-		defer cancel()
-		defer wg.Done()
-		if err := tezos.NewScraper(client, repo).Run(cctx, conf.since); err != nil {
-			errChan <- fmt.Errorf("scraper error: %w", err)
+// dispatch runs the subcommand given as first argument with the remaining arguments.
+// Without subcommand, or when the first argument is a flag, "all" is run.
+func dispatch(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" {
+		return runAll(ctx, args)
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(ctx, args[1:])
 		}
-	}()
-
-	wg.Wait()
-
-	return <-errChan
-}
+	}
 
-func initRepository(ctx context.Context, conf config) repository.PostgresRepository {
-	url := "postgres://" + conf.dbUser + ":" + conf.dbPassword + "@" + conf.dbHost + "/" + conf.dbDatabase
-	repo, err := repository.NewPostgresRepository(ctx, url)
-	if err != nil {
-		log.Fatal("repository: ", err)
+	usage()
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		return flag.ErrHelp
 	}
-	return repo
+	return fmt.Errorf("unknown command %q", args[0])
 }
 
-func initTezosClient(conf config) tezos.TezosClient {
-	client, err := tezos.NewClient(conf.tzktHost)
-	if err != nil {
-		log.Fatal("tezos client: ", err)
+// usage writes the list of subcommands to the standard error.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
 	}
-	return client
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
 }
 
-func initAPI(conf config, repo repository.PostgresRepository) *api.Server {
-	return api.NewServer(conf.apiAddr, "/xtz/delegations", api.GetDelegationHandler(api.NewController(repo)))
+// fatal logs the given message and attributes as an error, then exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-func confFromEnv() config {
-	conf := config{
-		apiAddr:    os.Getenv("API_ADDR"),
-		dbHost:     os.Getenv("DB_HOST"),
-		dbDatabase: os.Getenv("DB_DATABASE"),
-		dbUser:     os.Getenv("DB_USER"),
-		dbPassword: os.Getenv("DB_PASSWORD"),
-		tzktHost:   os.Getenv("TZKT_BASE_URL"),
+// loadConfig parses the command-line arguments of the given command, with the flags
+// registered by the given function besides the configuration ones, and loads the
+// configuration. Returns the remaining positional arguments as well.
+func loadConfig(name string, args []string, register func(*flag.FlagSet)) (config.Config, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	if register != nil {
+		register(flags)
+	}
+	loader := config.NewLoader(flags)
+	if err := flags.Parse(args); err != nil {
+		return config.Config{}, nil, err
+	}
+	conf, err := loader.Load(os.Getenv)
+	if err != nil {
+		return config.Config{}, nil, err
 	}
+	return conf, flags.Args(), nil
+}
 
-	var err error
-	if since := os.Getenv("SCRAP_SINCE"); since != "" {
-		conf.since, err = time.Parse(time.RFC3339, since)
-		if err != nil {
-			log.Fatal("env: SCRAP_SINCE: ", err)
-		}
+// runConfig writes the effective configuration given by the command-line arguments
+// and the environment to the standard output, secrets redacted.
+func runConfig(_ context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("config: expected subcommand: print")
 	}
+	conf, _, err := loadConfig("config print", args[1:], nil)
+	if err != nil {
+		return err
+	}
+	return conf.Print(os.Stdout)
+}
 
-	return conf
+// initLogger creates the logger of the configured level and format, and sets it as
+// the default one, which the standard logger writes to as well.
+func initLogger(conf config.Config) *slog.Logger {
+	logger := logging.New(os.Stderr, conf.Log.Level, conf.Log.Format)
+	slog.SetDefault(logger)
+	return logger
 }
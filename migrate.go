@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"kiln-tezos-delegation/repository"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// migrationStore is a store which schema is migrated.
+type migrationStore interface {
+	migrator
+	MigrateDown(context.Context, int) (int, error)
+	MigrationStatus(context.Context) ([]repository.MigrationStatus, error)
+}
+
+// runMigrate applies, reverts or lists the database migrations embedded in the binary.
+func runMigrate(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("migrate: expected subcommand: up, down or status")
+	}
+	action := args[0]
+	if action != "up" && action != "down" && action != "status" {
+		return fmt.Errorf("migrate: unknown subcommand %q, expected up, down or status", action)
+	}
+
+	var steps int
+	conf, _, err := loadConfig("migrate "+action, args[1:], func(flags *flag.FlagSet) {
+		if action == "down" {
+			flags.IntVar(&steps, "steps", 1, "number of migrations to revert")
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if conf.DB.Driver == "memory" {
+		return errors.New("migrate: nothing to migrate with memory driver")
+	}
+
+	logger := initLogger(conf)
+	repo := initStore(ctx, conf, logger).(migrationStore)
+
+	switch action {
+	case "up":
+		count, err := repo.MigrateUp(ctx)
+		if err != nil {
+			return fmt.Errorf("migrate up: %w", err)
+		}
+		logger.Info("database up to date", "applied", count)
+	case "down":
+		count, err := repo.MigrateDown(ctx, steps)
+		if err != nil {
+			return fmt.Errorf("migrate down: %w", err)
+		}
+		logger.Info("migrations reverted", "reverted", count)
+	case "status":
+		statuses, err := repo.MigrationStatus(ctx)
+		if err != nil {
+			return fmt.Errorf("migrate status: %w", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return w.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package repository
+
+import "context"
+
+// Truncate deletes every stored delegation, checkpoint and backfill range.
+func (p PostgresRepository) Truncate(ctx context.Context) error {
+	_, err := p.cnxPool.Exec(ctx, "TRUNCATE delegation, current_delegation, backfill_range, scraper_state")
+	return err
+}
@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DelegationFilter selects delegations matching all of its criteria.
+// Zero values and nil pointers mean the criterion is not applied.
+type DelegationFilter struct {
+	// UTC year of the block timestamp
+	Year int
+	// Sender address
+	Delegator string
+	// Address of the baker delegated to
+	Baker string
+	// Inclusive level range
+	MinLevel *int32
+	MaxLevel *int32
+	// Block timestamp range, From inclusive and To exclusive
+	From time.Time
+	To   time.Time
+	// Inclusive amount range
+	MinAmount *int64
+	MaxAmount *int64
+}
+
+// queryBuilder builds SQL conditions joined with AND, and their positional arguments.
+// It writes PostgreSQL syntax unless sqlite is set.
+type queryBuilder struct {
+	conds  []string
+	args   []any
+	sqlite bool
+}
+
+// add adds a condition which single placeholder is written %s, bound to the given argument.
+func (b *queryBuilder) add(cond string, arg any) {
+	b.conds = append(b.conds, fmt.Sprintf(cond, b.bind(arg)))
+}
+
+// addRow adds a condition comparing a row of columns with a row of arguments.
+func (b *queryBuilder) addRow(cond string, args ...any) {
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = b.bind(args[i])
+	}
+	b.conds = append(b.conds, fmt.Sprintf(cond, strings.Join(placeholders, ", ")))
+}
+
+// bind adds the given argument and returns its placeholder. Times are bound as
+// stored by SQLite, in microseconds since the Unix epoch.
+func (b *queryBuilder) bind(arg any) string {
+	if !b.sqlite {
+		b.args = append(b.args, arg)
+		return fmt.Sprintf("$%d", len(b.args))
+	}
+	if t, ok := arg.(time.Time); ok {
+		arg = t.UnixMicro()
+	}
+	b.args = append(b.args, arg)
+	return fmt.Sprintf("?%d", len(b.args))
+}
+
+// year returns the expression of the UTC year of the block timestamp, with a single
+// placeholder written %s.
+func (b *queryBuilder) year() string {
+	if b.sqlite {
+		return "CAST(strftime('%%Y', block_timestamp / 1000000, 'unixepoch') AS INTEGER) = %s"
+	}
+	return "EXTRACT(YEAR FROM block_timestamp AT TIME ZONE 'UTC') = %s"
+}
+
+// where returns the SQL condition, TRUE if there is none.
+func (b *queryBuilder) where() string {
+	if len(b.conds) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(b.conds, " AND ")
+}
+
+// apply adds the filter criteria to the query builder.
+func (f DelegationFilter) apply(b *queryBuilder) {
+	if f.Year != 0 {
+		b.add(b.year(), f.Year)
+	}
+	if f.Delegator != "" {
+		b.add("sender = %s", f.Delegator)
+	}
+	if f.Baker != "" {
+		b.add("new_delegate = %s", f.Baker)
+	}
+	if f.MinLevel != nil {
+		b.add("level >= %s", *f.MinLevel)
+	}
+	if f.MaxLevel != nil {
+		b.add("level <= %s", *f.MaxLevel)
+	}
+	if !f.From.IsZero() {
+		b.add("block_timestamp >= %s", f.From)
+	}
+	if !f.To.IsZero() {
+		b.add("block_timestamp < %s", f.To)
+	}
+	if f.MinAmount != nil {
+		b.add("amount >= %s", *f.MinAmount)
+	}
+	if f.MaxAmount != nil {
+		b.add("amount <= %s", *f.MaxAmount)
+	}
+}
+
+// match returns true if the delegation matches every criterion of the filter, as the
+// conditions added by apply select it.
+func (f DelegationFilter) match(dlg Delegation) bool {
+	switch {
+	case f.Year != 0 && dlg.BlockTimestamp.UTC().Year() != f.Year:
+	case f.Delegator != "" && dlg.Sender != f.Delegator:
+	case f.Baker != "" && dlg.NewDelegate != f.Baker:
+	case f.MinLevel != nil && dlg.Level < *f.MinLevel:
+	case f.MaxLevel != nil && dlg.Level > *f.MaxLevel:
+	case !f.From.IsZero() && dlg.BlockTimestamp.Before(f.From):
+	case !f.To.IsZero() && !dlg.BlockTimestamp.Before(f.To):
+	case f.MinAmount != nil && dlg.Amount < *f.MinAmount:
+	case f.MaxAmount != nil && dlg.Amount > *f.MaxAmount:
+	default:
+		return true
+	}
+	return false
+}
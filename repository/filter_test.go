@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelegationFilter(t *testing.T) {
+	t.Run("no criteria", func(t *testing.T) {
+		var b queryBuilder
+		DelegationFilter{}.apply(&b)
+
+		assert.Equal(t, "TRUE", b.where())
+		assert.Empty(t, b.args)
+	})
+
+	t.Run("every criteria", func(t *testing.T) {
+		minLevel, maxLevel := int32(10), int32(20)
+		minAmount, maxAmount := int64(0), int64(1000)
+		from := time.Date(2024, 01, 01, 0, 0, 0, 0, time.UTC)
+		to := time.Date(2024, 02, 01, 0, 0, 0, 0, time.UTC)
+
+		var b queryBuilder
+		DelegationFilter{
+			Year:      2024,
+			Delegator: "addr1",
+			Baker:     "baker1",
+			MinLevel:  &minLevel,
+			MaxLevel:  &maxLevel,
+			From:      from,
+			To:        to,
+			MinAmount: &minAmount,
+			MaxAmount: &maxAmount,
+		}.apply(&b)
+
+		assert.Equal(t, "EXTRACT(YEAR FROM block_timestamp AT TIME ZONE 'UTC') = $1 AND sender = $2 AND new_delegate = $3"+
+			" AND level >= $4 AND level <= $5 AND block_timestamp >= $6 AND block_timestamp < $7"+
+			" AND amount >= $8 AND amount <= $9", b.where())
+		assert.Equal(t, []any{2024, "addr1", "baker1", minLevel, maxLevel, from, to, minAmount, maxAmount}, b.args)
+	})
+
+	t.Run("sqlite syntax", func(t *testing.T) {
+		from := time.Date(2024, 01, 01, 0, 0, 0, 0, time.UTC)
+
+		b := queryBuilder{sqlite: true}
+		DelegationFilter{Year: 2024, From: from}.apply(&b)
+		b.addRow("(block_timestamp, operation_id) < (%s)", from, int64(42))
+
+		assert.Equal(t, "CAST(strftime('%Y', block_timestamp / 1000000, 'unixepoch') AS INTEGER) = ?1"+
+			" AND block_timestamp >= ?2 AND (block_timestamp, operation_id) < (?3, ?4)", b.where())
+		assert.Equal(t, []any{2024, from.UnixMicro(), from.UnixMicro(), int64(42)}, b.args)
+	})
+
+	t.Run("row condition after criteria", func(t *testing.T) {
+		var b queryBuilder
+		DelegationFilter{Delegator: "addr1"}.apply(&b)
+		b.addRow("(block_timestamp, operation_id) < (%s)", time.Time{}, int64(42))
+
+		assert.Equal(t, "sender = $1 AND (block_timestamp, operation_id) < ($2, $3)", b.where())
+		assert.Len(t, b.args, 3)
+	})
+}
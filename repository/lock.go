@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrLockLost is returned by writes fenced by an advisory lock which is no longer held.
+var ErrLockLost = errors.New("advisory lock lost")
+
+// AdvisoryLock is a PostgreSQL session-level advisory lock, held by a dedicated
+// connection until released. Should the connection or the process die, PostgreSQL
+// releases the lock along with the session.
+type AdvisoryLock struct {
+	conn *pgxpool.Conn
+	key  int64
+	// Process ID of the session holding the lock
+	pid int32
+}
+
+// TryAdvisoryLock acquires the advisory lock of the given key without waiting.
+// Returns false if another session holds it.
+func (p PostgresRepository) TryAdvisoryLock(ctx context.Context, key int64) (*AdvisoryLock, bool, error) {
+	// advisory locks are held by sessions, hence a dedicated connection
+	conn, err := p.cnxPool.Acquire(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var acquired bool
+	var pid int32
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1), pg_backend_pid()", key).Scan(&acquired, &pid); err != nil {
+		conn.Release()
+		return nil, false, fmt.Errorf("advisory lock: %w", err)
+	}
+	if !acquired {
+		conn.Release()
+		return nil, false, nil
+	}
+	return &AdvisoryLock{conn: conn, key: key, pid: pid}, true, nil
+}
+
+// Check pings the session holding the lock. An error means the lock may have been
+// released by PostgreSQL.
+func (l *AdvisoryLock) Check(ctx context.Context) error {
+	return l.conn.Ping(ctx)
+}
+
+// Release releases the lock, and its connection back to the pool. Should the unlock
+// fail, the connection is closed instead, which releases the lock as well.
+func (l *AdvisoryLock) Release(ctx context.Context) error {
+	defer l.conn.Release()
+
+	var released bool
+	err := l.conn.QueryRow(ctx, "SELECT pg_advisory_unlock($1)", l.key).Scan(&released)
+	if err == nil && !released {
+		err = fmt.Errorf("advisory lock %d was not held", l.key)
+	}
+	if err != nil {
+		_ = l.conn.Conn().Close(ctx)
+		return fmt.Errorf("advisory unlock: %w", err)
+	}
+	return nil
+}
+
+type fenceKey struct{}
+
+// WithFence returns a context fencing the writes made with it by the given lock: they
+// fail with ErrLockLost once the session which acquired the lock no longer holds it,
+// e.g. after PostgreSQL closed its connection. A nil lock fences nothing.
+func WithFence(ctx context.Context, lock *AdvisoryLock) context.Context {
+	return context.WithValue(ctx, fenceKey{}, lock)
+}
+
+// checkFence returns ErrLockLost if the lock fencing the given context is no longer
+// held, from within the given write transaction. The lock may still be lost before the
+// transaction commits, which narrows concurrent writes down to that window.
+func checkFence(ctx context.Context, tx pgx.Tx) error {
+	lock, _ := ctx.Value(fenceKey{}).(*AdvisoryLock)
+	if lock == nil {
+		return nil
+	}
+
+	// bigint keys are split into the class ID and object ID of the lock
+	const query = `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_locks
+			WHERE locktype = 'advisory' AND granted AND pid = $1 AND objsubid = 1
+				AND ((classid::bigint << 32) | objid::bigint) = $2
+		)
+	`
+	var held bool
+	if err := tx.QueryRow(ctx, query, lock.pid, lock.key).Scan(&held); err != nil {
+		return fmt.Errorf("advisory lock fence: %w", err)
+	}
+	if !held {
+		return ErrLockLost
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvisoryLock(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	repo, err := NewPostgresRepository(ctx, url, slog.Default())
+	require.NoError(t, err)
+	const key int64 = 42
+
+	t.Run("is held by one session at a time", func(t *testing.T) {
+		lock, ok, err := repo.TryAdvisoryLock(ctx, key)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.NoError(t, lock.Check(ctx))
+
+		_, ok, err = repo.TryAdvisoryLock(ctx, key)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		require.NoError(t, lock.Release(ctx))
+		other, ok, err := repo.TryAdvisoryLock(ctx, key)
+		assert.NoError(t, err)
+		require.True(t, ok)
+		assert.NoError(t, other.Release(ctx))
+	})
+
+	t.Run("fences writes once lost", func(t *testing.T) {
+		lock, ok, err := repo.TryAdvisoryLock(ctx, key)
+		require.NoError(t, err)
+		require.True(t, ok)
+		fenced := WithFence(ctx, lock)
+
+		_, err = repo.AddNewDelegations(fenced, []Delegation{{BlockTimestamp: time.Now(), OperationID: 1, Level: 1, Status: "applied"}})
+		assert.NoError(t, err)
+
+		// the session of the lock ends, as when PostgreSQL closes its connection
+		require.NoError(t, lock.conn.Conn().Close(ctx))
+		_, err = repo.AddNewDelegations(fenced, []Delegation{{BlockTimestamp: time.Now(), OperationID: 2, Level: 2, Status: "applied"}})
+		assert.ErrorIs(t, err, ErrLockLost)
+		_, err = repo.DeleteDelegationsFromLevel(fenced, 1)
+		assert.ErrorIs(t, err, ErrLockLost)
+
+		assert.Error(t, lock.Release(ctx))
+		require.NoError(t, repo.Truncate(ctx))
+	})
+}
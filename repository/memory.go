@@ -0,0 +1,413 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryRepository stores delegations in memory, with the same semantics as
+// PostgresRepository. Stored delegations are lost on exit, which suits development,
+// tests and ephemeral deployments. It is safe from concurrency.
+type MemoryRepository struct {
+	mu sync.RWMutex
+	// Delegations sorted by block timestamp most recent first, then by operation ID
+	delegations []Delegation
+	// Operation IDs of the stored delegations
+	operations map[int64]struct{}
+	// Levels, operation hashes and senders of the stored delegations
+	hashes map[operationKey]struct{}
+	// Current delegation state by delegator
+	current    map[string]CurrentDelegation
+	checkpoint *Checkpoint
+	// Backfill ranges by first and last level
+	backfills map[[2]int32]BackfillRange
+}
+
+// NewMemoryRepository creates an empty in-memory repository.
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		operations: map[int64]struct{}{},
+		hashes:     map[operationKey]struct{}{},
+		current:    map[string]CurrentDelegation{},
+		backfills:  map[[2]int32]BackfillRange{},
+	}
+}
+
+// Ping always succeeds.
+func (m *MemoryRepository) Ping(context.Context) error {
+	return nil
+}
+
+// AddNewDelegations inserts delegations and skips duplicates, having the same operation
+// ID or the same operation hash and sender at the same level. The current delegation state of the
+// senders of applied delegations is updated, unless a more recent delegation was
+// already stored, so insertion order does not matter.
+// Returns how many delegations were inserted and skipped as duplicates.
+func (m *MemoryRepository) AddNewDelegations(_ context.Context, dlgs []Delegation) (InsertStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addNewDelegations(dlgs), nil
+}
+
+// AddNewDelegationsAndCheckpoint inserts delegations as AddNewDelegations does, and
+// moves the scraper checkpoint forward to the given one at once.
+// The checkpoint is left unchanged if it is already further.
+func (m *MemoryRepository) AddNewDelegationsAndCheckpoint(_ context.Context, dlgs []Delegation, cp Checkpoint) (InsertStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.addNewDelegations(dlgs)
+	if m.checkpoint == nil || m.checkpoint.Before(cp) {
+		m.checkpoint = &cp
+	}
+	return stats, nil
+}
+
+// GetCheckpoint returns the scraper checkpoint. Returns ErrNotFound if there is none.
+func (m *MemoryRepository) GetCheckpoint(context.Context) (Checkpoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.checkpoint == nil {
+		return Checkpoint{}, ErrNotFound
+	}
+	return *m.checkpoint, nil
+}
+
+// addNewDelegations inserts delegations, the lock being held.
+func (m *MemoryRepository) addNewDelegations(dlgs []Delegation) InsertStats {
+	// inserted by operation ID, as in PostgreSQL, so that the first duplicate wins
+	sorted := slices.Clone(dlgs)
+	slices.SortStableFunc(sorted, func(a, b Delegation) int { return cmp.Compare(a.OperationID, b.OperationID) })
+
+	stats := InsertStats{}
+	for _, dlg := range sorted {
+		key, hashed := keyOf(dlg)
+		if _, ok := m.operations[dlg.OperationID]; ok {
+			stats.Skipped++
+			continue
+		}
+		if _, ok := m.hashes[key]; ok && hashed {
+			stats.Skipped++
+			continue
+		}
+		m.operations[dlg.OperationID] = struct{}{}
+		if hashed {
+			m.hashes[key] = struct{}{}
+		}
+		i, _ := slices.BinarySearchFunc(m.delegations, dlg, compareDelegations)
+		m.delegations = slices.Insert(m.delegations, i, dlg)
+		stats.Inserted++
+	}
+
+	for _, dlg := range sorted {
+		m.updateCurrent(dlg)
+	}
+	return stats
+}
+
+// updateCurrent sets the given delegation as the current one of its sender if it is
+// applied and more recent, the lock being held.
+func (m *MemoryRepository) updateCurrent(dlg Delegation) {
+	if dlg.Status != "applied" {
+		return
+	}
+	if cur, ok := m.current[dlg.Sender]; ok && !(Checkpoint{OperationID: cur.OperationID, Level: cur.Level}).Before(checkpointOf(dlg)) {
+		return
+	}
+	m.current[dlg.Sender] = CurrentDelegation{
+		Delegator:   dlg.Sender,
+		Delegate:    dlg.NewDelegate,
+		OperationID: dlg.OperationID,
+		Amount:      dlg.Amount,
+		Level:       dlg.Level,
+		Since:       dlg.BlockTimestamp,
+	}
+}
+
+// GetDelegations get a page of delegations matching the given filter, sorted by
+// block timestamp most recent first, then by operation ID.
+func (m *MemoryRepository) GetDelegations(_ context.Context, filter DelegationFilter, page Page) ([]Delegation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	start := 0
+	if page.After != nil {
+		after := Delegation{BlockTimestamp: page.After.BlockTimestamp, OperationID: page.After.OperationID}
+		i, found := slices.BinarySearchFunc(m.delegations, after, compareDelegations)
+		if found {
+			i++
+		}
+		start = i
+	}
+
+	ret := make([]Delegation, 0)
+	for _, dlg := range m.delegations[start:] {
+		if page.Limit > 0 && len(ret) == page.Limit {
+			break
+		}
+		if filter.match(dlg) {
+			ret = append(ret, dlg)
+		}
+	}
+	return ret, nil
+}
+
+// GetLatestBlockTimestamp gets the most recent delegation's block timestamp.
+// Returns ErrNotFound if there is no delegation.
+func (m *MemoryRepository) GetLatestBlockTimestamp(context.Context) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.delegations) == 0 {
+		return time.Time{}, ErrNotFound
+	}
+	return m.delegations[0].BlockTimestamp, nil
+}
+
+// GetLatestBlocks gets the references of the given number of most recent blocks
+// in which stored delegations were included, most recent first.
+func (m *MemoryRepository) GetLatestBlocks(_ context.Context, count int) ([]Block, error) {
+	if count < 0 {
+		return []Block{}, fmt.Errorf("negative block count %d", count)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type blockKey struct {
+		level int32
+		hash  string
+		ts    int64
+	}
+	seen := map[blockKey]struct{}{}
+	blks := make([]Block, 0, count)
+	for _, dlg := range m.delegations {
+		key := blockKey{dlg.Level, dlg.BlockHash, dlg.BlockTimestamp.UnixNano()}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		blks = append(blks, Block{Level: dlg.Level, Hash: dlg.BlockHash, Timestamp: dlg.BlockTimestamp})
+	}
+
+	slices.SortStableFunc(blks, func(a, b Block) int { return cmp.Compare(b.Level, a.Level) })
+	return blks[:min(count, len(blks))], nil
+}
+
+// DeleteDelegationsFromLevel deletes delegations included in blocks at the given
+// level or above. The current delegation state of their senders is recomputed from the
+// remaining delegations, and the scraper checkpoint is moved back to the most recent
+// remaining delegation, or removed if none remains. Returns the number of deleted
+// delegations.
+func (m *MemoryRepository) DeleteDelegationsFromLevel(_ context.Context, level int32) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	m.delegations = slices.DeleteFunc(m.delegations, func(dlg Delegation) bool {
+		if dlg.Level < level {
+			return false
+		}
+		delete(m.operations, dlg.OperationID)
+		delete(m.hashes, operationKey{dlg.Level, dlg.OperationHash, dlg.Sender})
+		deleted++
+		return true
+	})
+
+	orphaned := map[string]struct{}{}
+	for delegator, cur := range m.current {
+		if cur.Level >= level {
+			orphaned[delegator] = struct{}{}
+			delete(m.current, delegator)
+		}
+	}
+	var latest *Delegation
+	for i, dlg := range m.delegations {
+		if _, ok := orphaned[dlg.Sender]; ok {
+			m.updateCurrent(dlg)
+		}
+		if latest == nil || checkpointOf(*latest).Before(checkpointOf(dlg)) {
+			latest = &m.delegations[i]
+		}
+	}
+
+	if m.checkpoint != nil && m.checkpoint.Level >= level {
+		m.checkpoint = nil
+		if latest != nil {
+			m.checkpoint = &Checkpoint{OperationID: latest.OperationID, Level: latest.Level}
+		}
+	}
+	return deleted, nil
+}
+
+// GetCurrentDelegation returns the current delegation state of the given account.
+// Returns ErrNotFound if the account has no applied delegation.
+func (m *MemoryRepository) GetCurrentDelegation(_ context.Context, delegator string) (CurrentDelegation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cur, ok := m.current[delegator]
+	if !ok {
+		return CurrentDelegation{}, ErrNotFound
+	}
+	return cur, nil
+}
+
+// GetBackfillRanges returns the progress of the backfill ranges lying within the
+// [from, to[ level range, by ascending first level.
+func (m *MemoryRepository) GetBackfillRanges(_ context.Context, from, to int32) ([]BackfillRange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ret := []BackfillRange{}
+	for _, rng := range m.backfills {
+		if rng.FromLevel >= from && rng.ToLevel <= to {
+			ret = append(ret, rng)
+		}
+	}
+	slices.SortFunc(ret, func(a, b BackfillRange) int {
+		return cmp.Or(cmp.Compare(a.FromLevel, b.FromLevel), cmp.Compare(a.ToLevel, b.ToLevel))
+	})
+	return ret, nil
+}
+
+// SaveBackfillRange records the progress of a backfill range.
+func (m *MemoryRepository) SaveBackfillRange(_ context.Context, rng BackfillRange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.backfills[[2]int32{rng.FromLevel, rng.ToLevel}] = rng
+	return nil
+}
+
+// GetBakerStats computes aggregate statistics of the delegations to the given baker.
+// Delegators are accounts which current delegation is to the baker; at most top of
+// them are returned, by decreasing amount. Flows are computed over delegations having
+// their block timestamp within [from, to[.
+func (m *MemoryRepository) GetBakerStats(_ context.Context, baker string, from, to time.Time, top int) (BakerStats, error) {
+	if top < 0 {
+		return BakerStats{}, fmt.Errorf("negative top delegator count %d", top)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := BakerStats{TopDelegators: make([]Delegator, 0, top)}
+	if baker == "" {
+		// an empty delegate is stored as NULL in PostgreSQL, matching no baker
+		return stats, nil
+	}
+
+	var delegators []Delegator
+	for _, cur := range m.current {
+		if cur.Delegate != baker {
+			continue
+		}
+		stats.DelegatorCount++
+		stats.DelegatedBalance += cur.Amount
+		delegators = append(delegators, Delegator{Address: cur.Delegator, Amount: cur.Amount, Since: cur.Since})
+	}
+	slices.SortFunc(delegators, func(a, b Delegator) int {
+		return cmp.Or(cmp.Compare(b.Amount, a.Amount), cmp.Compare(a.Address, b.Address))
+	})
+	stats.TopDelegators = append(stats.TopDelegators, delegators[:min(top, len(delegators))]...)
+
+	for _, dlg := range m.delegations {
+		if dlg.Status != "applied" || dlg.NewDelegate == dlg.PrevDelegate ||
+			dlg.BlockTimestamp.Before(from) || !dlg.BlockTimestamp.Before(to) {
+			continue
+		}
+		if dlg.NewDelegate == baker {
+			stats.Inflow.Count++
+			stats.Inflow.Amount += dlg.Amount
+		}
+		if dlg.PrevDelegate == baker {
+			stats.Outflow.Count++
+			stats.Outflow.Amount += dlg.Amount
+		}
+	}
+	return stats, nil
+}
+
+// GetDelegationHistogram counts and sums the amounts of applied delegations having their
+// block timestamp within [from, to[, by UTC time interval. Only non-empty buckets are returned,
+// oldest first. Weeks start on Mondays.
+func (m *MemoryRepository) GetDelegationHistogram(_ context.Context, interval Interval, from, to time.Time) ([]Bucket, error) {
+	if err := interval.validate(); err != nil {
+		return []Bucket{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	buckets := map[time.Time]*Bucket{}
+	for _, dlg := range m.delegations {
+		if dlg.Status != "applied" || dlg.BlockTimestamp.Before(from) || !dlg.BlockTimestamp.Before(to) {
+			continue
+		}
+		start, err := truncate(dlg.BlockTimestamp, interval)
+		if err != nil {
+			return []Bucket{}, err
+		}
+		bkt, ok := buckets[start]
+		if !ok {
+			bkt = &Bucket{Start: start}
+			buckets[start] = bkt
+		}
+		bkt.Count++
+		bkt.Amount += dlg.Amount
+	}
+
+	ret := make([]Bucket, 0, len(buckets))
+	for _, bkt := range buckets {
+		ret = append(ret, *bkt)
+	}
+	slices.SortFunc(ret, func(a, b Bucket) int { return a.Start.Compare(b.Start) })
+	return ret, nil
+}
+
+// truncate returns the beginning of the UTC interval the given time lies within.
+func truncate(t time.Time, interval Interval) (time.Time, error) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case IntervalDay:
+		return day, nil
+	case IntervalWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7), nil
+	case IntervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	default:
+		return time.Time{}, fmt.Errorf("unsupported interval %q", interval)
+	}
+}
+
+// operationKey identifies a delegation across TzKT instances, by level, operation hash
+// and sender.
+type operationKey struct {
+	level  int32
+	hash   string
+	sender string
+}
+
+// keyOf returns the key of the given delegation, and false if it has no operation hash.
+func keyOf(dlg Delegation) (operationKey, bool) {
+	return operationKey{dlg.Level, dlg.OperationHash, dlg.Sender}, dlg.OperationHash != ""
+}
+
+// checkpointOf returns the checkpoint located at the given delegation.
+func checkpointOf(dlg Delegation) Checkpoint {
+	return Checkpoint{OperationID: dlg.OperationID, Level: dlg.Level}
+}
+
+// compareDelegations orders delegations by block timestamp most recent first, then by
+// operation ID.
+func compareDelegations(a, b Delegation) int {
+	return cmp.Or(b.BlockTimestamp.Compare(a.BlockTimestamp), cmp.Compare(b.OperationID, a.OperationID))
+}
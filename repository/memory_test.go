@@ -0,0 +1,13 @@
+package repository_test
+
+import (
+	"kiln-tezos-delegation/repository"
+	"kiln-tezos-delegation/repository/repositorytest"
+	"testing"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	repositorytest.Run(t, func(*testing.T) repositorytest.Repository {
+		return repository.NewMemoryRepository()
+	})
+}
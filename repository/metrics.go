@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// queryDuration is the duration of repository operations, by operation.
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "tezos_delegation",
+	Name:      "db_query_duration_seconds",
+	Help:      "Duration of database operations, transactions included, by repository operation.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"operation"})
+
+// observeQuery starts timing the given repository operation. The returned function
+// records its duration, and logs it at debug level.
+func (p PostgresRepository) observeQuery(ctx context.Context, op string) func() {
+	return observeOperation(ctx, p.logger, op)
+}
+
+// observeOperation starts timing the given operation of any storage backend, see
+// observeQuery.
+func observeOperation(ctx context.Context, logger *slog.Logger, op string) func() {
+	timer := prometheus.NewTimer(queryDuration.WithLabelValues(op))
+	return func() {
+		elapsed := timer.ObserveDuration()
+		logger.DebugContext(ctx, "repository operation", "operation", op, "duration", elapsed.Round(time.Microsecond))
+	}
+}
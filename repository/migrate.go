@@ -0,0 +1,308 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationFiles are the PostgreSQL migrations, named after their version, e.g.
+// "001_tezos_delegation.sql".
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationSeparator separates the statements applying a migration from the ones
+// reverting it, in migration files.
+const migrationSeparator = "---- create above / drop below ----"
+
+// migrationLockID is the key of the PostgreSQL advisory lock held while migrating, so
+// that instances started concurrently do not race.
+const migrationLockID int64 = 0x74657a6f735f6d67
+
+// ErrChecksumMismatch is matched by errors returned when an applied migration was
+// modified since.
+var ErrChecksumMismatch = errors.New("migration checksum mismatch")
+
+// Migration is a versioned change of the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	// Statements applying the migration
+	Up string
+	// Statements reverting the migration, empty if it cannot be reverted
+	Down string
+	// Hex-encoded SHA-256 of the migration file
+	Checksum string
+}
+
+// MigrationStatus is a migration along with its state in the database.
+type MigrationStatus struct {
+	Migration
+	Applied bool
+	// Zero if not applied
+	AppliedAt time.Time
+}
+
+// appliedMigration is a migration recorded as applied in the database.
+type appliedMigration struct {
+	version   int
+	checksum  string
+	appliedAt time.Time
+}
+
+// parseMigrations reads the migration files of the given directory, ordered by version.
+// Files are named after their version and name, e.g. "001_tezos_delegation.sql", and
+// hold the statements reverting them after the migrationSeparator line, if any.
+func parseMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		num, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: file name must start with a positive version", entry.Name())
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		up, down, _ := strings.Cut(string(content), migrationSeparator)
+
+		migrations = append(migrations, Migration{
+			Version:  version,
+			Name:     name,
+			Up:       strings.TrimSpace(up),
+			Down:     strings.TrimSpace(down),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migration %d: duplicate version", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// verifyMigrations returns an error if any applied migration is unknown, or was
+// modified since it was applied.
+func verifyMigrations(migrations []Migration, applied map[int]appliedMigration) error {
+	known := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = m
+	}
+
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+
+	for _, version := range versions {
+		m, ok := known[version]
+		if !ok {
+			return fmt.Errorf("migration %d: applied but unknown, the database is more recent than the binary", version)
+		}
+		if m.Checksum != applied[version].checksum {
+			return fmt.Errorf("%w: migration %d_%s was modified since applied", ErrChecksumMismatch, m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// MigrateUp applies the pending migrations in order, each one in a transaction, and
+// returns the number of migrations applied. Migrations are run under an advisory lock,
+// so that concurrent instances wait for each other. Returns an error matching
+// ErrChecksumMismatch if an applied migration was modified since.
+func (p PostgresRepository) MigrateUp(ctx context.Context) (int, error) {
+	count := 0
+	err := p.withMigrations(ctx, func(conn *pgxpool.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+					m.Version, m.Name, m.Checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			p.logger.InfoContext(ctx, "migration applied", "version", m.Version, "name", m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown reverts the given number of the latest applied migrations, in reverse
+// order, each one in a transaction, and returns the number of migrations reverted.
+// Migrations are run under an advisory lock, as with MigrateUp.
+func (p PostgresRepository) MigrateDown(ctx context.Context, steps int) (int, error) {
+	count := 0
+	err := p.withMigrations(ctx, func(conn *pgxpool.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s: cannot be reverted", m.Version, m.Name)
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			p.logger.InfoContext(ctx, "migration reverted", "version", m.Version, "name", m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrationStatus returns every known migration, ordered by version, along with its
+// state in the database. Returns an error matching ErrChecksumMismatch if an applied
+// migration was modified since.
+func (p PostgresRepository) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := p.withMigrations(ctx, func(_ *pgxpool.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for _, m := range migrations {
+			a, ok := applied[m.Version]
+			statuses = append(statuses, MigrationStatus{Migration: m, Applied: ok, AppliedAt: a.appliedAt})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// withMigrations calls the given function with a connection holding the migration
+// lock, the known migrations and the applied ones, once verified. The versions table
+// is created first if needed.
+func (p PostgresRepository) withMigrations(ctx context.Context, fn func(*pgxpool.Conn, []Migration, map[int]appliedMigration) error) error {
+	migrations, err := parseMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	// advisory locks are held by sessions, hence a dedicated connection
+	conn, err := p.cnxPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("migration lock: %w", err)
+	}
+	defer func() {
+		_, _ = conn.Exec(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}()
+
+	if err := p.prepareMigrations(ctx, conn, migrations); err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	applied := map[int]appliedMigration{}
+	var a appliedMigration
+	_, err = pgx.ForEachRow(rows, []any{&a.version, &a.checksum, &a.appliedAt}, func() error {
+		applied[a.version] = a
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := verifyMigrations(migrations, applied); err != nil {
+		return err
+	}
+	return fn(conn, migrations, applied)
+}
+
+// prepareMigrations creates the versions table if needed. Databases migrated with the
+// tern tool before have their tern version imported, assuming the migrations applied
+// are the known ones.
+func (p PostgresRepository) prepareMigrations(ctx context.Context, conn *pgxpool.Conn, migrations []Migration) error {
+	const create = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+		)`
+	if _, err := conn.Exec(ctx, create); err != nil {
+		return err
+	}
+
+	var empty, ternTable bool
+	err := conn.QueryRow(ctx, `
+		SELECT NOT EXISTS (SELECT 1 FROM schema_migrations), to_regclass('public.schema_version') IS NOT NULL`,
+	).Scan(&empty, &ternTable)
+	if err != nil || !empty || !ternTable {
+		return err
+	}
+
+	var ternVersion int
+	if err := conn.QueryRow(ctx, "SELECT version FROM public.schema_version").Scan(&ternVersion); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for _, m := range migrations {
+			if m.Version > ternVersion {
+				break
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+				m.Version, m.Name, m.Checksum)
+			if err != nil {
+				return err
+			}
+		}
+		p.logger.InfoContext(ctx, "imported migrations applied with tern", "version", ternVersion)
+		return nil
+	})
+}
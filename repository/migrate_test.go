@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMigrations(t *testing.T) {
+	t.Run("parses embedded migrations", func(t *testing.T) {
+		migrations, err := parseMigrations(migrationFiles, "migrations")
+
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version)
+			assert.NotEmpty(t, m.Name)
+			assert.NotEmpty(t, m.Up)
+			assert.NotEmpty(t, m.Down)
+			assert.Len(t, m.Checksum, 64)
+		}
+		assert.Equal(t, "tezos_delegation", migrations[0].Name)
+	})
+
+	t.Run("orders by version and splits up and down", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"m/010_second.sql": {Data: []byte("CREATE INDEX i;\n" + migrationSeparator + "\nDROP INDEX i;\n")},
+			"m/002_first.sql":  {Data: []byte("CREATE TABLE t ();\n")},
+			"m/README.md":      {Data: []byte("not a migration")},
+		}
+
+		migrations, err := parseMigrations(fsys, "m")
+
+		require.NoError(t, err)
+		require.Len(t, migrations, 2)
+		assert.Equal(t, 2, migrations[0].Version)
+		assert.Equal(t, "first", migrations[0].Name)
+		assert.Equal(t, "CREATE TABLE t ();", migrations[0].Up)
+		assert.Empty(t, migrations[0].Down)
+		assert.Equal(t, 10, migrations[1].Version)
+		assert.Equal(t, "CREATE INDEX i;", migrations[1].Up)
+		assert.Equal(t, "DROP INDEX i;", migrations[1].Down)
+		assert.NotEqual(t, migrations[0].Checksum, migrations[1].Checksum)
+	})
+
+	t.Run("rejects file name without version", func(t *testing.T) {
+		_, err := parseMigrations(fstest.MapFS{"m/init.sql": {Data: []byte("SELECT 1;")}}, "m")
+
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects duplicate versions", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"m/001_a.sql": {Data: []byte("SELECT 1;")},
+			"m/1_b.sql":   {Data: []byte("SELECT 2;")},
+		}
+
+		_, err := parseMigrations(fsys, "m")
+
+		assert.ErrorContains(t, err, "duplicate version")
+	})
+}
+
+func TestVerifyMigrations(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Name: "a", Checksum: "aaa"},
+		{Version: 2, Name: "b", Checksum: "bbb"},
+	}
+
+	t.Run("accepts applied migrations unchanged", func(t *testing.T) {
+		err := verifyMigrations(migrations, map[int]appliedMigration{1: {version: 1, checksum: "aaa"}})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("rejects modified migration", func(t *testing.T) {
+		err := verifyMigrations(migrations, map[int]appliedMigration{
+			1: {version: 1, checksum: "aaa"},
+			2: {version: 2, checksum: "changed"},
+		})
+
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+		assert.ErrorContains(t, err, "2_b")
+	})
+
+	t.Run("rejects unknown applied migration", func(t *testing.T) {
+		err := verifyMigrations(migrations, map[int]appliedMigration{3: {version: 3, checksum: "ccc"}})
+
+		assert.ErrorContains(t, err, "unknown")
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	repo, err := NewPostgresRepository(ctx, url, slog.Default())
+	require.NoError(t, err)
+
+	t.Run("applies pending migrations once", func(t *testing.T) {
+		_, err := repo.MigrateUp(ctx)
+		require.NoError(t, err)
+
+		count, err := repo.MigrateUp(ctx)
+		assert.NoError(t, err)
+		assert.Zero(t, count)
+
+		statuses, err := repo.MigrationStatus(ctx)
+		assert.NoError(t, err)
+		for _, s := range statuses {
+			assert.True(t, s.Applied, s.Name)
+		}
+	})
+}
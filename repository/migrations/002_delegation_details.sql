@@ -0,0 +1,27 @@
+ALTER TABLE delegation
+  ADD COLUMN operation_hash TEXT NOT NULL DEFAULT '',
+  ADD COLUMN status TEXT NOT NULL DEFAULT 'applied',
+  ADD COLUMN fee BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN prev_delegate TEXT,
+  ADD COLUMN new_delegate TEXT;
+
+COMMENT ON COLUMN delegation.operation_hash IS 'Hash of the delegation operation';
+COMMENT ON COLUMN delegation.status IS 'Operation status (applied, failed, backtracked, skipped)';
+COMMENT ON COLUMN delegation.fee IS 'Fee paid to the baker for including the operation';
+COMMENT ON COLUMN delegation.prev_delegate IS 'Account address of the baker the sender delegated from, NULL if it was not delegating';
+COMMENT ON COLUMN delegation.new_delegate IS 'Account address of the baker the sender delegated to, NULL on undelegation';
+
+CREATE INDEX idx_delegation_new_delegate ON delegation (new_delegate);
+CREATE INDEX idx_delegation_prev_delegate ON delegation (prev_delegate);
+
+---- create above / drop below ----
+
+DROP INDEX idx_delegation_prev_delegate;
+DROP INDEX idx_delegation_new_delegate;
+
+ALTER TABLE delegation
+  DROP COLUMN new_delegate,
+  DROP COLUMN prev_delegate,
+  DROP COLUMN fee,
+  DROP COLUMN status,
+  DROP COLUMN operation_hash;
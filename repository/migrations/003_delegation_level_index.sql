@@ -0,0 +1,5 @@
+CREATE INDEX idx_delegation_level ON delegation (level);
+
+---- create above / drop below ----
+
+DROP INDEX idx_delegation_level;
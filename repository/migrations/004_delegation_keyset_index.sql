@@ -0,0 +1,5 @@
+CREATE INDEX idx_delegation_block_timestamp_operation_id ON delegation (block_timestamp DESC, operation_id DESC);
+
+---- create above / drop below ----
+
+DROP INDEX idx_delegation_block_timestamp_operation_id;
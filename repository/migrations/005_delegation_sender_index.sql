@@ -0,0 +1,5 @@
+CREATE INDEX idx_delegation_sender ON delegation (sender);
+
+---- create above / drop below ----
+
+DROP INDEX idx_delegation_sender;
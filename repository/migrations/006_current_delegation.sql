@@ -0,0 +1,28 @@
+CREATE TABLE current_delegation (
+  delegator TEXT PRIMARY KEY,
+  delegate TEXT,
+  operation_id BIGINT NOT NULL,
+  amount BIGINT NOT NULL,
+  level INTEGER NOT NULL,
+  block_timestamp TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+COMMENT ON TABLE current_delegation IS 'Latest delegation state of every account, derived from applied delegations';
+COMMENT ON COLUMN current_delegation.delegator IS 'Account address (public key hash) of the delegated account';
+COMMENT ON COLUMN current_delegation.delegate IS 'Account address of the baker currently delegated to, NULL if undelegated';
+COMMENT ON COLUMN current_delegation.operation_id IS 'Unique ID of the latest delegation operation of the account, stored in the TzKT indexer database';
+COMMENT ON COLUMN current_delegation.amount IS 'Sender balance at the time of the latest delegation operation';
+COMMENT ON COLUMN current_delegation.level IS 'The height of the block in which the latest delegation operation was included';
+COMMENT ON COLUMN current_delegation.block_timestamp IS 'Timestamp with time zone of the block of the latest delegation operation';
+
+CREATE INDEX idx_current_delegation_delegate ON current_delegation (delegate);
+
+INSERT INTO current_delegation (delegator, delegate, operation_id, amount, level, block_timestamp)
+SELECT DISTINCT ON (sender) sender, new_delegate, operation_id, amount, level, block_timestamp
+FROM delegation
+WHERE status = 'applied'
+ORDER BY sender, level DESC, operation_id DESC;
+
+---- create above / drop below ----
+
+DROP TABLE current_delegation CASCADE;
@@ -0,0 +1,17 @@
+CREATE TABLE backfill_range (
+  from_level INTEGER NOT NULL,
+  to_level INTEGER NOT NULL,
+  next_level INTEGER NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  PRIMARY KEY (from_level, to_level)
+);
+
+COMMENT ON TABLE backfill_range IS 'Progress of historical backfills, by level range';
+COMMENT ON COLUMN backfill_range.from_level IS 'First level of the range, inclusive';
+COMMENT ON COLUMN backfill_range.to_level IS 'Last level of the range, exclusive';
+COMMENT ON COLUMN backfill_range.next_level IS 'Level from which the range is still to be backfilled, equal to to_level once done';
+COMMENT ON COLUMN backfill_range.updated_at IS 'Timestamp with time zone of the last progress';
+
+---- create above / drop below ----
+
+DROP TABLE backfill_range;
@@ -0,0 +1,21 @@
+CREATE TABLE scraper_state (
+  id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+  last_operation_id BIGINT NOT NULL,
+  last_level INTEGER NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+COMMENT ON TABLE scraper_state IS 'Checkpoint of the scraper, single row';
+COMMENT ON COLUMN scraper_state.last_operation_id IS 'ID of the last delegation operation scraped, stored in the TzKT indexer database';
+COMMENT ON COLUMN scraper_state.last_level IS 'Level of the block of the last delegation operation scraped';
+COMMENT ON COLUMN scraper_state.updated_at IS 'Timestamp with time zone of the last checkpoint';
+
+INSERT INTO scraper_state (last_operation_id, last_level)
+SELECT operation_id, level
+FROM delegation
+ORDER BY level DESC, operation_id DESC
+LIMIT 1;
+
+---- create above / drop below ----
+
+DROP TABLE scraper_state;
@@ -0,0 +1,17 @@
+-- Operation IDs differ between TzKT instances: a delegation is identified by its
+-- operation hash and sender within its block, an operation group holding at most one
+-- delegation per sender. Duplicates fetched from different instances are
+-- removed, keeping the first stored one.
+DELETE FROM delegation dup
+USING delegation kept
+WHERE dup.level = kept.level
+  AND dup.operation_hash = kept.operation_hash
+  AND dup.sender = kept.sender
+  AND dup.operation_hash <> ''
+  AND dup.operation_id > kept.operation_id;
+
+CREATE UNIQUE INDEX idx_delegation_level_operation_hash ON delegation (level, operation_hash, sender) WHERE operation_hash <> '';
+
+---- create above / drop below ----
+
+DROP INDEX idx_delegation_level_operation_hash;
@@ -0,0 +1,55 @@
+-- Timestamps are stored in microseconds since the Unix epoch, UTC, as precise as PostgreSQL ones.
+
+CREATE TABLE delegation (
+  operation_id INTEGER PRIMARY KEY,
+  inserted_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER) * 1000000),
+  block_timestamp INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  level INTEGER NOT NULL,
+  sender TEXT NOT NULL,
+  block_hash TEXT NOT NULL,
+  operation_hash TEXT NOT NULL DEFAULT '',
+  status TEXT NOT NULL DEFAULT 'applied',
+  fee INTEGER NOT NULL DEFAULT 0,
+  prev_delegate TEXT,
+  new_delegate TEXT
+);
+
+CREATE INDEX idx_delegation_block_timestamp_operation_id ON delegation (block_timestamp DESC, operation_id DESC);
+CREATE INDEX idx_delegation_level ON delegation (level);
+CREATE INDEX idx_delegation_sender ON delegation (sender);
+CREATE INDEX idx_delegation_new_delegate ON delegation (new_delegate);
+CREATE INDEX idx_delegation_prev_delegate ON delegation (prev_delegate);
+
+CREATE TABLE current_delegation (
+  delegator TEXT PRIMARY KEY,
+  delegate TEXT,
+  operation_id INTEGER NOT NULL,
+  amount INTEGER NOT NULL,
+  level INTEGER NOT NULL,
+  block_timestamp INTEGER NOT NULL
+);
+
+CREATE INDEX idx_current_delegation_delegate ON current_delegation (delegate);
+
+CREATE TABLE backfill_range (
+  from_level INTEGER NOT NULL,
+  to_level INTEGER NOT NULL,
+  next_level INTEGER NOT NULL,
+  updated_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER) * 1000000),
+  PRIMARY KEY (from_level, to_level)
+);
+
+CREATE TABLE scraper_state (
+  id INTEGER PRIMARY KEY CHECK (id = 1),
+  last_operation_id INTEGER NOT NULL,
+  last_level INTEGER NOT NULL,
+  updated_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER) * 1000000)
+);
+
+---- create above / drop below ----
+
+DROP TABLE scraper_state;
+DROP TABLE backfill_range;
+DROP TABLE current_delegation;
+DROP TABLE delegation;
@@ -0,0 +1,18 @@
+-- Operation IDs differ between TzKT instances: a delegation is identified by its
+-- operation hash and sender within its block, an operation group holding at most one
+-- delegation per sender. Duplicates fetched from different instances are
+-- removed, keeping the first stored one.
+DELETE FROM delegation
+WHERE operation_hash <> '' AND EXISTS (
+  SELECT 1 FROM delegation kept
+  WHERE kept.level = delegation.level
+    AND kept.operation_hash = delegation.operation_hash
+    AND kept.sender = delegation.sender
+    AND kept.operation_id < delegation.operation_id
+);
+
+CREATE UNIQUE INDEX idx_delegation_level_operation_hash ON delegation (level, operation_hash, sender) WHERE operation_hash <> '';
+
+---- create above / drop below ----
+
+DROP INDEX idx_delegation_level_operation_hash;
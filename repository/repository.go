@@ -2,13 +2,24 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// ErrNotFound is returned when the requested entity does not exist.
+var ErrNotFound = errors.New("not found")
+
+// PostgresRepository stores delegations in a PostgreSQL database. The duration of
+// every operation is recorded as a metric, and logged at debug level.
 type PostgresRepository struct {
 	cnxPool *pgxpool.Pool
+	logger  *slog.Logger
 }
 
 type Delegation struct {
@@ -18,9 +29,141 @@ type Delegation struct {
 	Level          int32
 	Sender         string
 	BlockHash      string
+	OperationHash  string
+	Status         string
+	Fee            int64
+	// Baker the sender delegated from, empty if it was not delegating
+	PrevDelegate string
+	// Baker the sender delegated to, empty on undelegation
+	NewDelegate string
+}
+
+// CurrentDelegation is the latest delegation state of an account, given by its most
+// recent applied delegation.
+type CurrentDelegation struct {
+	Delegator string
+	// Baker currently delegated to, empty if undelegated
+	Delegate    string
+	OperationID int64
+	Amount      int64
+	Level       int32
+	// Block timestamp of the latest delegation
+	Since time.Time
+}
+
+// Checkpoint locates the last delegation operation scraped, from which scraping resumes.
+type Checkpoint struct {
+	OperationID int64
+	Level       int32
+}
+
+// Before returns true if the given checkpoint is further than this one. Levels are
+// compared first, since operation IDs differ between TzKT instances.
+func (c Checkpoint) Before(other Checkpoint) bool {
+	if c.Level != other.Level {
+		return c.Level < other.Level
+	}
+	return c.OperationID < other.OperationID
+}
+
+// InsertStats reports the outcome of a delegation insertion.
+type InsertStats struct {
+	Inserted int64
+	// Number of delegations already stored, or duplicated in the inserted ones
+	Skipped int64
+}
+
+// Cursor locates a delegation in the sorting order of delegations, which is by
+// block timestamp most recent first, then by operation ID.
+type Cursor struct {
+	BlockTimestamp time.Time
+	OperationID    int64
+}
+
+// Page selects at most Limit delegations located after the cursor, if any.
+// A zero limit means no limit.
+type Page struct {
+	Limit int
+	After *Cursor
+}
+
+// Block references a block in which stored delegations were included.
+type Block struct {
+	Level     int32
+	Hash      string
+	Timestamp time.Time
+}
+
+// BackfillRange is the progress of a historical backfill over the [FromLevel, ToLevel[
+// level range. Levels below NextLevel are backfilled; the range is done once NextLevel
+// reaches ToLevel.
+type BackfillRange struct {
+	FromLevel int32
+	ToLevel   int32
+	NextLevel int32
+}
+
+// Done returns true if the whole range is backfilled.
+func (r BackfillRange) Done() bool {
+	return r.NextLevel >= r.ToLevel
+}
+
+// BakerStats are aggregate statistics of the delegations to a baker.
+type BakerStats struct {
+	// Number of accounts currently delegating to the baker
+	DelegatorCount int64
+	// Sum of the amounts of the current delegations to the baker
+	DelegatedBalance int64
+	// Delegations to the baker over a period
+	Inflow Flow
+	// Delegations away from the baker over a period
+	Outflow Flow
+	// Current delegators with the biggest amounts
+	TopDelegators []Delegator
+}
+
+// Flow is the number and summed amount of delegations.
+type Flow struct {
+	Count  int64
+	Amount int64
 }
 
-func NewPostgresRepository(ctx context.Context, cnxString string) (PostgresRepository, error) {
+// Delegator is an account currently delegating to a baker.
+type Delegator struct {
+	Address string
+	Amount  int64
+	// Block timestamp of the delegation
+	Since time.Time
+}
+
+// Interval is the duration of histogram buckets.
+type Interval string
+
+const (
+	IntervalDay   Interval = "day"
+	IntervalWeek  Interval = "week"
+	IntervalMonth Interval = "month"
+)
+
+// validate returns an error if the interval is not supported.
+func (i Interval) validate() error {
+	switch i {
+	case IntervalDay, IntervalWeek, IntervalMonth:
+		return nil
+	default:
+		return fmt.Errorf("unsupported interval %q", i)
+	}
+}
+
+// Bucket is the number and summed amount of delegations within a time interval.
+type Bucket struct {
+	// Beginning of the interval
+	Start  time.Time
+	Count  int64
+	Amount int64
+}
+
+func NewPostgresRepository(ctx context.Context, cnxString string, logger *slog.Logger) (PostgresRepository, error) {
 	cnxPool, err := pgxpool.New(ctx, cnxString)
 	if err != nil {
 		return PostgresRepository{}, err
@@ -30,74 +173,205 @@ func NewPostgresRepository(ctx context.Context, cnxString string) (PostgresRepos
 	}
 	return PostgresRepository{
 		cnxPool: cnxPool,
+		logger:  logger,
 	}, nil
 }
 
-// AddNewDelegations inserts delegations and skips duplicates.
-func (p PostgresRepository) AddNewDelegations(ctx context.Context, dlgs []Delegation) error {
+// Ping checks the database is reachable.
+func (p PostgresRepository) Ping(ctx context.Context) error {
+	defer p.observeQuery(ctx, "ping")()
+
+	return p.cnxPool.Ping(ctx)
+}
+
+// AddNewDelegations inserts delegations and skips duplicates, having the same operation
+// ID or the same operation hash and sender at the same level. Delegations are copied
+// into a staging table, then merged in a single statement. The current delegation
+// state of the senders of applied delegations is updated in the same transaction,
+// unless a more recent delegation was already stored, so insertion order does not matter.
+// Returns how many delegations were inserted and skipped as duplicates, or ErrLockLost
+// if the context is fenced by a lock which was lost, see WithFence.
+func (p PostgresRepository) AddNewDelegations(ctx context.Context, dlgs []Delegation) (InsertStats, error) {
+	defer p.observeQuery(ctx, "add_new_delegations")()
+
+	if len(dlgs) == 0 {
+		return InsertStats{}, nil
+	}
+
+	tx, err := p.cnxPool.Begin(ctx)
+	if err != nil {
+		return InsertStats{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkFence(ctx, tx); err != nil {
+		return InsertStats{}, err
+	}
+
+	stats, err := addNewDelegations(ctx, tx, dlgs)
+	if err != nil {
+		return InsertStats{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return InsertStats{}, err
+	}
+	return stats, nil
+}
+
+// AddNewDelegationsAndCheckpoint inserts delegations as AddNewDelegations does, and
+// moves the scraper checkpoint forward to the given one in the same transaction.
+// The checkpoint is left unchanged if it is already further.
+func (p PostgresRepository) AddNewDelegationsAndCheckpoint(ctx context.Context, dlgs []Delegation, cp Checkpoint) (InsertStats, error) {
+	defer p.observeQuery(ctx, "add_new_delegations_and_checkpoint")()
+
 	const query = `
-		INSERT INTO delegation (block_timestamp, operation_id, amount, level, sender, block_hash)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT DO NOTHING
+		INSERT INTO scraper_state (last_operation_id, last_level)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET
+			last_operation_id = EXCLUDED.last_operation_id,
+			last_level = EXCLUDED.last_level,
+			updated_at = now()
+		WHERE (scraper_state.last_level, scraper_state.last_operation_id) < (EXCLUDED.last_level, EXCLUDED.last_operation_id)
 	`
 	tx, err := p.cnxPool.Begin(ctx)
 	if err != nil {
-		return err
+		return InsertStats{}, err
 	}
 	defer tx.Rollback(ctx)
 
-	for i := range dlgs {
-		_, err := tx.Exec(ctx, query,
-			dlgs[i].BlockTimestamp, dlgs[i].OperationID, dlgs[i].Amount, dlgs[i].Level, dlgs[i].Sender, dlgs[i].BlockHash,
-		)
+	if err := checkFence(ctx, tx); err != nil {
+		return InsertStats{}, err
+	}
+
+	stats := InsertStats{}
+	if len(dlgs) > 0 {
+		stats, err = addNewDelegations(ctx, tx, dlgs)
 		if err != nil {
-			return err
+			return InsertStats{}, err
 		}
 	}
 
+	if _, err := tx.Exec(ctx, query, cp.OperationID, cp.Level); err != nil {
+		return InsertStats{}, err
+	}
+
 	if err := tx.Commit(ctx); err != nil {
-		return err
+		return InsertStats{}, err
 	}
-	return nil
+	return stats, nil
 }
 
-// GetDelegations get all delegations sorted by block timestamp most recent first.
-func (p PostgresRepository) GetDelegations(ctx context.Context) ([]Delegation, error) {
-	const query = `
-		SELECT block_timestamp, operation_id, amount, level, sender, block_hash
-		FROM delegation
-		ORDER BY block_timestamp DESC
+// GetCheckpoint returns the scraper checkpoint. Returns ErrNotFound if there is none.
+func (p PostgresRepository) GetCheckpoint(ctx context.Context) (Checkpoint, error) {
+	defer p.observeQuery(ctx, "get_checkpoint")()
+
+	const query = "SELECT last_operation_id, last_level FROM scraper_state"
+	var cp Checkpoint
+	err := p.cnxPool.QueryRow(ctx, query).Scan(&cp.OperationID, &cp.Level)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Checkpoint{}, ErrNotFound
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	return cp, nil
+}
+
+// addNewDelegations inserts delegations within the given transaction.
+func addNewDelegations(ctx context.Context, tx pgx.Tx, dlgs []Delegation) (InsertStats, error) {
+	const stagingQuery = `
+		CREATE TEMPORARY TABLE delegation_staging (
+			block_timestamp TIMESTAMP WITH TIME ZONE, operation_id BIGINT, amount BIGINT, level INTEGER,
+			sender TEXT, block_hash TEXT, operation_hash TEXT, status TEXT, fee BIGINT,
+			prev_delegate TEXT, new_delegate TEXT
+		) ON COMMIT DROP
 	`
+	const mergeQuery = `
+		INSERT INTO delegation (
+			block_timestamp, operation_id, amount, level, sender, block_hash,
+			operation_hash, status, fee, prev_delegate, new_delegate
+		)
+		SELECT
+			block_timestamp, operation_id, amount, level, sender, block_hash,
+			operation_hash, status, fee, prev_delegate, new_delegate
+		FROM delegation_staging
+		ORDER BY operation_id
+		ON CONFLICT DO NOTHING
+	`
+	const currentQuery = `
+		INSERT INTO current_delegation (delegator, delegate, operation_id, amount, level, block_timestamp)
+		SELECT DISTINCT ON (sender) sender, new_delegate, operation_id, amount, level, block_timestamp
+		FROM delegation_staging
+		WHERE status = 'applied'
+		ORDER BY sender, level DESC, operation_id DESC
+		ON CONFLICT (delegator) DO UPDATE SET
+			delegate = EXCLUDED.delegate,
+			operation_id = EXCLUDED.operation_id,
+			amount = EXCLUDED.amount,
+			level = EXCLUDED.level,
+			block_timestamp = EXCLUDED.block_timestamp
+		WHERE (current_delegation.level, current_delegation.operation_id) < (EXCLUDED.level, EXCLUDED.operation_id)
+	`
+	if _, err := tx.Exec(ctx, stagingQuery); err != nil {
+		return InsertStats{}, err
+	}
 
-	rows, err := p.cnxPool.Query(ctx, query)
+	columns := []string{
+		"block_timestamp", "operation_id", "amount", "level", "sender", "block_hash",
+		"operation_hash", "status", "fee", "prev_delegate", "new_delegate",
+	}
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{"delegation_staging"}, columns,
+		pgx.CopyFromSlice(len(dlgs), func(i int) ([]any, error) {
+			return []any{
+				dlgs[i].BlockTimestamp, dlgs[i].OperationID, dlgs[i].Amount, dlgs[i].Level, dlgs[i].Sender, dlgs[i].BlockHash,
+				dlgs[i].OperationHash, dlgs[i].Status, dlgs[i].Fee, nullString(dlgs[i].PrevDelegate), nullString(dlgs[i].NewDelegate),
+			}, nil
+		}),
+	)
 	if err != nil {
-		return []Delegation{}, err
+		return InsertStats{}, err
 	}
 
-	ret := make([]Delegation, 0)
-	for rows.Next() {
-		var dlg Delegation
-		if err := rows.Scan(
-			&dlg.BlockTimestamp, &dlg.OperationID, &dlg.Amount, &dlg.Level, &dlg.Sender, &dlg.BlockHash,
-		); err != nil {
-			return []Delegation{}, err
-		}
-		ret = append(ret, dlg)
+	tag, err := tx.Exec(ctx, mergeQuery)
+	if err != nil {
+		return InsertStats{}, err
+	}
+	if _, err := tx.Exec(ctx, currentQuery); err != nil {
+		return InsertStats{}, err
 	}
 
-	return ret, nil
+	return InsertStats{
+		Inserted: tag.RowsAffected(),
+		Skipped:  int64(len(dlgs)) - tag.RowsAffected(),
+	}, nil
 }
 
-// GetDelegationsOfYear get all delegations of a given year sorted by block timestamp most recent first.
-func (p PostgresRepository) GetDelegationsOfYear(ctx context.Context, year int) ([]Delegation, error) {
-	const query = `
-		SELECT block_timestamp, operation_id, amount, level, sender, block_hash
+// GetDelegations get a page of delegations matching the given filter, sorted by
+// block timestamp most recent first, then by operation ID. The page cursor is
+// applied with a keyset condition.
+func (p PostgresRepository) GetDelegations(ctx context.Context, filter DelegationFilter, page Page) ([]Delegation, error) {
+	defer p.observeQuery(ctx, "get_delegations")()
+
+	var b queryBuilder
+	filter.apply(&b)
+	if page.After != nil {
+		b.addRow("(block_timestamp, operation_id) < (%s)", page.After.BlockTimestamp, page.After.OperationID)
+	}
+	limit := "ALL"
+	if page.Limit > 0 {
+		limit = strconv.Itoa(page.Limit)
+	}
+
+	query := `
+		SELECT block_timestamp, operation_id, amount, level, sender, block_hash,
+			operation_hash, status, fee, COALESCE(prev_delegate, ''), COALESCE(new_delegate, '')
 		FROM delegation
-		WHERE EXTRACT(YEAR FROM block_timestamp) = $1
-		ORDER BY block_timestamp DESC
-	`
+		WHERE ` + b.where() + `
+		ORDER BY block_timestamp DESC, operation_id DESC
+		LIMIT ` + limit
 
-	rows, err := p.cnxPool.Query(ctx, query, year)
+	rows, err := p.cnxPool.Query(ctx, query, b.args...)
 	if err != nil {
 		return []Delegation{}, err
 	}
@@ -107,21 +381,303 @@ func (p PostgresRepository) GetDelegationsOfYear(ctx context.Context, year int)
 		var dlg Delegation
 		if err := rows.Scan(
 			&dlg.BlockTimestamp, &dlg.OperationID, &dlg.Amount, &dlg.Level, &dlg.Sender, &dlg.BlockHash,
+			&dlg.OperationHash, &dlg.Status, &dlg.Fee, &dlg.PrevDelegate, &dlg.NewDelegate,
 		); err != nil {
 			return []Delegation{}, err
 		}
 		ret = append(ret, dlg)
 	}
 
-	return ret, nil
+	return ret, rows.Err()
 }
 
 // GetLatestBlockTimestamp gets the most recent delegation's block timestamp.
+// Returns ErrNotFound if there is no delegation.
 func (p PostgresRepository) GetLatestBlockTimestamp(ctx context.Context) (time.Time, error) {
+	defer p.observeQuery(ctx, "get_latest_block_timestamp")()
+
 	const query = "SELECT block_timestamp FROM delegation ORDER BY block_timestamp DESC LIMIT 1"
 	var ts time.Time
-	if err := p.cnxPool.QueryRow(ctx, query).Scan(&ts); err != nil {
+	err := p.cnxPool.QueryRow(ctx, query).Scan(&ts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
 		return time.Time{}, err
 	}
 	return ts, nil
 }
+
+// GetLatestBlocks gets the references of the given number of most recent blocks
+// in which stored delegations were included, most recent first.
+func (p PostgresRepository) GetLatestBlocks(ctx context.Context, count int) ([]Block, error) {
+	defer p.observeQuery(ctx, "get_latest_blocks")()
+
+	const query = `
+		SELECT DISTINCT level, block_hash, block_timestamp
+		FROM delegation
+		ORDER BY level DESC
+		LIMIT $1
+	`
+
+	rows, err := p.cnxPool.Query(ctx, query, count)
+	if err != nil {
+		return []Block{}, err
+	}
+
+	ret := make([]Block, 0, count)
+	for rows.Next() {
+		var blk Block
+		if err := rows.Scan(&blk.Level, &blk.Hash, &blk.Timestamp); err != nil {
+			return []Block{}, err
+		}
+		ret = append(ret, blk)
+	}
+
+	return ret, rows.Err()
+}
+
+// DeleteDelegationsFromLevel deletes delegations included in blocks at the given
+// level or above, typically orphaned by a chain reorganisation. The current delegation
+// state of their senders is recomputed from the remaining delegations in the same
+// transaction, and the scraper checkpoint is moved back to the most recent remaining
+// delegation, or removed if none remains. Returns the number of deleted delegations,
+// or ErrLockLost as AddNewDelegations does.
+func (p PostgresRepository) DeleteDelegationsFromLevel(ctx context.Context, level int32) (int64, error) {
+	defer p.observeQuery(ctx, "delete_delegations_from_level")()
+
+	const query = "DELETE FROM delegation WHERE level >= $1"
+	const orphanedQuery = "DELETE FROM current_delegation WHERE level >= $1 RETURNING delegator"
+	const currentQuery = `
+		INSERT INTO current_delegation (delegator, delegate, operation_id, amount, level, block_timestamp)
+		SELECT DISTINCT ON (sender) sender, new_delegate, operation_id, amount, level, block_timestamp
+		FROM delegation
+		WHERE status = 'applied' AND sender = ANY($1)
+		ORDER BY sender, level DESC, operation_id DESC
+	`
+	const checkpointQuery = `
+		WITH latest AS (
+			SELECT operation_id, level FROM delegation ORDER BY level DESC, operation_id DESC LIMIT 1
+		)
+		UPDATE scraper_state
+		SET last_operation_id = latest.operation_id, last_level = latest.level, updated_at = now()
+		FROM latest
+		WHERE scraper_state.last_level >= $1
+	`
+	const noCheckpointQuery = "DELETE FROM scraper_state WHERE last_level >= $1"
+	tx, err := p.cnxPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkFence(ctx, tx); err != nil {
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, query, level)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(ctx, orphanedQuery, level)
+	if err != nil {
+		return 0, err
+	}
+	delegators, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, currentQuery, delegators); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, checkpointQuery, level); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, noCheckpointQuery, level); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetCurrentDelegation returns the current delegation state of the given account.
+// Returns ErrNotFound if the account has no applied delegation.
+func (p PostgresRepository) GetCurrentDelegation(ctx context.Context, delegator string) (CurrentDelegation, error) {
+	defer p.observeQuery(ctx, "get_current_delegation")()
+
+	const query = `
+		SELECT delegator, COALESCE(delegate, ''), operation_id, amount, level, block_timestamp
+		FROM current_delegation
+		WHERE delegator = $1
+	`
+	var cur CurrentDelegation
+	err := p.cnxPool.QueryRow(ctx, query, delegator).Scan(
+		&cur.Delegator, &cur.Delegate, &cur.OperationID, &cur.Amount, &cur.Level, &cur.Since,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return CurrentDelegation{}, ErrNotFound
+	}
+	if err != nil {
+		return CurrentDelegation{}, err
+	}
+	return cur, nil
+}
+
+// GetBackfillRanges returns the progress of the backfill ranges lying within the
+// [from, to[ level range, by ascending first level.
+func (p PostgresRepository) GetBackfillRanges(ctx context.Context, from, to int32) ([]BackfillRange, error) {
+	defer p.observeQuery(ctx, "get_backfill_ranges")()
+
+	const query = `
+		SELECT from_level, to_level, next_level
+		FROM backfill_range
+		WHERE from_level >= $1 AND to_level <= $2
+		ORDER BY from_level
+	`
+	rows, err := p.cnxPool.Query(ctx, query, from, to)
+	if err != nil {
+		return []BackfillRange{}, err
+	}
+
+	ret := []BackfillRange{}
+	for rows.Next() {
+		var rng BackfillRange
+		if err := rows.Scan(&rng.FromLevel, &rng.ToLevel, &rng.NextLevel); err != nil {
+			return []BackfillRange{}, err
+		}
+		ret = append(ret, rng)
+	}
+	if err := rows.Err(); err != nil {
+		return []BackfillRange{}, err
+	}
+
+	return ret, nil
+}
+
+// SaveBackfillRange records the progress of a backfill range.
+func (p PostgresRepository) SaveBackfillRange(ctx context.Context, rng BackfillRange) error {
+	defer p.observeQuery(ctx, "save_backfill_range")()
+
+	const query = `
+		INSERT INTO backfill_range (from_level, to_level, next_level)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (from_level, to_level) DO UPDATE SET
+			next_level = EXCLUDED.next_level,
+			updated_at = now()
+	`
+	_, err := p.cnxPool.Exec(ctx, query, rng.FromLevel, rng.ToLevel, rng.NextLevel)
+	return err
+}
+
+// GetBakerStats computes aggregate statistics of the delegations to the given baker.
+// Delegators are accounts which current delegation is to the baker; at most top of
+// them are returned, by decreasing amount. Flows are computed over delegations having
+// their block timestamp within [from, to[.
+func (p PostgresRepository) GetBakerStats(ctx context.Context, baker string, from, to time.Time, top int) (BakerStats, error) {
+	defer p.observeQuery(ctx, "get_baker_stats")()
+
+	const totalQuery = `
+		SELECT COUNT(*), COALESCE(SUM(amount), 0)
+		FROM current_delegation
+		WHERE delegate = $1
+	`
+	const topQuery = `
+		SELECT delegator, amount, block_timestamp
+		FROM current_delegation
+		WHERE delegate = $1
+		ORDER BY amount DESC, delegator
+		LIMIT $2
+	`
+	const flowQuery = `
+		SELECT
+			COUNT(*) FILTER (WHERE new_delegate = $1),
+			COALESCE(SUM(amount) FILTER (WHERE new_delegate = $1), 0),
+			COUNT(*) FILTER (WHERE prev_delegate = $1),
+			COALESCE(SUM(amount) FILTER (WHERE prev_delegate = $1), 0)
+		FROM delegation
+		WHERE status = 'applied'
+			AND new_delegate IS DISTINCT FROM prev_delegate
+			AND (new_delegate = $1 OR prev_delegate = $1)
+			AND block_timestamp >= $2 AND block_timestamp < $3
+	`
+
+	stats := BakerStats{TopDelegators: make([]Delegator, 0, top)}
+
+	if err := p.cnxPool.QueryRow(ctx, totalQuery, baker).Scan(
+		&stats.DelegatorCount, &stats.DelegatedBalance,
+	); err != nil {
+		return BakerStats{}, err
+	}
+
+	rows, err := p.cnxPool.Query(ctx, topQuery, baker, top)
+	if err != nil {
+		return BakerStats{}, err
+	}
+	for rows.Next() {
+		var dlgr Delegator
+		if err := rows.Scan(&dlgr.Address, &dlgr.Amount, &dlgr.Since); err != nil {
+			return BakerStats{}, err
+		}
+		stats.TopDelegators = append(stats.TopDelegators, dlgr)
+	}
+	if err := rows.Err(); err != nil {
+		return BakerStats{}, err
+	}
+
+	if err := p.cnxPool.QueryRow(ctx, flowQuery, baker, from, to).Scan(
+		&stats.Inflow.Count, &stats.Inflow.Amount, &stats.Outflow.Count, &stats.Outflow.Amount,
+	); err != nil {
+		return BakerStats{}, err
+	}
+
+	return stats, nil
+}
+
+// GetDelegationHistogram counts and sums the amounts of applied delegations having their
+// block timestamp within [from, to[, by UTC time interval. Only non-empty buckets are returned,
+// oldest first. Weeks start on Mondays.
+func (p PostgresRepository) GetDelegationHistogram(ctx context.Context, interval Interval, from, to time.Time) ([]Bucket, error) {
+	defer p.observeQuery(ctx, "get_delegation_histogram")()
+
+	const query = `
+		SELECT date_trunc($1, block_timestamp AT TIME ZONE 'UTC') AS bucket, COUNT(*), COALESCE(SUM(amount), 0)
+		FROM delegation
+		WHERE status = 'applied' AND block_timestamp >= $2 AND block_timestamp < $3
+		GROUP BY bucket
+		ORDER BY bucket
+	`
+
+	// checked beforehand, the interval is not evaluated without delegations in the period
+	if err := interval.validate(); err != nil {
+		return []Bucket{}, err
+	}
+
+	rows, err := p.cnxPool.Query(ctx, query, string(interval), from, to)
+	if err != nil {
+		return []Bucket{}, err
+	}
+
+	ret := make([]Bucket, 0)
+	for rows.Next() {
+		var bkt Bucket
+		if err := rows.Scan(&bkt.Start, &bkt.Count, &bkt.Amount); err != nil {
+			return []Bucket{}, err
+		}
+		bkt.Start = bkt.Start.UTC()
+		ret = append(ret, bkt)
+	}
+
+	return ret, rows.Err()
+}
+
+// nullString returns nil for an empty string so that it is stored as NULL.
+func nullString(val string) any {
+	if val == "" {
+		return nil
+	}
+	return val
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// benchOperationID is the first operation ID of benchmark delegations, far above
+// real TzKT operation IDs so that benchmarks do not collide with scraped data.
+const benchOperationID = int64(1) << 50
+
+// newBenchRepository connects to the migrated database given by the TEST_DATABASE_URL
+// environment variable, and deletes benchmark delegations at the end of the benchmark.
+// Skips the benchmark if the variable is not set.
+func newBenchRepository(b *testing.B) PostgresRepository {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		b.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	repo, err := NewPostgresRepository(ctx, url, slog.Default())
+	require.NoError(b, err)
+
+	b.Cleanup(func() {
+		_, _ = repo.cnxPool.Exec(ctx, "DELETE FROM delegation WHERE operation_id >= $1", benchOperationID)
+		_, _ = repo.cnxPool.Exec(ctx, "DELETE FROM current_delegation WHERE operation_id >= $1", benchOperationID)
+		repo.cnxPool.Close()
+	})
+	return repo
+}
+
+// benchDelegations returns count delegations with operation IDs starting at first.
+func benchDelegations(first int64, count int) []Delegation {
+	ts := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+	dlgs := make([]Delegation, count)
+	for i := range dlgs {
+		id := first + int64(i)
+		dlgs[i] = Delegation{
+			BlockTimestamp: ts,
+			OperationID:    id,
+			Amount:         id % 1000000,
+			Level:          int32(i / 10),
+			Sender:         "tz1bench" + strconv.FormatInt(id%5000, 10),
+			BlockHash:      "BLbench",
+			OperationHash:  "oobench" + strconv.FormatInt(id, 10),
+			Status:         "applied",
+			NewDelegate:    "tz1benchbaker",
+		}
+	}
+	return dlgs
+}
+
+func BenchmarkAddNewDelegations(b *testing.B) {
+	for _, size := range []int{100, 1000, 10000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			repo := newBenchRepository(b)
+			ctx := context.Background()
+			next := benchOperationID
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stats, err := repo.AddNewDelegations(ctx, benchDelegations(next, size))
+				require.NoError(b, err)
+				require.Equal(b, int64(size), stats.Inserted)
+				next += int64(size)
+			}
+			b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+func BenchmarkAddNewDelegationsDuplicates(b *testing.B) {
+	const size = 1000
+	repo := newBenchRepository(b)
+	ctx := context.Background()
+	dlgs := benchDelegations(benchOperationID, size)
+	_, err := repo.AddNewDelegations(ctx, dlgs)
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stats, err := repo.AddNewDelegations(ctx, dlgs)
+		require.NoError(b, err)
+		require.Equal(b, int64(size), stats.Skipped)
+	}
+	b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "rows/s")
+}
@@ -0,0 +1,30 @@
+package repository_test
+
+import (
+	"context"
+	"kiln-tezos-delegation/repository"
+	"kiln-tezos-delegation/repository/repositorytest"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresRepository(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	repo, err := repository.NewPostgresRepository(ctx, url, slog.Default())
+	require.NoError(t, err)
+	_, err = repo.MigrateUp(ctx)
+	require.NoError(t, err)
+
+	repositorytest.Run(t, func(t *testing.T) repositorytest.Repository {
+		require.NoError(t, repo.Truncate(ctx))
+		return repo
+	})
+}
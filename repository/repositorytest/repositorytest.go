@@ -0,0 +1,552 @@
+// Package repositorytest provides the conformance test suite of the storage backends,
+// which every implementation of the repository operations must pass.
+package repositorytest
+
+import (
+	"context"
+	"fmt"
+	"kiln-tezos-delegation/repository"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Repository is a storage backend of delegations.
+type Repository interface {
+	Ping(context.Context) error
+	AddNewDelegations(context.Context, []repository.Delegation) (repository.InsertStats, error)
+	AddNewDelegationsAndCheckpoint(context.Context, []repository.Delegation, repository.Checkpoint) (repository.InsertStats, error)
+	GetCheckpoint(context.Context) (repository.Checkpoint, error)
+	GetDelegations(context.Context, repository.DelegationFilter, repository.Page) ([]repository.Delegation, error)
+	GetLatestBlockTimestamp(context.Context) (time.Time, error)
+	GetLatestBlocks(context.Context, int) ([]repository.Block, error)
+	DeleteDelegationsFromLevel(context.Context, int32) (int64, error)
+	GetCurrentDelegation(context.Context, string) (repository.CurrentDelegation, error)
+	GetBackfillRanges(context.Context, int32, int32) ([]repository.BackfillRange, error)
+	SaveBackfillRange(context.Context, repository.BackfillRange) error
+	GetBakerStats(context.Context, string, time.Time, time.Time, int) (repository.BakerStats, error)
+	GetDelegationHistogram(context.Context, repository.Interval, time.Time, time.Time) ([]repository.Bucket, error)
+}
+
+// Run runs the conformance test suite against the repositories returned by the given
+// function, which must be empty. Times are compared in UTC.
+func Run(t *testing.T, newRepository func(t *testing.T) Repository) {
+	ctx := context.Background()
+
+	// run runs a subtest with an empty repository holding the given delegations.
+	run := func(name string, dlgs []repository.Delegation, fn func(t *testing.T, repo Repository)) {
+		t.Run(name, func(t *testing.T) {
+			repo := newRepository(t)
+			if len(dlgs) > 0 {
+				_, err := repo.AddNewDelegations(ctx, dlgs)
+				require.NoError(t, err)
+			}
+			fn(t, repo)
+		})
+	}
+
+	run("pings", nil, func(t *testing.T, repo Repository) {
+		assert.NoError(t, repo.Ping(ctx))
+	})
+
+	run("skips duplicate delegations", nil, func(t *testing.T, repo Repository) {
+		stats, err := repo.AddNewDelegations(ctx, []repository.Delegation{delegation(1), delegation(2), delegation(2)})
+		require.NoError(t, err)
+		assert.Equal(t, repository.InsertStats{Inserted: 2, Skipped: 1}, stats)
+
+		stats, err = repo.AddNewDelegations(ctx, []repository.Delegation{delegation(2), delegation(3)})
+		require.NoError(t, err)
+		assert.Equal(t, repository.InsertStats{Inserted: 1, Skipped: 1}, stats)
+
+		stats, err = repo.AddNewDelegations(ctx, nil)
+		require.NoError(t, err)
+		assert.Zero(t, stats)
+
+		assertDelegations(t, repo, repository.DelegationFilter{}, 3, 2, 1)
+	})
+
+	run("skips delegations already stored under another operation ID", nil, func(t *testing.T, repo Repository) {
+		other := delegation(1)
+		other.OperationID = 1001
+		unhashed := delegation(2)
+		unhashed.OperationHash = ""
+		otherUnhashed := unhashed
+		otherUnhashed.OperationID = 1002
+
+		stats, err := repo.AddNewDelegations(ctx, []repository.Delegation{delegation(1), unhashed})
+		require.NoError(t, err)
+		assert.Equal(t, repository.InsertStats{Inserted: 2}, stats)
+
+		stats, err = repo.AddNewDelegations(ctx, []repository.Delegation{other, otherUnhashed})
+		require.NoError(t, err)
+		assert.Equal(t, repository.InsertStats{Inserted: 1, Skipped: 1}, stats)
+
+		assertDelegations(t, repo, repository.DelegationFilter{}, 1002, 2, 1)
+	})
+
+	run("stores delegations of several senders within the same operation", nil, func(t *testing.T, repo Repository) {
+		other := delegation(2)
+		other.Level = delegation(1).Level
+		other.OperationHash = delegation(1).OperationHash
+		other.Sender = "tz1other"
+
+		stats, err := repo.AddNewDelegations(ctx, []repository.Delegation{delegation(1), other})
+
+		require.NoError(t, err)
+		assert.Equal(t, repository.InsertStats{Inserted: 2}, stats)
+		assertDelegations(t, repo, repository.DelegationFilter{}, 2, 1)
+	})
+
+	run("skips duplicates inserted concurrently", nil, func(t *testing.T, repo Repository) {
+		dlgs := make([]repository.Delegation, 50)
+		for i := range dlgs {
+			dlgs[i] = delegation(int64(i + 1))
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var total repository.InsertStats
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stats, err := repo.AddNewDelegations(ctx, dlgs)
+				assert.NoError(t, err)
+				mu.Lock()
+				defer mu.Unlock()
+				total.Inserted += stats.Inserted
+				total.Skipped += stats.Skipped
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, repository.InsertStats{Inserted: 50, Skipped: 200}, total)
+		got, err := repo.GetDelegations(ctx, repository.DelegationFilter{}, repository.Page{})
+		require.NoError(t, err)
+		assert.Len(t, got, 50)
+	})
+
+	sameTime := []repository.Delegation{
+		at(delegation(4), baseTime), at(delegation(1), baseTime.Add(time.Hour)),
+		at(delegation(3), baseTime), at(delegation(2), baseTime.Add(-time.Hour)),
+	}
+	run("sorts delegations by block timestamp then operation ID", sameTime, func(t *testing.T, repo Repository) {
+		got, err := repo.GetDelegations(ctx, repository.DelegationFilter{}, repository.Page{})
+
+		require.NoError(t, err)
+		assert.Equal(t, utc([]repository.Delegation{sameTime[1], sameTime[0], sameTime[2], sameTime[3]}), utc(got))
+	})
+
+	run("pages delegations after cursor", sameTime, func(t *testing.T, repo Repository) {
+		first, err := repo.GetDelegations(ctx, repository.DelegationFilter{}, repository.Page{Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, first, 2)
+		last := first[1]
+
+		next, err := repo.GetDelegations(ctx, repository.DelegationFilter{}, repository.Page{
+			Limit: 2,
+			After: &repository.Cursor{BlockTimestamp: last.BlockTimestamp, OperationID: last.OperationID},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1, 4}, operationIDs(first))
+		assert.Equal(t, []int64{3, 2}, operationIDs(next))
+	})
+
+	run("returns no delegation as empty slice", nil, func(t *testing.T, repo Repository) {
+		got, err := repo.GetDelegations(ctx, repository.DelegationFilter{}, repository.Page{})
+
+		require.NoError(t, err)
+		assert.NotNil(t, got)
+		assert.Empty(t, got)
+	})
+
+	newYear := []repository.Delegation{
+		at(delegation(1), time.Date(2023, 12, 31, 23, 30, 0, 0, time.UTC)),
+		at(delegation(2), time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)),
+		// in 2023 in its own location, but in 2024 in UTC
+		at(delegation(3), time.Date(2023, 12, 31, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*3600))),
+	}
+	run("filters delegations by UTC year", newYear, func(t *testing.T, repo Repository) {
+		assertDelegations(t, repo, repository.DelegationFilter{Year: 2023}, 1)
+		assertDelegations(t, repo, repository.DelegationFilter{Year: 2024}, 3, 2)
+		assertDelegations(t, repo, repository.DelegationFilter{Year: 2022})
+	})
+
+	criteria := []repository.Delegation{
+		{OperationID: 1, Level: 100, Amount: 10, Sender: "tz1a", NewDelegate: "tz1baker", BlockTimestamp: baseTime},
+		{OperationID: 2, Level: 101, Amount: 20, Sender: "tz1b", NewDelegate: "tz1baker", BlockTimestamp: baseTime.Add(time.Hour)},
+		{OperationID: 3, Level: 102, Amount: 30, Sender: "tz1a", NewDelegate: "tz1other", BlockTimestamp: baseTime.Add(2 * time.Hour)},
+		{OperationID: 4, Level: 103, Amount: 40, Sender: "tz1a", PrevDelegate: "tz1other", BlockTimestamp: baseTime.Add(3 * time.Hour)},
+	}
+	for i := range criteria {
+		criteria[i].BlockHash, criteria[i].OperationHash, criteria[i].Status = "B", "o", "applied"
+	}
+	run("filters delegations by every criterion", criteria, func(t *testing.T, repo Repository) {
+		level, maxLevel := int32(101), int32(102)
+		amount, maxAmount := int64(20), int64(30)
+
+		assertDelegations(t, repo, repository.DelegationFilter{Delegator: "tz1a"}, 4, 3, 1)
+		assertDelegations(t, repo, repository.DelegationFilter{Baker: "tz1baker"}, 2, 1)
+		assertDelegations(t, repo, repository.DelegationFilter{MinLevel: &level}, 4, 3, 2)
+		assertDelegations(t, repo, repository.DelegationFilter{MaxLevel: &level}, 2, 1)
+		assertDelegations(t, repo, repository.DelegationFilter{MinLevel: &level, MaxLevel: &maxLevel}, 3, 2)
+		assertDelegations(t, repo, repository.DelegationFilter{From: baseTime.Add(time.Hour), To: baseTime.Add(3 * time.Hour)}, 3, 2)
+		assertDelegations(t, repo, repository.DelegationFilter{MinAmount: &amount, MaxAmount: &maxAmount}, 3, 2)
+		assertDelegations(t, repo, repository.DelegationFilter{Delegator: "tz1a", Baker: "tz1other"}, 3)
+	})
+
+	run("keeps latest applied delegation as current one whatever insertion order", nil, func(t *testing.T, repo Repository) {
+		newer := withDelegates(delegation(2), "tz1old", "tz1new")
+		older := withDelegates(delegation(1), "", "tz1old")
+		failed := withStatus(withDelegates(delegation(3), "tz1new", "tz1failed"), "failed")
+
+		_, err := repo.AddNewDelegations(ctx, []repository.Delegation{newer, failed})
+		require.NoError(t, err)
+		_, err = repo.AddNewDelegations(ctx, []repository.Delegation{older})
+		require.NoError(t, err)
+
+		cur, err := repo.GetCurrentDelegation(ctx, "tz1sender")
+		require.NoError(t, err)
+		assert.Equal(t, repository.CurrentDelegation{
+			Delegator: "tz1sender", Delegate: "tz1new", OperationID: 2, Amount: newer.Amount,
+			Level: newer.Level, Since: newer.BlockTimestamp,
+		}, utcCurrent(cur))
+	})
+
+	run("keeps delegation of highest level as current one whatever operation IDs", nil, func(t *testing.T, repo Repository) {
+		newer := withDelegates(delegation(4), "tz1old", "tz1new")
+		older := withDelegates(delegation(1), "", "tz1old")
+		older.OperationID = 50
+
+		_, err := repo.AddNewDelegations(ctx, []repository.Delegation{newer, older})
+		require.NoError(t, err)
+
+		cur, err := repo.GetCurrentDelegation(ctx, "tz1sender")
+		require.NoError(t, err)
+		assert.Equal(t, "tz1new", cur.Delegate)
+		assert.EqualValues(t, 4, cur.OperationID)
+	})
+
+	run("reports undelegation as current delegation without delegate", []repository.Delegation{
+		withDelegates(delegation(1), "", "tz1baker"), withDelegates(delegation(2), "tz1baker", ""),
+	}, func(t *testing.T, repo Repository) {
+		cur, err := repo.GetCurrentDelegation(ctx, "tz1sender")
+
+		require.NoError(t, err)
+		assert.Empty(t, cur.Delegate)
+		assert.EqualValues(t, 2, cur.OperationID)
+	})
+
+	run("does not find current delegation without applied delegation", []repository.Delegation{
+		withStatus(delegation(1), "failed"),
+	}, func(t *testing.T, repo Repository) {
+		_, err := repo.GetCurrentDelegation(ctx, "tz1sender")
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+
+		_, err = repo.GetCurrentDelegation(ctx, "tz1unknown")
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+	})
+
+	run("moves checkpoint forward only", nil, func(t *testing.T, repo Repository) {
+		_, err := repo.GetCheckpoint(ctx)
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+
+		stats, err := repo.AddNewDelegationsAndCheckpoint(ctx, []repository.Delegation{delegation(10), delegation(10)},
+			repository.Checkpoint{OperationID: 10, Level: 110})
+		require.NoError(t, err)
+		assert.Equal(t, repository.InsertStats{Inserted: 1, Skipped: 1}, stats)
+
+		_, err = repo.AddNewDelegationsAndCheckpoint(ctx, nil, repository.Checkpoint{OperationID: 5, Level: 105})
+		require.NoError(t, err)
+		cp, err := repo.GetCheckpoint(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, repository.Checkpoint{OperationID: 10, Level: 110}, cp)
+
+		_, err = repo.AddNewDelegationsAndCheckpoint(ctx, nil, repository.Checkpoint{OperationID: 12, Level: 112})
+		require.NoError(t, err)
+		cp, err = repo.GetCheckpoint(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, repository.Checkpoint{OperationID: 12, Level: 112}, cp)
+
+		// levels are compared first, operation IDs differing between TzKT instances
+		_, err = repo.AddNewDelegationsAndCheckpoint(ctx, nil, repository.Checkpoint{OperationID: 7, Level: 113})
+		require.NoError(t, err)
+		cp, err = repo.GetCheckpoint(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, repository.Checkpoint{OperationID: 7, Level: 113}, cp)
+		assertDelegations(t, repo, repository.DelegationFilter{}, 10)
+	})
+
+	run("does not find latest block timestamp without delegation", nil, func(t *testing.T, repo Repository) {
+		_, err := repo.GetLatestBlockTimestamp(ctx)
+
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+	})
+
+	run("gets latest block timestamp", sameTime, func(t *testing.T, repo Repository) {
+		ts, err := repo.GetLatestBlockTimestamp(ctx)
+
+		require.NoError(t, err)
+		assert.Equal(t, baseTime.Add(time.Hour), ts.UTC())
+	})
+
+	run("gets distinct latest blocks", []repository.Delegation{delegation(1), delegation(2), delegation(3), delegation(4)},
+		func(t *testing.T, repo Repository) {
+			// delegations 2 and 3 share a block
+			blks, err := repo.GetLatestBlocks(ctx, 2)
+
+			require.NoError(t, err)
+			require.Len(t, blks, 2)
+			assert.Equal(t, repository.Block{Level: 102, Hash: "B102", Timestamp: delegation(4).BlockTimestamp}, utcBlock(blks[0]))
+			assert.Equal(t, repository.Block{Level: 101, Hash: "B101", Timestamp: delegation(2).BlockTimestamp}, utcBlock(blks[1]))
+
+			blks, err = repo.GetLatestBlocks(ctx, 10)
+			require.NoError(t, err)
+			assert.Len(t, blks, 3)
+		})
+
+	run("deletes delegations from level and rolls back states", nil, func(t *testing.T, repo Repository) {
+		dlgs := []repository.Delegation{
+			withDelegates(delegation(1), "", "tz1a"), withDelegates(delegation(2), "tz1a", "tz1b"),
+			withDelegates(delegation(4), "tz1b", "tz1c"),
+		}
+		_, err := repo.AddNewDelegationsAndCheckpoint(ctx, dlgs, repository.Checkpoint{OperationID: 4, Level: 102})
+		require.NoError(t, err)
+
+		deleted, err := repo.DeleteDelegationsFromLevel(ctx, 101)
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, deleted)
+		assertDelegations(t, repo, repository.DelegationFilter{}, 1)
+		cur, err := repo.GetCurrentDelegation(ctx, "tz1sender")
+		require.NoError(t, err)
+		assert.Equal(t, "tz1a", cur.Delegate)
+		cp, err := repo.GetCheckpoint(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, repository.Checkpoint{OperationID: 1, Level: 100}, cp)
+
+		deleted, err = repo.DeleteDelegationsFromLevel(ctx, 100)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, deleted)
+		_, err = repo.GetCurrentDelegation(ctx, "tz1sender")
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+		_, err = repo.GetCheckpoint(ctx)
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+	})
+
+	run("keeps checkpoint below deleted level", []repository.Delegation{delegation(1), delegation(4)}, func(t *testing.T, repo Repository) {
+		_, err := repo.AddNewDelegationsAndCheckpoint(ctx, nil, repository.Checkpoint{OperationID: 1, Level: 100})
+		require.NoError(t, err)
+
+		_, err = repo.DeleteDelegationsFromLevel(ctx, 102)
+		require.NoError(t, err)
+
+		cp, err := repo.GetCheckpoint(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, repository.Checkpoint{OperationID: 1, Level: 100}, cp)
+	})
+
+	run("saves and gets backfill ranges", nil, func(t *testing.T, repo Repository) {
+		for _, rng := range []repository.BackfillRange{
+			{FromLevel: 100, ToLevel: 200, NextLevel: 200},
+			{FromLevel: 0, ToLevel: 100, NextLevel: 50},
+			{FromLevel: 200, ToLevel: 300, NextLevel: 200},
+			{FromLevel: 0, ToLevel: 100, NextLevel: 100},
+		} {
+			require.NoError(t, repo.SaveBackfillRange(ctx, rng))
+		}
+
+		rngs, err := repo.GetBackfillRanges(ctx, 0, 200)
+
+		require.NoError(t, err)
+		assert.Equal(t, []repository.BackfillRange{
+			{FromLevel: 0, ToLevel: 100, NextLevel: 100},
+			{FromLevel: 100, ToLevel: 200, NextLevel: 200},
+		}, rngs)
+
+		rngs, err = repo.GetBackfillRanges(ctx, 300, 400)
+		require.NoError(t, err)
+		assert.NotNil(t, rngs)
+		assert.Empty(t, rngs)
+	})
+
+	bakers := []repository.Delegation{
+		// tz1a and tz1b delegate to the baker, tz1c left it for another one
+		sent(withDelegates(delegation(1), "", "tz1baker"), "tz1a", 100),
+		sent(withDelegates(delegation(2), "", "tz1baker"), "tz1b", 300),
+		sent(withDelegates(delegation(3), "", "tz1baker"), "tz1c", 50),
+		sent(withDelegates(delegation(4), "tz1baker", "tz1other"), "tz1c", 60),
+		// redelegation to the same baker, failed delegation and delegation before the period
+		sent(withDelegates(delegation(5), "tz1baker", "tz1baker"), "tz1a", 100),
+		withStatus(sent(withDelegates(delegation(6), "", "tz1baker"), "tz1d", 1000), "failed"),
+		at(sent(withDelegates(delegation(7), "", "tz1baker"), "tz1e", 5), baseTime.Add(-48*time.Hour)),
+	}
+	run("computes baker stats", bakers, func(t *testing.T, repo Repository) {
+		stats, err := repo.GetBakerStats(ctx, "tz1baker", baseTime.Add(-time.Hour), baseTime.Add(24*time.Hour), 2)
+
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, stats.DelegatorCount)
+		assert.EqualValues(t, 405, stats.DelegatedBalance)
+		assert.Equal(t, repository.Flow{Count: 3, Amount: 450}, stats.Inflow)
+		assert.Equal(t, repository.Flow{Count: 1, Amount: 60}, stats.Outflow)
+		require.Len(t, stats.TopDelegators, 2)
+		assert.Equal(t, "tz1b", stats.TopDelegators[0].Address)
+		assert.EqualValues(t, 300, stats.TopDelegators[0].Amount)
+		assert.Equal(t, "tz1a", stats.TopDelegators[1].Address)
+		assert.Equal(t, delegation(5).BlockTimestamp, stats.TopDelegators[1].Since.UTC())
+	})
+
+	run("computes baker stats without top delegators", bakers, func(t *testing.T, repo Repository) {
+		stats, err := repo.GetBakerStats(ctx, "tz1baker", baseTime.Add(-time.Hour), baseTime.Add(24*time.Hour), 0)
+
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, stats.DelegatorCount)
+		assert.EqualValues(t, 405, stats.DelegatedBalance)
+		assert.Equal(t, repository.Flow{Count: 3, Amount: 450}, stats.Inflow)
+		assert.Equal(t, repository.Flow{Count: 1, Amount: 60}, stats.Outflow)
+		assert.NotNil(t, stats.TopDelegators)
+		assert.Empty(t, stats.TopDelegators)
+	})
+
+	run("computes empty stats of unknown baker", bakers, func(t *testing.T, repo Repository) {
+		stats, err := repo.GetBakerStats(ctx, "tz1unknown", baseTime.Add(-time.Hour), baseTime.Add(24*time.Hour), 2)
+
+		require.NoError(t, err)
+		assert.Equal(t, repository.BakerStats{TopDelegators: []repository.Delegator{}}, stats)
+	})
+
+	monday := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	histogram := []repository.Delegation{
+		at(sent(delegation(1), "tz1a", 1), monday.Add(10*time.Hour)),
+		at(sent(delegation(2), "tz1a", 2), monday.Add(23*time.Hour)),
+		at(sent(delegation(3), "tz1a", 4), monday.AddDate(0, 0, 6)),
+		at(sent(delegation(4), "tz1a", 8), monday.AddDate(0, 0, 7)),
+		at(sent(delegation(5), "tz1a", 16), monday.AddDate(0, 0, 28)),
+		withStatus(at(sent(delegation(6), "tz1a", 32), monday.Add(time.Hour)), "failed"),
+	}
+	for _, tc := range []struct {
+		interval repository.Interval
+		exp      []repository.Bucket
+	}{
+		{repository.IntervalDay, []repository.Bucket{
+			{Start: monday, Count: 2, Amount: 3},
+			{Start: monday.AddDate(0, 0, 6), Count: 1, Amount: 4},
+			{Start: monday.AddDate(0, 0, 7), Count: 1, Amount: 8},
+		}},
+		{repository.IntervalWeek, []repository.Bucket{
+			{Start: monday, Count: 3, Amount: 7},
+			{Start: monday.AddDate(0, 0, 7), Count: 1, Amount: 8},
+		}},
+		{repository.IntervalMonth, []repository.Bucket{
+			{Start: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Count: 4, Amount: 15},
+		}},
+	} {
+		run(fmt.Sprintf("computes histogram by %s", tc.interval), histogram, func(t *testing.T, repo Repository) {
+			// the last delegation lies on the exclusive end of the period
+			bkts, err := repo.GetDelegationHistogram(ctx, tc.interval, monday, monday.AddDate(0, 0, 28))
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.exp, bkts)
+		})
+	}
+
+	run("returns error on unsupported histogram interval", nil, func(t *testing.T, repo Repository) {
+		_, err := repo.GetDelegationHistogram(ctx, repository.Interval("year"), monday, monday.AddDate(0, 0, 28))
+
+		assert.Error(t, err)
+	})
+
+	run("computes empty histogram", nil, func(t *testing.T, repo Repository) {
+		bkts, err := repo.GetDelegationHistogram(ctx, repository.IntervalDay, monday, monday.AddDate(0, 0, 28))
+
+		require.NoError(t, err)
+		assert.NotNil(t, bkts)
+		assert.Empty(t, bkts)
+	})
+}
+
+// baseTime is the block timestamp of the delegation of operation ID 1.
+var baseTime = time.Date(2024, 6, 26, 19, 14, 33, 0, time.UTC)
+
+// delegation returns an applied delegation of the "tz1sender" account without delegates,
+// included every hour from baseTime by operation ID. Operations 2 and 3 share a block.
+func delegation(id int64) repository.Delegation {
+	level := int32(99 + id)
+	if id >= 3 {
+		level--
+	}
+	return repository.Delegation{
+		BlockTimestamp: baseTime.Add(time.Duration(level-100) * time.Hour),
+		OperationID:    id,
+		Amount:         1000 * id,
+		Level:          level,
+		Sender:         "tz1sender",
+		BlockHash:      fmt.Sprintf("B%d", level),
+		OperationHash:  fmt.Sprintf("o%d", id),
+		Status:         "applied",
+		Fee:            id,
+	}
+}
+
+func at(dlg repository.Delegation, ts time.Time) repository.Delegation {
+	dlg.BlockTimestamp = ts
+	return dlg
+}
+
+func sent(dlg repository.Delegation, sender string, amount int64) repository.Delegation {
+	dlg.Sender, dlg.Amount = sender, amount
+	return dlg
+}
+
+func withDelegates(dlg repository.Delegation, prev, next string) repository.Delegation {
+	dlg.PrevDelegate, dlg.NewDelegate = prev, next
+	return dlg
+}
+
+func withStatus(dlg repository.Delegation, status string) repository.Delegation {
+	dlg.Status = status
+	return dlg
+}
+
+// assertDelegations asserts the delegations matching the given filter have the given
+// operation IDs, in order.
+func assertDelegations(t *testing.T, repo Repository, filter repository.DelegationFilter, ids ...int64) {
+	t.Helper()
+	got, err := repo.GetDelegations(context.Background(), filter, repository.Page{})
+	require.NoError(t, err)
+	if ids == nil {
+		ids = []int64{}
+	}
+	assert.Equal(t, ids, operationIDs(got))
+}
+
+func operationIDs(dlgs []repository.Delegation) []int64 {
+	ids := make([]int64, len(dlgs))
+	for i := range dlgs {
+		ids[i] = dlgs[i].OperationID
+	}
+	return ids
+}
+
+// utc returns the given delegations with their timestamps in UTC, as backends may
+// return them in another location.
+func utc(dlgs []repository.Delegation) []repository.Delegation {
+	ret := make([]repository.Delegation, len(dlgs))
+	for i := range dlgs {
+		ret[i] = at(dlgs[i], dlgs[i].BlockTimestamp.UTC())
+	}
+	return ret
+}
+
+func utcCurrent(cur repository.CurrentDelegation) repository.CurrentDelegation {
+	cur.Since = cur.Since.UTC()
+	return cur
+}
+
+func utcBlock(blk repository.Block) repository.Block {
+	blk.Timestamp = blk.Timestamp.UTC()
+	return blk
+}
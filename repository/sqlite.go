@@ -0,0 +1,587 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteNow is the current time as stored by SQLite.
+const sqliteNow = "CAST(strftime('%s', 'now') AS INTEGER) * 1000000"
+
+// SQLiteRepository stores delegations in a SQLite database file, with the same
+// semantics as PostgresRepository, for lightweight single-instance deployments.
+// Timestamps are stored in microseconds since the Unix epoch. The duration of every
+// operation is recorded as a metric, and logged at debug level.
+type SQLiteRepository struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+// NewSQLiteRepository opens the SQLite database of the given file, created if needed.
+// Transactions take the write lock as soon as they begin, waiting for concurrent ones,
+// and the write-ahead log lets reads run concurrently with them.
+func NewSQLiteRepository(ctx context.Context, path string, logger *slog.Logger) (SQLiteRepository, error) {
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(10000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Set("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return SQLiteRepository{}, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return SQLiteRepository{}, err
+	}
+	return SQLiteRepository{
+		db:     db,
+		logger: logger,
+	}, nil
+}
+
+// Close closes the database.
+func (s SQLiteRepository) Close() error {
+	return s.db.Close()
+}
+
+// observeQuery starts timing the given repository operation, see observeOperation.
+func (s SQLiteRepository) observeQuery(ctx context.Context, op string) func() {
+	return observeOperation(ctx, s.logger, op)
+}
+
+// Ping checks the database is reachable.
+func (s SQLiteRepository) Ping(ctx context.Context) error {
+	defer s.observeQuery(ctx, "ping")()
+
+	return s.db.PingContext(ctx)
+}
+
+// AddNewDelegations inserts delegations and skips duplicates, having the same operation
+// ID or the same operation hash and sender at the same level, by ascending operation ID.
+// The current delegation state of the senders of applied delegations is updated in the
+// same transaction, unless a more recent delegation was already stored, so insertion
+// order does not matter. Returns how many delegations were inserted and skipped as
+// duplicates.
+func (s SQLiteRepository) AddNewDelegations(ctx context.Context, dlgs []Delegation) (InsertStats, error) {
+	defer s.observeQuery(ctx, "add_new_delegations")()
+
+	if len(dlgs) == 0 {
+		return InsertStats{}, nil
+	}
+
+	var stats InsertStats
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		stats, err = sqliteAddNewDelegations(ctx, tx, dlgs)
+		return err
+	})
+	return stats, err
+}
+
+// AddNewDelegationsAndCheckpoint inserts delegations as AddNewDelegations does, and
+// moves the scraper checkpoint forward to the given one in the same transaction.
+// The checkpoint is left unchanged if it is already further.
+func (s SQLiteRepository) AddNewDelegationsAndCheckpoint(ctx context.Context, dlgs []Delegation, cp Checkpoint) (InsertStats, error) {
+	defer s.observeQuery(ctx, "add_new_delegations_and_checkpoint")()
+
+	const query = `
+		INSERT INTO scraper_state (id, last_operation_id, last_level)
+		VALUES (1, ?1, ?2)
+		ON CONFLICT (id) DO UPDATE SET
+			last_operation_id = excluded.last_operation_id,
+			last_level = excluded.last_level,
+			updated_at = ` + sqliteNow + `
+		WHERE (scraper_state.last_level, scraper_state.last_operation_id) < (excluded.last_level, excluded.last_operation_id)
+	`
+	var stats InsertStats
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if len(dlgs) > 0 {
+			var err error
+			if stats, err = sqliteAddNewDelegations(ctx, tx, dlgs); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, query, cp.OperationID, cp.Level)
+		return err
+	})
+	return stats, err
+}
+
+// GetCheckpoint returns the scraper checkpoint. Returns ErrNotFound if there is none.
+func (s SQLiteRepository) GetCheckpoint(ctx context.Context) (Checkpoint, error) {
+	defer s.observeQuery(ctx, "get_checkpoint")()
+
+	const query = "SELECT last_operation_id, last_level FROM scraper_state"
+	var cp Checkpoint
+	err := s.db.QueryRowContext(ctx, query).Scan(&cp.OperationID, &cp.Level)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Checkpoint{}, ErrNotFound
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	return cp, nil
+}
+
+// sqliteAddNewDelegations inserts delegations within the given transaction.
+func sqliteAddNewDelegations(ctx context.Context, tx *sql.Tx, dlgs []Delegation) (InsertStats, error) {
+	const insertQuery = `
+		INSERT INTO delegation (
+			block_timestamp, operation_id, amount, level, sender, block_hash,
+			operation_hash, status, fee, prev_delegate, new_delegate
+		)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11)
+		ON CONFLICT DO NOTHING
+	`
+	const currentQuery = `
+		INSERT INTO current_delegation (delegator, delegate, operation_id, amount, level, block_timestamp)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+		ON CONFLICT (delegator) DO UPDATE SET
+			delegate = excluded.delegate,
+			operation_id = excluded.operation_id,
+			amount = excluded.amount,
+			level = excluded.level,
+			block_timestamp = excluded.block_timestamp
+		WHERE (current_delegation.level, current_delegation.operation_id) < (excluded.level, excluded.operation_id)
+	`
+	insertStmt, err := tx.PrepareContext(ctx, insertQuery)
+	if err != nil {
+		return InsertStats{}, err
+	}
+	defer insertStmt.Close()
+	currentStmt, err := tx.PrepareContext(ctx, currentQuery)
+	if err != nil {
+		return InsertStats{}, err
+	}
+	defer currentStmt.Close()
+
+	// inserted by operation ID, as in PostgreSQL, so that the first duplicate wins
+	sorted := slices.Clone(dlgs)
+	slices.SortStableFunc(sorted, func(a, b Delegation) int { return cmp.Compare(a.OperationID, b.OperationID) })
+
+	stats := InsertStats{}
+	for _, dlg := range sorted {
+		res, err := insertStmt.ExecContext(ctx,
+			dlg.BlockTimestamp.UnixMicro(), dlg.OperationID, dlg.Amount, dlg.Level, dlg.Sender, dlg.BlockHash,
+			dlg.OperationHash, dlg.Status, dlg.Fee, nullString(dlg.PrevDelegate), nullString(dlg.NewDelegate),
+		)
+		if err != nil {
+			return InsertStats{}, err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return InsertStats{}, err
+		}
+		stats.Inserted += inserted
+		stats.Skipped += 1 - inserted
+	}
+
+	for _, dlg := range sorted {
+		if dlg.Status != "applied" {
+			continue
+		}
+		if _, err := currentStmt.ExecContext(ctx,
+			dlg.Sender, nullString(dlg.NewDelegate), dlg.OperationID, dlg.Amount, dlg.Level, dlg.BlockTimestamp.UnixMicro(),
+		); err != nil {
+			return InsertStats{}, err
+		}
+	}
+	return stats, nil
+}
+
+// GetDelegations get a page of delegations matching the given filter, sorted by
+// block timestamp most recent first, then by operation ID. The page cursor is
+// applied with a keyset condition.
+func (s SQLiteRepository) GetDelegations(ctx context.Context, filter DelegationFilter, page Page) ([]Delegation, error) {
+	defer s.observeQuery(ctx, "get_delegations")()
+
+	b := queryBuilder{sqlite: true}
+	filter.apply(&b)
+	if page.After != nil {
+		b.addRow("(block_timestamp, operation_id) < (%s)", page.After.BlockTimestamp, page.After.OperationID)
+	}
+	limit := "-1"
+	if page.Limit > 0 {
+		limit = strconv.Itoa(page.Limit)
+	}
+
+	query := `
+		SELECT block_timestamp, operation_id, amount, level, sender, block_hash,
+			operation_hash, status, fee, COALESCE(prev_delegate, ''), COALESCE(new_delegate, '')
+		FROM delegation
+		WHERE ` + b.where() + `
+		ORDER BY block_timestamp DESC, operation_id DESC
+		LIMIT ` + limit
+
+	rows, err := s.db.QueryContext(ctx, query, b.args...)
+	if err != nil {
+		return []Delegation{}, err
+	}
+	defer rows.Close()
+
+	ret := make([]Delegation, 0)
+	for rows.Next() {
+		var dlg Delegation
+		var ts int64
+		if err := rows.Scan(
+			&ts, &dlg.OperationID, &dlg.Amount, &dlg.Level, &dlg.Sender, &dlg.BlockHash,
+			&dlg.OperationHash, &dlg.Status, &dlg.Fee, &dlg.PrevDelegate, &dlg.NewDelegate,
+		); err != nil {
+			return []Delegation{}, err
+		}
+		dlg.BlockTimestamp = sqliteTime(ts)
+		ret = append(ret, dlg)
+	}
+
+	return ret, rows.Err()
+}
+
+// GetLatestBlockTimestamp gets the most recent delegation's block timestamp.
+// Returns ErrNotFound if there is no delegation.
+func (s SQLiteRepository) GetLatestBlockTimestamp(ctx context.Context) (time.Time, error) {
+	defer s.observeQuery(ctx, "get_latest_block_timestamp")()
+
+	const query = "SELECT block_timestamp FROM delegation ORDER BY block_timestamp DESC LIMIT 1"
+	var ts int64
+	err := s.db.QueryRowContext(ctx, query).Scan(&ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sqliteTime(ts), nil
+}
+
+// GetLatestBlocks gets the references of the given number of most recent blocks
+// in which stored delegations were included, most recent first.
+func (s SQLiteRepository) GetLatestBlocks(ctx context.Context, count int) ([]Block, error) {
+	defer s.observeQuery(ctx, "get_latest_blocks")()
+
+	// SQLite takes a negative limit as no limit
+	if count < 0 {
+		return []Block{}, fmt.Errorf("negative block count %d", count)
+	}
+	const query = `
+		SELECT DISTINCT level, block_hash, block_timestamp
+		FROM delegation
+		ORDER BY level DESC
+		LIMIT ?1
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, count)
+	if err != nil {
+		return []Block{}, err
+	}
+	defer rows.Close()
+
+	ret := make([]Block, 0, count)
+	for rows.Next() {
+		var blk Block
+		var ts int64
+		if err := rows.Scan(&blk.Level, &blk.Hash, &ts); err != nil {
+			return []Block{}, err
+		}
+		blk.Timestamp = sqliteTime(ts)
+		ret = append(ret, blk)
+	}
+
+	return ret, rows.Err()
+}
+
+// DeleteDelegationsFromLevel deletes delegations included in blocks at the given
+// level or above, typically orphaned by a chain reorganisation. The current delegation
+// state of their senders is recomputed from the remaining delegations in the same
+// transaction, and the scraper checkpoint is moved back to the most recent remaining
+// delegation, or removed if none remains. Returns the number of deleted delegations.
+func (s SQLiteRepository) DeleteDelegationsFromLevel(ctx context.Context, level int32) (int64, error) {
+	defer s.observeQuery(ctx, "delete_delegations_from_level")()
+
+	const query = "DELETE FROM delegation WHERE level >= ?1"
+	const orphanedQuery = "DELETE FROM current_delegation WHERE level >= ?1 RETURNING delegator"
+	const currentQuery = `
+		INSERT INTO current_delegation (delegator, delegate, operation_id, amount, level, block_timestamp)
+		SELECT sender, new_delegate, operation_id, amount, level, block_timestamp
+		FROM delegation
+		WHERE status = 'applied' AND sender = ?1
+		ORDER BY level DESC, operation_id DESC
+		LIMIT 1
+	`
+	const checkpointQuery = `
+		UPDATE scraper_state
+		SET (last_operation_id, last_level) = (
+				SELECT operation_id, level FROM delegation ORDER BY level DESC, operation_id DESC LIMIT 1
+			),
+			updated_at = ` + sqliteNow + `
+		WHERE last_level >= ?1 AND EXISTS (SELECT 1 FROM delegation)
+	`
+	const noCheckpointQuery = "DELETE FROM scraper_state WHERE last_level >= ?1"
+
+	var deleted int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, query, level)
+		if err != nil {
+			return err
+		}
+		if deleted, err = res.RowsAffected(); err != nil {
+			return err
+		}
+
+		delegators, err := sqliteStrings(tx.QueryContext(ctx, orphanedQuery, level))
+		if err != nil {
+			return err
+		}
+		for _, delegator := range delegators {
+			if _, err := tx.ExecContext(ctx, currentQuery, delegator); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, checkpointQuery, level); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, noCheckpointQuery, level)
+		return err
+	})
+	return deleted, err
+}
+
+// GetCurrentDelegation returns the current delegation state of the given account.
+// Returns ErrNotFound if the account has no applied delegation.
+func (s SQLiteRepository) GetCurrentDelegation(ctx context.Context, delegator string) (CurrentDelegation, error) {
+	defer s.observeQuery(ctx, "get_current_delegation")()
+
+	const query = `
+		SELECT delegator, COALESCE(delegate, ''), operation_id, amount, level, block_timestamp
+		FROM current_delegation
+		WHERE delegator = ?1
+	`
+	var cur CurrentDelegation
+	var ts int64
+	err := s.db.QueryRowContext(ctx, query, delegator).Scan(
+		&cur.Delegator, &cur.Delegate, &cur.OperationID, &cur.Amount, &cur.Level, &ts,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CurrentDelegation{}, ErrNotFound
+	}
+	if err != nil {
+		return CurrentDelegation{}, err
+	}
+	cur.Since = sqliteTime(ts)
+	return cur, nil
+}
+
+// GetBackfillRanges returns the progress of the backfill ranges lying within the
+// [from, to[ level range, by ascending first level.
+func (s SQLiteRepository) GetBackfillRanges(ctx context.Context, from, to int32) ([]BackfillRange, error) {
+	defer s.observeQuery(ctx, "get_backfill_ranges")()
+
+	const query = `
+		SELECT from_level, to_level, next_level
+		FROM backfill_range
+		WHERE from_level >= ?1 AND to_level <= ?2
+		ORDER BY from_level
+	`
+	rows, err := s.db.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return []BackfillRange{}, err
+	}
+	defer rows.Close()
+
+	ret := []BackfillRange{}
+	for rows.Next() {
+		var rng BackfillRange
+		if err := rows.Scan(&rng.FromLevel, &rng.ToLevel, &rng.NextLevel); err != nil {
+			return []BackfillRange{}, err
+		}
+		ret = append(ret, rng)
+	}
+	if err := rows.Err(); err != nil {
+		return []BackfillRange{}, err
+	}
+
+	return ret, nil
+}
+
+// SaveBackfillRange records the progress of a backfill range.
+func (s SQLiteRepository) SaveBackfillRange(ctx context.Context, rng BackfillRange) error {
+	defer s.observeQuery(ctx, "save_backfill_range")()
+
+	const query = `
+		INSERT INTO backfill_range (from_level, to_level, next_level)
+		VALUES (?1, ?2, ?3)
+		ON CONFLICT (from_level, to_level) DO UPDATE SET
+			next_level = excluded.next_level,
+			updated_at = ` + sqliteNow
+	_, err := s.db.ExecContext(ctx, query, rng.FromLevel, rng.ToLevel, rng.NextLevel)
+	return err
+}
+
+// GetBakerStats computes aggregate statistics of the delegations to the given baker.
+// Delegators are accounts which current delegation is to the baker; at most top of
+// them are returned, by decreasing amount. Flows are computed over delegations having
+// their block timestamp within [from, to[.
+func (s SQLiteRepository) GetBakerStats(ctx context.Context, baker string, from, to time.Time, top int) (BakerStats, error) {
+	defer s.observeQuery(ctx, "get_baker_stats")()
+
+	// SQLite takes a negative limit as no limit
+	if top < 0 {
+		return BakerStats{}, fmt.Errorf("negative top delegator count %d", top)
+	}
+	const totalQuery = `
+		SELECT COUNT(*), COALESCE(SUM(amount), 0)
+		FROM current_delegation
+		WHERE delegate = ?1
+	`
+	const topQuery = `
+		SELECT delegator, amount, block_timestamp
+		FROM current_delegation
+		WHERE delegate = ?1
+		ORDER BY amount DESC, delegator
+		LIMIT ?2
+	`
+	const flowQuery = `
+		SELECT
+			COUNT(*) FILTER (WHERE new_delegate = ?1),
+			COALESCE(SUM(amount) FILTER (WHERE new_delegate = ?1), 0),
+			COUNT(*) FILTER (WHERE prev_delegate = ?1),
+			COALESCE(SUM(amount) FILTER (WHERE prev_delegate = ?1), 0)
+		FROM delegation
+		WHERE status = 'applied'
+			AND new_delegate IS NOT prev_delegate
+			AND (new_delegate = ?1 OR prev_delegate = ?1)
+			AND block_timestamp >= ?2 AND block_timestamp < ?3
+	`
+
+	stats := BakerStats{TopDelegators: make([]Delegator, 0, top)}
+
+	if err := s.db.QueryRowContext(ctx, totalQuery, baker).Scan(
+		&stats.DelegatorCount, &stats.DelegatedBalance,
+	); err != nil {
+		return BakerStats{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, topQuery, baker, top)
+	if err != nil {
+		return BakerStats{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dlgr Delegator
+		var ts int64
+		if err := rows.Scan(&dlgr.Address, &dlgr.Amount, &ts); err != nil {
+			return BakerStats{}, err
+		}
+		dlgr.Since = sqliteTime(ts)
+		stats.TopDelegators = append(stats.TopDelegators, dlgr)
+	}
+	if err := rows.Err(); err != nil {
+		return BakerStats{}, err
+	}
+
+	if err := s.db.QueryRowContext(ctx, flowQuery, baker, from.UnixMicro(), to.UnixMicro()).Scan(
+		&stats.Inflow.Count, &stats.Inflow.Amount, &stats.Outflow.Count, &stats.Outflow.Amount,
+	); err != nil {
+		return BakerStats{}, err
+	}
+
+	return stats, nil
+}
+
+// GetDelegationHistogram counts and sums the amounts of applied delegations having their
+// block timestamp within [from, to[, by UTC time interval. Only non-empty buckets are returned,
+// oldest first. Weeks start on Mondays.
+func (s SQLiteRepository) GetDelegationHistogram(ctx context.Context, interval Interval, from, to time.Time) ([]Bucket, error) {
+	defer s.observeQuery(ctx, "get_delegation_histogram")()
+
+	// dates of the beginning of intervals, in UTC
+	const date = "date(block_timestamp / 1000000, 'unixepoch'"
+	buckets := map[Interval]string{
+		IntervalDay:   date + ")",
+		IntervalWeek:  date + ", '-6 days', 'weekday 1')",
+		IntervalMonth: date + ", 'start of month')",
+	}
+	bucket, ok := buckets[interval]
+	if !ok {
+		return []Bucket{}, fmt.Errorf("unsupported interval %q", interval)
+	}
+
+	query := `
+		SELECT ` + bucket + ` AS bucket, COUNT(*), COALESCE(SUM(amount), 0)
+		FROM delegation
+		WHERE status = 'applied' AND block_timestamp >= ?1 AND block_timestamp < ?2
+		GROUP BY bucket
+		ORDER BY bucket
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, from.UnixMicro(), to.UnixMicro())
+	if err != nil {
+		return []Bucket{}, err
+	}
+	defer rows.Close()
+
+	ret := make([]Bucket, 0)
+	for rows.Next() {
+		var bkt Bucket
+		var start string
+		if err := rows.Scan(&start, &bkt.Count, &bkt.Amount); err != nil {
+			return []Bucket{}, err
+		}
+		if bkt.Start, err = time.Parse(time.DateOnly, start); err != nil {
+			return []Bucket{}, err
+		}
+		ret = append(ret, bkt)
+	}
+
+	return ret, rows.Err()
+}
+
+// inTx calls the given function within a transaction, committed if it succeeds.
+func (s SQLiteRepository) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteTime returns the time of the given number of microseconds since the Unix
+// epoch, as stored by SQLite, in UTC.
+func sqliteTime(micros int64) time.Time {
+	return time.UnixMicro(micros).UTC()
+}
+
+// sqliteStrings collects the single string column of the given rows.
+func sqliteStrings(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, rows.Err()
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+)
+
+// sqliteMigrationFiles are the SQLite migrations, named as the PostgreSQL ones.
+//
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrationFiles embed.FS
+
+// MigrateUp applies the pending migrations in order, each one in a transaction, and
+// returns the number of migrations applied. Returns an error matching
+// ErrChecksumMismatch if an applied migration was modified since.
+func (s SQLiteRepository) MigrateUp(ctx context.Context) (int, error) {
+	count := 0
+	err := s.withMigrations(ctx, func(conn *sql.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err := sqliteMigrate(ctx, conn, m.Up,
+				"INSERT INTO schema_migrations (version, name, checksum) VALUES (?1, ?2, ?3)", m.Version, m.Name, m.Checksum)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			s.logger.InfoContext(ctx, "migration applied", "version", m.Version, "name", m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown reverts the given number of the latest applied migrations, in reverse
+// order, each one in a transaction, and returns the number of migrations reverted.
+func (s SQLiteRepository) MigrateDown(ctx context.Context, steps int) (int, error) {
+	count := 0
+	err := s.withMigrations(ctx, func(conn *sql.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s: cannot be reverted", m.Version, m.Name)
+			}
+			err := sqliteMigrate(ctx, conn, m.Down, "DELETE FROM schema_migrations WHERE version = ?1", m.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			s.logger.InfoContext(ctx, "migration reverted", "version", m.Version, "name", m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrationStatus returns every known migration, ordered by version, along with its
+// state in the database. Returns an error matching ErrChecksumMismatch if an applied
+// migration was modified since.
+func (s SQLiteRepository) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := s.withMigrations(ctx, func(_ *sql.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for _, m := range migrations {
+			a, ok := applied[m.Version]
+			statuses = append(statuses, MigrationStatus{Migration: m, Applied: ok, AppliedAt: a.appliedAt})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// withMigrations calls the given function with a dedicated connection, the known
+// migrations and the applied ones, once verified. The versions table is created first
+// if needed. Transactions taking the write lock as they begin, concurrent migrations
+// of the same file wait for each other, and the versions table rejects a migration
+// applied twice.
+func (s SQLiteRepository) withMigrations(ctx context.Context, fn func(*sql.Conn, []Migration, map[int]appliedMigration) error) error {
+	migrations, err := parseMigrations(sqliteMigrationFiles, "migrations/sqlite")
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	const create = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at INTEGER NOT NULL DEFAULT (` + sqliteNow + `)
+		)`
+	if _, err := conn.ExecContext(ctx, create); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		var appliedAt int64
+		if err := rows.Scan(&a.version, &a.checksum, &appliedAt); err != nil {
+			return err
+		}
+		a.appliedAt = sqliteTime(appliedAt)
+		applied[a.version] = a
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if err := verifyMigrations(migrations, applied); err != nil {
+		return err
+	}
+	return fn(conn, migrations, applied)
+}
+
+// sqliteMigrate runs the given migration statements, then records the migration with
+// the given query and arguments, in a transaction.
+func sqliteMigrate(ctx context.Context, conn *sql.Conn, statements, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
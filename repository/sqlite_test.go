@@ -0,0 +1,63 @@
+package repository_test
+
+import (
+	"context"
+	"kiln-tezos-delegation/repository"
+	"kiln-tezos-delegation/repository/repositorytest"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSQLiteRepository opens a SQLite database in a temporary file, closed once the
+// test ends.
+func newSQLiteRepository(t *testing.T) repository.SQLiteRepository {
+	repo, err := repository.NewSQLiteRepository(context.Background(), filepath.Join(t.TempDir(), "test.db"), slog.Default())
+	require.NoError(t, err)
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repositorytest.Repository {
+		repo := newSQLiteRepository(t)
+		_, err := repo.MigrateUp(context.Background())
+		require.NoError(t, err)
+		return repo
+	})
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	ctx := context.Background()
+	repo := newSQLiteRepository(t)
+
+	count, err := repo.MigrateUp(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, count)
+
+	count, err = repo.MigrateUp(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	statuses, err := repo.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+		assert.False(t, status.AppliedAt.IsZero())
+	}
+
+	count, err = repo.MigrateDown(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	statuses, err = repo.MigrationStatus(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.False(t, status.Applied)
+	}
+	_, err = repo.GetCheckpoint(ctx)
+	assert.ErrorContains(t, err, "no such table")
+}
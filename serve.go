@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kiln-tezos-delegation/api"
+	"kiln-tezos-delegation/config"
+	"kiln-tezos-delegation/leader"
+	"kiln-tezos-delegation/repository"
+	"kiln-tezos-delegation/tezos"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// tezosClient gets Tezos delegation operations, either from one or several TzKT
+// instances, or from a Tezos node.
+type tezosClient interface {
+	tezos.TezosClient
+	tezos.BackfillClient
+}
+
+// store stores delegations, either in a PostgreSQL or SQLite database, or in memory.
+type store interface {
+	tezos.TezosRepository
+	tezos.BackfillRepository
+	api.Repository
+	api.BakerRepository
+	api.DelegatorRepository
+	api.HealthRepository
+}
+
+// migrator is implemented by stores which schema is migrated.
+type migrator interface {
+	MigrateUp(context.Context) (int, error)
+}
+
+// locker is implemented by stores shared by instances, which hold the leader lock.
+type locker interface {
+	TryAdvisoryLock(context.Context, int64) (*repository.AdvisoryLock, bool, error)
+}
+
+var (
+	_ store          = repository.PostgresRepository{}
+	_ store          = repository.SQLiteRepository{}
+	_ store          = (*repository.MemoryRepository)(nil)
+	_ migrationStore = repository.PostgresRepository{}
+	_ migrationStore = repository.SQLiteRepository{}
+	_ locker         = repository.PostgresRepository{}
+)
+
+// ingestionLockID is the key of the PostgreSQL advisory lock held by the leader, the
+// only instance ingesting delegations.
+const ingestionLockID int64 = 0x74657a6f735f6c64
+
+// ingester stores Tezos delegation operations until context is cancelled, and reports
+// its progress.
+type ingester interface {
+	Run(context.Context, time.Time) error
+	api.IngestionMonitor
+}
+
+// runServe serves the REST API until context is cancelled. Any number of instances
+// may run concurrently.
+func runServe(ctx context.Context, args []string) error {
+	return runService(ctx, "serve", args, true, false)
+}
+
+// runScrape ingests delegations until context is cancelled, serving the operational
+// endpoints only. With leader election, only one of the instances ingests at a time.
+func runScrape(ctx context.Context, args []string) error {
+	return runService(ctx, "scrape", args, false, true)
+}
+
+// runAll serves the REST API and ingests delegations until context is cancelled.
+func runAll(ctx context.Context, args []string) error {
+	return runService(ctx, "all", args, true, true)
+}
+
+// runService runs the HTTP server, with the REST API routes or not, and the ingestion
+// or not, until context is cancelled or any of them fails.
+func runService(ctx context.Context, name string, args []string, withAPI, withIngestion bool) error {
+	conf, _, err := loadConfig(name, args, nil)
+	if err != nil {
+		return err
+	}
+
+	logger := initLogger(conf)
+	repo := initStore(ctx, conf, logger)
+	if m, ok := repo.(migrator); ok && conf.DB.Migrate {
+		// concurrent instances wait for the first one to migrate
+		if _, err := m.MigrateUp(ctx); err != nil {
+			return fmt.Errorf("database migration error: %w", err)
+		}
+	}
+
+	var ing ingester
+	if withIngestion {
+		client := initTezosClient(conf, logger)
+		ing = initIngester(conf, client, repo, logger)
+	}
+	svr := initServer(conf, repo, ing, withAPI, logger)
+
+	tasks := []func(context.Context) error{
+		func(ctx context.Context) error {
+			if err := svr.Start(ctx); err != nil {
+				return fmt.Errorf("api server error: %w", err)
+			}
+			return nil
+		},
+	}
+	if ing != nil {
+		ingest := ing.Run
+		// instances share nothing but a database to elect a leader on
+		if l, ok := repo.(locker); ok && conf.Ingestion.LeaderElection {
+			ingest = elect(l, ing, logger)
+		}
+		tasks = append(tasks, func(ctx context.Context) error {
+			if err := ingest(ctx, conf.Ingestion.Since); err != nil && ctx.Err() == nil {
+				return fmt.Errorf("%s ingestion error: %w", conf.Ingestion.Mode, err)
+			}
+			return nil
+		})
+	}
+	return runTasks(ctx, tasks...)
+}
+
+// elect returns a function running the given ingester whenever the instance holds the
+// ingestion lock, until context is cancelled. The starting time is used for the first
+// leadership only: later ones resume from the checkpoint stored by the previous leader.
+// Writes of the ingester are fenced by the lock, so that a leader which lost it cannot
+// write until it notices.
+func elect(repo locker, ing ingester, logger *slog.Logger) func(context.Context, time.Time) error {
+	// lock of the current leadership, acquired right before it starts
+	var held *repository.AdvisoryLock
+	acquire := func(ctx context.Context) (leader.Lock, bool, error) {
+		lock, ok, err := repo.TryAdvisoryLock(ctx, ingestionLockID)
+		if !ok {
+			return nil, false, err
+		}
+		held = lock
+		return lock, true, nil
+	}
+	elector := leader.NewElector(acquire, leader.DefaultInterval, logger.With("component", "leader"))
+
+	return func(ctx context.Context, since time.Time) error {
+		return elector.Run(ctx, func(ctx context.Context) error {
+			defer func() { since = time.Time{} }()
+			return ing.Run(repository.WithFence(ctx, held), since)
+		})
+	}
+}
+
+// runTasks runs the given tasks concurrently until they all return, the first one
+// returning cancelling the others. Returns the first error.
+func runTasks(ctx context.Context, tasks ...func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errChan := make(chan error, len(tasks))
+	for _, task := range tasks {
+		go func() {
+			defer cancel()
+			errChan <- task(ctx)
+		}()
+	}
+
+	var first error
+	for range tasks {
+		if err := <-errChan; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// initStore creates the store of the configured driver.
+func initStore(ctx context.Context, conf config.Config, logger *slog.Logger) store {
+	switch conf.DB.Driver {
+	case "memory":
+		logger.Warn("delegations are stored in memory, they will be lost on exit")
+		return repository.NewMemoryRepository()
+	case "sqlite":
+		repo, err := repository.NewSQLiteRepository(ctx, conf.DB.Path, logger.With("component", "repository"))
+		if err != nil {
+			fatal("cannot open database", "error", err)
+		}
+		return repo
+	default:
+		return initRepository(ctx, conf, logger)
+	}
+}
+
+// initRepository connects to the configured PostgreSQL database.
+func initRepository(ctx context.Context, conf config.Config, logger *slog.Logger) repository.PostgresRepository {
+	repo, err := repository.NewPostgresRepository(ctx, conf.DB.URL(), logger.With("component", "repository"))
+	if err != nil {
+		fatal("cannot connect to database", "error", err)
+	}
+	return repo
+}
+
+// initTezosClient creates a client of the configured Tezos node, of the configured TzKT
+// instance, or a client failing over between them if several are configured. Options
+// apply to every instance.
+func initTezosClient(conf config.Config, logger *slog.Logger, opts ...tezos.ClientOption) tezosClient {
+	opts = append(opts,
+		tezos.WithLogger(logger.With("component", "tezos_client")),
+		tezos.WithPageSize(conf.Tezos.PageSize),
+	)
+
+	if conf.Tezos.Source == "node" {
+		client, err := tezos.NewNodeClient(conf.Tezos.NodeURL, opts...)
+		if err != nil {
+			fatal("cannot create tezos node client", "error", err)
+		}
+		return client
+	}
+
+	if len(conf.Tezos.TzktBaseURLs) == 1 {
+		client, err := tezos.NewClient(conf.Tezos.TzktBaseURLs[0], opts...)
+		if err != nil {
+			fatal("cannot create tezos client", "error", err)
+		}
+		return client
+	}
+
+	mopts := []tezos.MultiClientOption{tezos.WithMaxLag(int32(conf.Tezos.MaxLag))}
+	if conf.Tezos.CrossCheck {
+		mopts = append(mopts, tezos.WithCrossCheck(nil))
+	}
+	client, err := tezos.NewMultiClient(conf.Tezos.TzktBaseURLs, opts, mopts...)
+	if err != nil {
+		fatal("cannot create tezos client", "error", err)
+	}
+	return client
+}
+
+func initIngester(conf config.Config, client tezos.TezosClient, repo tezos.TezosRepository, logger *slog.Logger) ingester {
+	logger = logger.With("component", "ingester")
+	switch conf.Ingestion.Mode {
+	case "streaming":
+		// the WebSocket API of the instance of highest priority is subscribed to
+		streamer, err := tezos.NewStreamer(conf.Tezos.TzktBaseURLs[0], client, repo, logger)
+		if err != nil {
+			fatal("cannot create tezos streamer", "error", err)
+		}
+		return streamer
+	default:
+		return tezos.NewScraper(client, repo, logger)
+	}
+}
+
+// initServer creates the HTTP server of the operational endpoints, and of the REST API
+// if requested. Readiness checks the ingestion lag only if there is an ingester.
+func initServer(conf config.Config, repo store, ing ingester, withAPI bool, logger *slog.Logger) *api.Server {
+	health := api.NewHealthController(repo, ing, int32(conf.API.ReadyMaxLag))
+
+	routes := []api.Route{
+		{Method: http.MethodGet, Pattern: "/metrics", Handler: promhttp.Handler(), Operational: true},
+		{Method: http.MethodGet, Pattern: "/healthz", Handler: api.GetHealthHandler(), Operational: true},
+		{Method: http.MethodGet, Pattern: "/readyz", Handler: api.GetReadinessHandler(health), Operational: true},
+	}
+	if withAPI {
+		ctrl := api.NewController(repo)
+		routes = append(routes,
+			api.Route{Method: http.MethodGet, Pattern: "/xtz/delegations", Handler: api.GetDelegationHandler(ctrl), Unversioned: true},
+			api.Route{Method: http.MethodGet, Pattern: "/xtz/delegations/histogram", Handler: api.GetDelegationHistogramHandler(ctrl)},
+			api.Route{Method: http.MethodGet, Pattern: "/xtz/bakers/{address}/stats", Handler: api.GetBakerStatsHandler(api.NewBakerController(repo))},
+			api.Route{Method: http.MethodGet, Pattern: "/xtz/delegators/{address}", Handler: api.GetDelegatorHandler(api.NewDelegatorController(repo))},
+		)
+	}
+
+	return api.NewServer(conf.API.Addr, logger.With("component", "api"), routes)
+}
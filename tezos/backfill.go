@@ -0,0 +1,227 @@
+package tezos
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/repository"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBackfillWorkers is the number of ranges backfilled concurrently when not specified.
+	DefaultBackfillWorkers = 4
+	// DefaultBackfillRangeSize is the number of levels of backfill ranges when not specified.
+	DefaultBackfillRangeSize = 10000
+	// backfillReportInterval is the delay between two progress reports.
+	backfillReportInterval = 10 * time.Second
+)
+
+type BackfillClient interface {
+	StreamDelegationsInLevels(context.Context, int32, int32, DelegationPageFunc) error
+}
+
+type BackfillRepository interface {
+	AddNewDelegations(context.Context, []repository.Delegation) (repository.InsertStats, error)
+	GetBackfillRanges(context.Context, int32, int32) ([]repository.BackfillRange, error)
+	SaveBackfillRange(context.Context, repository.BackfillRange) error
+}
+
+// BackfillReport sums up a backfill run.
+type BackfillReport struct {
+	// Number of ranges backfilled during the run
+	Ranges int64
+	// Number of ranges already backfilled by a previous run
+	Skipped  int64
+	Fetched  int64
+	Inserted int64
+	Elapsed  time.Duration
+}
+
+// Throughput returns the number of delegations fetched per second.
+func (r BackfillReport) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Fetched) / r.Elapsed.Seconds()
+}
+
+// Backfiller stores the delegations of a historical level range. The range is split
+// into smaller ranges backfilled by concurrent workers, which progress is saved after
+// every stored page so that a run resumes where a previous one stopped.
+type Backfiller struct {
+	client    BackfillClient
+	repo      BackfillRepository
+	workers   int
+	rangeSize int32
+	logger    *slog.Logger
+}
+
+// NewBackfiller creates a new backfiller running the given number of workers over
+// ranges of the given number of levels. Non-positive values are replaced by defaults.
+func NewBackfiller(client BackfillClient, repo BackfillRepository, workers int, rangeSize int32, logger *slog.Logger) *Backfiller {
+	if workers <= 0 {
+		workers = DefaultBackfillWorkers
+	}
+	if rangeSize <= 0 {
+		rangeSize = DefaultBackfillRangeSize
+	}
+	return &Backfiller{
+		client:    client,
+		repo:      repo,
+		workers:   workers,
+		rangeSize: rangeSize,
+		logger:    logger,
+	}
+}
+
+// Run backfills delegations included in blocks within the [from, to[ level range,
+// until done, context is cancelled, or any worker fails. Progress is logged regularly.
+// Returns a report of the run, along with the first error which stopped it if any.
+func (b *Backfiller) Run(ctx context.Context, from, to int32) (BackfillReport, error) {
+	if from >= to {
+		return BackfillReport{}, errors.New("empty level range")
+	}
+
+	pending, skipped, err := b.plan(ctx, from, to)
+	if err != nil {
+		return BackfillReport{}, err
+	}
+	b.logger.InfoContext(ctx, "backfilling levels", "from", from, "to", to, "pending", len(pending), "skipped", skipped)
+
+	start := time.Now()
+	report := BackfillReport{Skipped: skipped}
+	var ranges, fetched, inserted atomic.Int64
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan repository.BackfillRange)
+	errChan := make(chan error, b.workers)
+	var wg sync.WaitGroup
+	wg.Add(b.workers)
+
+	for i := 0; i < b.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for rng := range queue {
+				err := b.backfillRange(wctx, rng, func(stats repository.InsertStats) {
+					fetched.Add(stats.Inserted + stats.Skipped)
+					inserted.Add(stats.Inserted)
+				})
+				if err != nil {
+					errChan <- err
+					cancel()
+					return
+				}
+				ranges.Add(1)
+			}
+		}()
+	}
+
+	// report throughput until workers are done
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(backfillReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				elapsed := time.Since(start)
+				b.logger.InfoContext(ctx, "backfill progress", "ranges", ranges.Load(), "pending", len(pending),
+					"fetched", fetched.Load(), "inserted", inserted.Load(), "throughput", float64(fetched.Load())/elapsed.Seconds())
+			}
+		}
+	}()
+
+feed:
+	for _, rng := range pending {
+		select {
+		case <-wctx.Done():
+			break feed
+		case queue <- rng:
+		}
+	}
+	close(queue)
+	wg.Wait()
+	close(done)
+	close(errChan)
+
+	report.Ranges = ranges.Load()
+	report.Fetched = fetched.Load()
+	report.Inserted = inserted.Load()
+	report.Elapsed = time.Since(start)
+
+	if err := <-errChan; err != nil {
+		return report, err
+	}
+	return report, ctx.Err()
+}
+
+// plan splits the [from, to[ level range into ranges, and returns the ones still to be
+// backfilled starting from their saved progress, along with the number of done ones.
+// Saved progress is only considered for ranges with the same bounds.
+func (b *Backfiller) plan(ctx context.Context, from, to int32) ([]repository.BackfillRange, int64, error) {
+	saved, err := b.repo.GetBackfillRanges(ctx, from, to)
+	if err != nil {
+		return nil, 0, err
+	}
+	progress := make(map[[2]int32]int32, len(saved))
+	for _, rng := range saved {
+		progress[[2]int32{rng.FromLevel, rng.ToLevel}] = rng.NextLevel
+	}
+
+	pending, skipped := []repository.BackfillRange{}, int64(0)
+	for lvl := from; lvl < to; {
+		// avoid overflowing near the maximum level
+		end := to
+		if to-lvl > b.rangeSize {
+			end = lvl + b.rangeSize
+		}
+
+		rng := repository.BackfillRange{FromLevel: lvl, ToLevel: end, NextLevel: lvl}
+		if next, ok := progress[[2]int32{lvl, end}]; ok {
+			rng.NextLevel = next
+		}
+		if rng.Done() {
+			skipped++
+		} else {
+			pending = append(pending, rng)
+		}
+		lvl = end
+	}
+
+	return pending, skipped, nil
+}
+
+// backfillRange stores the delegations of the given range from its next level, and
+// saves its progress after every stored page. The given function is called with the
+// insertion statistics of every page.
+func (b *Backfiller) backfillRange(ctx context.Context, rng repository.BackfillRange, onPage func(repository.InsertStats)) error {
+	err := b.client.StreamDelegationsInLevels(ctx, rng.NextLevel, rng.ToLevel, func(dlgs []Delegation) error {
+		rdlgs := make([]repository.Delegation, len(dlgs))
+		for i := range dlgs {
+			rdlgs[i] = toRepositoryDelegation(dlgs[i])
+		}
+
+		stats, err := b.repo.AddNewDelegations(ctx, rdlgs)
+		if err != nil {
+			return err
+		}
+		onPage(stats)
+
+		// delegations of the last level may go on in the next page, so it is not done yet
+		rng.NextLevel = max(rng.NextLevel, rdlgs[len(rdlgs)-1].Level)
+		return b.repo.SaveBackfillRange(ctx, rng)
+	})
+	if err != nil {
+		return err
+	}
+
+	rng.NextLevel = rng.ToLevel
+	return b.repo.SaveBackfillRange(ctx, rng)
+}
@@ -0,0 +1,162 @@
+package tezos_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/repository"
+	"kiln-tezos-delegation/tezos"
+	"log/slog"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type backfillClientMock struct {
+	mu sync.Mutex
+	// pages returned by first level of the requested range
+	StreamDelegationsInLevelsRet map[int32][][]tezos.Delegation
+	StreamDelegationsInLevelsErr error
+	StreamDelegationsInLevelsIn  [][2]int32
+}
+
+func (m *backfillClientMock) StreamDelegationsInLevels(_ context.Context, from, to int32, fn tezos.DelegationPageFunc) error {
+	m.mu.Lock()
+	m.StreamDelegationsInLevelsIn = append(m.StreamDelegationsInLevelsIn, [2]int32{from, to})
+	pages := m.StreamDelegationsInLevelsRet[from]
+	m.mu.Unlock()
+
+	for _, page := range pages {
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+	return m.StreamDelegationsInLevelsErr
+}
+
+type backfillRepoMock struct {
+	mu                      sync.Mutex
+	AddNewDelegationsIn     []repository.Delegation
+	GetBackfillRangesRet    []repository.BackfillRange
+	GetBackfillRangesErr    error
+	SaveBackfillRangeErr    error
+	SaveBackfillRangeIn     []repository.BackfillRange
+	SaveBackfillRangeLatest map[int32]repository.BackfillRange
+}
+
+func (m *backfillRepoMock) AddNewDelegations(_ context.Context, dlgs []repository.Delegation) (repository.InsertStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.AddNewDelegationsIn = append(m.AddNewDelegationsIn, dlgs...)
+	return repository.InsertStats{Inserted: int64(len(dlgs))}, nil
+}
+
+func (m *backfillRepoMock) GetBackfillRanges(context.Context, int32, int32) ([]repository.BackfillRange, error) {
+	return m.GetBackfillRangesRet, m.GetBackfillRangesErr
+}
+
+func (m *backfillRepoMock) SaveBackfillRange(_ context.Context, rng repository.BackfillRange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.SaveBackfillRangeIn = append(m.SaveBackfillRangeIn, rng)
+	if m.SaveBackfillRangeLatest == nil {
+		m.SaveBackfillRangeLatest = map[int32]repository.BackfillRange{}
+	}
+	m.SaveBackfillRangeLatest[rng.FromLevel] = rng
+	return m.SaveBackfillRangeErr
+}
+
+func TestBackfiller(t *testing.T) {
+	t.Run("backfills every range and saves progress", func(t *testing.T) {
+		clientMock := backfillClientMock{
+			StreamDelegationsInLevelsRet: map[int32][][]tezos.Delegation{
+				0:  {{{ID: 1, Level: 3}, {ID: 2, Level: 5}}, {{ID: 3, Level: 7}}},
+				10: {{{ID: 4, Level: 12}}},
+				20: {},
+			},
+		}
+		repoMock := backfillRepoMock{}
+
+		bf := tezos.NewBackfiller(&clientMock, &repoMock, 2, 10, slog.Default())
+		report, err := bf.Run(context.Background(), 0, 25)
+
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), report.Ranges)
+		assert.Equal(t, int64(0), report.Skipped)
+		assert.Equal(t, int64(4), report.Fetched)
+		assert.Equal(t, int64(4), report.Inserted)
+		assert.Len(t, repoMock.AddNewDelegationsIn, 4)
+
+		sort.Slice(clientMock.StreamDelegationsInLevelsIn, func(i, j int) bool {
+			return clientMock.StreamDelegationsInLevelsIn[i][0] < clientMock.StreamDelegationsInLevelsIn[j][0]
+		})
+		assert.Equal(t, [][2]int32{{0, 10}, {10, 20}, {20, 25}}, clientMock.StreamDelegationsInLevelsIn)
+		assert.Equal(t, map[int32]repository.BackfillRange{
+			0:  {FromLevel: 0, ToLevel: 10, NextLevel: 10},
+			10: {FromLevel: 10, ToLevel: 20, NextLevel: 20},
+			20: {FromLevel: 20, ToLevel: 25, NextLevel: 25},
+		}, repoMock.SaveBackfillRangeLatest)
+		// progress is saved after each page of the first range, before it is done
+		assert.Contains(t, repoMock.SaveBackfillRangeIn, repository.BackfillRange{FromLevel: 0, ToLevel: 10, NextLevel: 5})
+		assert.Contains(t, repoMock.SaveBackfillRangeIn, repository.BackfillRange{FromLevel: 0, ToLevel: 10, NextLevel: 7})
+	})
+
+	t.Run("resumes from saved progress", func(t *testing.T) {
+		clientMock := backfillClientMock{}
+		repoMock := backfillRepoMock{
+			GetBackfillRangesRet: []repository.BackfillRange{
+				{FromLevel: 0, ToLevel: 10, NextLevel: 10},
+				{FromLevel: 10, ToLevel: 20, NextLevel: 15},
+				{FromLevel: 20, ToLevel: 24, NextLevel: 20}, // bounds changed since
+			},
+		}
+
+		bf := tezos.NewBackfiller(&clientMock, &repoMock, 1, 10, slog.Default())
+		report, err := bf.Run(context.Background(), 0, 25)
+
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), report.Ranges)
+		assert.Equal(t, int64(1), report.Skipped)
+		assert.Equal(t, [][2]int32{{15, 20}, {20, 25}}, clientMock.StreamDelegationsInLevelsIn)
+	})
+
+	t.Run("stops on error", func(t *testing.T) {
+		clientMock := backfillClientMock{
+			StreamDelegationsInLevelsRet: map[int32][][]tezos.Delegation{
+				0: {{{ID: 1, Level: 3}}},
+			},
+			StreamDelegationsInLevelsErr: errors.New("fake tezos error"),
+		}
+		repoMock := backfillRepoMock{}
+
+		bf := tezos.NewBackfiller(&clientMock, &repoMock, 1, 10, slog.Default())
+		report, err := bf.Run(context.Background(), 0, 100)
+
+		assert.Error(t, err)
+		assert.Equal(t, int64(0), report.Ranges)
+		assert.Len(t, clientMock.StreamDelegationsInLevelsIn, 1)
+		// progress of the failed range is kept
+		assert.Equal(t, repository.BackfillRange{FromLevel: 0, ToLevel: 10, NextLevel: 3}, repoMock.SaveBackfillRangeLatest[0])
+	})
+
+	t.Run("stops on progress loading error", func(t *testing.T) {
+		clientMock := backfillClientMock{}
+		repoMock := backfillRepoMock{
+			GetBackfillRangesErr: errors.New("fake database error"),
+		}
+
+		bf := tezos.NewBackfiller(&clientMock, &repoMock, 1, 10, slog.Default())
+		_, err := bf.Run(context.Background(), 0, 100)
+
+		assert.Error(t, err)
+		assert.Empty(t, clientMock.StreamDelegationsInLevelsIn)
+	})
+
+	t.Run("error on empty level range", func(t *testing.T) {
+		bf := tezos.NewBackfiller(&backfillClientMock{}, &backfillRepoMock{}, 1, 10, slog.Default())
+		_, err := bf.Run(context.Background(), 10, 10)
+		assert.Error(t, err)
+	})
+}
@@ -4,11 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// DefaultPageSize is the number of delegations requested per page when
+// streaming delegations, unless configured otherwise with WithPageSize.
+const DefaultPageSize = 1000
+
+// MaxPageSize is the maximum number of items the TzKT API returns per request.
+const MaxPageSize = 10000
+
 // Client is a basic TzKT API client.
 type Client struct {
 	// HTTP client
@@ -17,21 +27,120 @@ type Client struct {
 	protoURL url.URL
 	// Parsed URL for operation delegations endpoint
 	delegURL url.URL
+	// Parsed URL for blocks endpoint
+	blockURL url.URL
+	// Parsed URL for head endpoint
+	headURL url.URL
+	// Number of delegations requested per page when streaming
+	pageSize int
+	// Logger of retries and failures
+	logger *slog.Logger
+}
+
+// clientOptions are the optional settings shared by Client and NodeClient.
+type clientOptions struct {
+	// HTTP transport requests are retried over
+	transport http.RoundTripper
+	// Number of delegations requested per page when streaming
+	pageSize int
+	// Retry policy of requests
+	retry RetryPolicy
+	// Logger of retries and failures
+	logger *slog.Logger
+}
+
+// newClientOptions returns the default options with the given ones applied, requests
+// being sent with the given transport.
+func newClientOptions(transport http.RoundTripper, opts []ClientOption) clientOptions {
+	o := clientOptions{
+		transport: transport,
+		pageSize:  DefaultPageSize,
+		retry:     DefaultRetryPolicy,
+		logger:    slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// httpClient returns an HTTP client retrying requests with the configured policy.
+func (o clientOptions) httpClient() http.Client {
+	return http.Client{Transport: newRetryTransport(o.transport, o.retry, o.logger)}
+}
+
+// ClientOption configures optional behaviour of a Client or a NodeClient.
+type ClientOption func(*clientOptions)
+
+// WithPageSize sets the number of delegations requested per page when streaming
+// delegations. Values out of the ]0, MaxPageSize] range are clamped.
+func WithPageSize(size int) ClientOption {
+	return func(o *clientOptions) {
+		o.pageSize = min(max(size, 1), MaxPageSize)
+	}
+}
+
+// WithRetryPolicy sets how requests are retried on transport errors, 429 and 5xx
+// responses, and when the circuit breaker opens.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(o *clientOptions) {
+		o.retry = policy
+	}
+}
+
+// WithLogger sets the logger of the client, slog.Default() otherwise.
+func WithLogger(logger *slog.Logger) ClientOption {
+	return func(o *clientOptions) {
+		o.logger = logger
+	}
+}
+
+// WithRateLimiter limits the rate of requests sent to the API with the given limiter,
+// shared by every client it is passed to, e.g. by every upstream of a MultiClient.
+// Every retry counts as a request. A nil limiter disables the limit.
+func WithRateLimiter(limiter *RateLimiter) ClientOption {
+	return func(o *clientOptions) {
+		if limiter == nil {
+			return
+		}
+		o.transport = rateLimitedTransport{next: o.transport, limiter: limiter}
+	}
+}
+
+// DelegationPageFunc is called for every page of delegations fetched while streaming.
+// Returning an error stops the streaming, and that error is returned to the caller.
+type DelegationPageFunc func([]Delegation) error
+
+// delegationFields are the fields of delegation operations selected from the TzKT API.
+const delegationFields = "id,sender,amount,level,timestamp,block,hash,status,bakerFee,prevDelegate,newDelegate"
+
+// Account is a TzKT account reference.
+type Account struct {
+	Address string `json:"address"`
 }
 
 type Delegation struct {
 	ID        int64     `json:"id"`
 	Timestamp time.Time `json:"timestamp"`
 	Block     string    `json:"block"`
-	Sender    struct {
-		Address string `json:"address"`
-	} `json:"sender"`
-	Level  int32 `json:"level"`
-	Amount int64 `json:"amount"`
+	Hash      string    `json:"hash"`
+	Status    string    `json:"status"`
+	Sender    Account   `json:"sender"`
+	Level     int32     `json:"level"`
+	Amount    int64     `json:"amount"`
+	BakerFee  int64     `json:"bakerFee"`
+	// Baker the sender delegated from, nil if it was not delegating
+	PrevDelegate *Account `json:"prevDelegate"`
+	// Baker the sender delegated to, nil on undelegation
+	NewDelegate *Account `json:"newDelegate"`
 }
 
 // NewClient creates a new client and returns an error if the base URL passed is invalid.
-func NewClient(baseURL string) (Client, error) {
+// Requests are retried with DefaultRetryPolicy unless configured otherwise. Once
+// retries are exhausted, or while the TzKT API is cut off by the circuit breaker,
+// methods return an *UpstreamError matching ErrRateLimited or ErrUpstreamUnavailable.
+// The duration and status code of every attempt are recorded as metrics.
+func NewClient(baseURL string, opts ...ClientOption) (Client, error) {
 	pBase, err := url.Parse(baseURL + "v1/protocols/current")
 	if err != nil {
 		return Client{}, err
@@ -42,9 +151,27 @@ func NewClient(baseURL string) (Client, error) {
 		return Client{}, err
 	}
 
+	bBase, err := url.Parse(baseURL + "v1/blocks")
+	if err != nil {
+		return Client{}, err
+	}
+
+	hBase, err := url.Parse(baseURL + "v1/head")
+	if err != nil {
+		return Client{}, err
+	}
+
+	// innermost transport, recording every attempt without rate limiting delays
+	o := newClientOptions(metricsTransport{next: http.DefaultTransport, routes: tzktRoutes}, opts)
+
 	return Client{
+		client:   o.httpClient(),
 		protoURL: *pBase,
 		delegURL: *dBase,
+		blockURL: *bBase,
+		headURL:  *hBase,
+		pageSize: o.pageSize,
+		logger:   o.logger,
 	}, nil
 }
 
@@ -83,29 +210,170 @@ func (c Client) GetCurrentProtocolTimeBetweenBlocks(ctx context.Context) (time.D
 // and returns delegations which timestamps are greater or equal to the time passed
 // as parameter. Delegation operations are guaranteed to be sorted most recent first
 // by the TzKT API but this function does not enforce this behaviour.
+// Only the first page of results is returned, its size being the default one of
+// the TzKT API; use StreamDelegationsSince to get all of them.
 // Returns the underlying HTTP client errors, or any issues related to response processing.
 func (c Client) GetDelegationsSince(ctx context.Context, since time.Time) ([]Delegation, error) {
 	// cannot sort by timestamp; sort by id since it seems to be a reliable increment
-	url := c.delegURL.String() + "?select=id,sender,amount,level,timestamp,block&sort.asc=id&timestamp.ge=" + since.UTC().Format(time.RFC3339)
+	url := c.delegURL.String() + "?select=" + delegationFields + "&sort.asc=id&timestamp.ge=" + since.UTC().Format(time.RFC3339)
+	return c.getDelegations(ctx, url)
+}
+
+// StreamDelegationsSince calls the "/operations/delegations" endpoint of the TzKT API
+// page by page, and passes delegations which timestamps are greater or equal to the
+// time passed as parameter to the given function, oldest first. Pages are fetched
+// using the operation ID as a cursor, until a page smaller than the configured page
+// size is returned, meaning the client caught up with the TzKT API.
+// Returns the underlying HTTP client errors, any issues related to response processing,
+// or the error returned by the page function.
+func (c Client) StreamDelegationsSince(ctx context.Context, since time.Time, fn DelegationPageFunc) error {
+	query := url.Values{}
+	query.Set("timestamp.ge", since.UTC().Format(time.RFC3339))
+	return c.streamDelegations(ctx, query, fn)
+}
+
+// StreamDelegationsAfter calls the "/operations/delegations" endpoint of the TzKT API
+// page by page, and passes delegations which operation IDs are greater than the one
+// passed as parameter to the given function, oldest first. Pages are fetched the same
+// way as with StreamDelegationsSince. The level of the block of that operation is not
+// needed, operation IDs being consistent within a TzKT instance.
+// Returns the underlying HTTP client errors, any issues related to response processing,
+// or the error returned by the page function.
+func (c Client) StreamDelegationsAfter(ctx context.Context, id int64, _ int32, fn DelegationPageFunc) error {
+	query := url.Values{}
+	query.Set("id.gt", strconv.FormatInt(id, 10))
+	return c.streamDelegations(ctx, query, fn)
+}
+
+// StreamDelegationsFromLevel calls the "/operations/delegations" endpoint of the TzKT
+// API page by page, and passes delegations included in blocks at the given level or
+// above to the given function, oldest first. Pages are fetched the same way as with
+// StreamDelegationsSince.
+// Returns the underlying HTTP client errors, any issues related to response processing,
+// or the error returned by the page function.
+func (c Client) StreamDelegationsFromLevel(ctx context.Context, from int32, fn DelegationPageFunc) error {
+	query := url.Values{}
+	query.Set("level.ge", strconv.Itoa(int(from)))
+	return c.streamDelegations(ctx, query, fn)
+}
+
+// StreamDelegationsInLevels calls the "/operations/delegations" endpoint of the TzKT
+// API page by page, and passes delegations included in blocks within the [from, to[
+// level range to the given function, oldest first. Pages are fetched the same way as
+// with StreamDelegationsSince.
+// Returns the underlying HTTP client errors, any issues related to response processing,
+// or the error returned by the page function.
+func (c Client) StreamDelegationsInLevels(ctx context.Context, from, to int32, fn DelegationPageFunc) error {
+	query := url.Values{}
+	query.Set("level.ge", strconv.Itoa(int(from)))
+	query.Set("level.lt", strconv.Itoa(int(to)))
+	return c.streamDelegations(ctx, query, fn)
+}
+
+// streamDelegations fetches delegations matching the given filter query page by page,
+// and passes them to the given function.
+func (c Client) streamDelegations(ctx context.Context, query url.Values, fn DelegationPageFunc) error {
+	query.Set("select", delegationFields)
+	// cannot sort by timestamp; sort by id since it seems to be a reliable increment
+	query.Set("sort.asc", "id")
+	query.Set("limit", strconv.Itoa(c.pageSize))
+
+	for {
+		u := c.delegURL
+		u.RawQuery = query.Encode()
+
+		dlgs, err := c.getDelegations(ctx, u.String())
+		if err != nil {
+			return err
+		}
+
+		if len(dlgs) > 0 {
+			if err := fn(dlgs); err != nil {
+				return err
+			}
+		}
+
+		if len(dlgs) < c.pageSize {
+			return nil
+		}
+
+		// next page starts right after the last operation of the current one
+		query.Set("offset.cr", strconv.FormatInt(dlgs[len(dlgs)-1].ID, 10))
+	}
+}
+
+// GetBlockHashes calls the "/blocks" endpoint of the TzKT API and returns the hashes
+// of the blocks at the given levels, by level. Levels having no block are missing
+// from the returned map.
+// Returns the underlying HTTP client errors, or any issues related to response processing.
+func (c Client) GetBlockHashes(ctx context.Context, levels []int32) (map[int32]string, error) {
+	strLevels := make([]string, len(levels))
+	for i := range levels {
+		strLevels[i] = strconv.Itoa(int(levels[i]))
+	}
+
+	query := url.Values{}
+	query.Set("select", "level,hash")
+	query.Set("level.in", strings.Join(strLevels, ","))
+	query.Set("limit", strconv.Itoa(len(levels)))
+
+	u := c.blockURL
+	u.RawQuery = query.Encode()
+
+	payload := []struct {
+		Level int32  `json:"level"`
+		Hash  string `json:"hash"`
+	}{}
+	if err := c.getJSON(ctx, u.String(), &payload); err != nil {
+		return map[int32]string{}, err
+	}
+
+	hashes := make(map[int32]string, len(payload))
+	for i := range payload {
+		hashes[payload[i].Level] = payload[i].Hash
+	}
+
+	return hashes, nil
+}
+
+// GetHeadLevel calls the "/head" endpoint of the TzKT API and returns the level of
+// the last block indexed.
+// Returns the underlying HTTP client errors, or any issues related to response processing.
+func (c Client) GetHeadLevel(ctx context.Context) (int32, error) {
+	payload := struct {
+		Level int32 `json:"level"`
+	}{}
+	if err := c.getJSON(ctx, c.headURL.String(), &payload); err != nil {
+		return 0, err
+	}
+	return payload.Level, nil
+}
+
+// getDelegations calls the given delegation operations URL and decodes the response.
+func (c Client) getDelegations(ctx context.Context, url string) ([]Delegation, error) {
+	payload := []Delegation{}
+	if err := c.getJSON(ctx, url, &payload); err != nil {
+		return []Delegation{}, err
+	}
+	return payload, nil
+}
+
+// getJSON calls the given URL and decodes the JSON response into the given value.
+func (c Client) getJSON(ctx context.Context, url string, v any) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return []Delegation{}, err
+		return err
 	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return []Delegation{}, err
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return []Delegation{}, fmt.Errorf("bad HTTP status: %d", resp.StatusCode)
+		return fmt.Errorf("bad HTTP status: %d", resp.StatusCode)
 	}
 
-	payload := []Delegation{}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return []Delegation{}, err
-	}
-
-	return payload, nil
+	return json.NewDecoder(resp.Body).Decode(v)
 }
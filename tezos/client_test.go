@@ -2,16 +2,23 @@ package tezos_test
 
 import (
 	"context"
+	"errors"
 	"kiln-tezos-delegation/tezos"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// noRetry disables retries, so that failures are returned right away.
+var noRetry = tezos.WithRetryPolicy(tezos.RetryPolicy{MaxAttempts: 1})
+
 func TestClient(t *testing.T) {
 	t.Run("calls current protocol endpoint correctly", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -21,7 +28,7 @@ func TestClient(t *testing.T) {
 		}))
 		defer server.Close()
 
-		cli, err := tezos.NewClient(server.URL + "/")
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
 		require.NoError(t, err)
 
 		var gotDur time.Duration
@@ -37,7 +44,7 @@ func TestClient(t *testing.T) {
 		}))
 		defer server.Close()
 
-		cli, err := tezos.NewClient(server.URL + "/")
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
 		require.NoError(t, err)
 
 		_, err = cli.GetCurrentProtocolTimeBetweenBlocks(context.Background())
@@ -53,7 +60,7 @@ func TestClient(t *testing.T) {
 		}))
 		defer server.Close()
 
-		cli, err := tezos.NewClient(server.URL + "/")
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
 		require.NoError(t, err)
 
 		_, err = cli.GetCurrentProtocolTimeBetweenBlocks(context.Background())
@@ -65,18 +72,18 @@ func TestClient(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			assert.Equal(t, "/v1/operations/delegations", r.URL.Path)
 			assert.Equal(t, 3, len(r.URL.Query())) // only 3 query parameters
-			assert.Equal(t, "id,sender,amount,level,timestamp,block", r.URL.Query().Get("select"))
+			assert.Equal(t, "id,sender,amount,level,timestamp,block,hash,status,bakerFee,prevDelegate,newDelegate", r.URL.Query().Get("select"))
 			assert.Equal(t, "id", r.URL.Query().Get("sort.asc"))
 			assert.Equal(t, "1991-03-01T10:25:07Z", r.URL.Query().Get("timestamp.ge"))
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(`[
-				{"id":42,"timestamp":"2024-06-25T10:02:33Z","block":"hash1","sender":{"address":"addr1"},"level":242,"amount":342},
-				{"id":43,"timestamp":"2024-06-25T14:02:33Z","block":"hash2","sender":{"address":"addr2"},"level":243,"amount":343}
+				{"id":42,"timestamp":"2024-06-25T10:02:33Z","block":"hash1","hash":"op1","status":"applied","sender":{"address":"addr1"},"level":242,"amount":342,"bakerFee":442,"prevDelegate":{"address":"baker1"},"newDelegate":{"address":"baker2"}},
+				{"id":43,"timestamp":"2024-06-25T14:02:33Z","block":"hash2","hash":"op2","status":"applied","sender":{"address":"addr2"},"level":243,"amount":343,"bakerFee":443,"prevDelegate":{"address":"baker2"},"newDelegate":null}
 			]`))
 		}))
 		defer server.Close()
 
-		cli, err := tezos.NewClient(server.URL + "/")
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
 		require.NoError(t, err)
 
 		var gotDlgs []tezos.Delegation
@@ -90,6 +97,15 @@ func TestClient(t *testing.T) {
 		assert.Equal(t, "addr1", gotDlgs[0].Sender.Address)
 		assert.Equal(t, int32(242), gotDlgs[0].Level)
 		assert.Equal(t, int64(342), gotDlgs[0].Amount)
+		assert.Equal(t, "op1", gotDlgs[0].Hash)
+		assert.Equal(t, "applied", gotDlgs[0].Status)
+		assert.Equal(t, int64(442), gotDlgs[0].BakerFee)
+		require.NotNil(t, gotDlgs[0].PrevDelegate)
+		assert.Equal(t, "baker1", gotDlgs[0].PrevDelegate.Address)
+		require.NotNil(t, gotDlgs[0].NewDelegate)
+		assert.Equal(t, "baker2", gotDlgs[0].NewDelegate.Address)
+		// undelegation
+		assert.Nil(t, gotDlgs[1].NewDelegate)
 	})
 
 	t.Run("returns error delegation operations fetch bad status", func(t *testing.T) {
@@ -98,7 +114,7 @@ func TestClient(t *testing.T) {
 		}))
 		defer server.Close()
 
-		cli, err := tezos.NewClient(server.URL + "/")
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
 		require.NoError(t, err)
 
 		_, err = cli.GetDelegationsSince(context.Background(), time.Time{})
@@ -113,11 +129,393 @@ func TestClient(t *testing.T) {
 		}))
 		defer server.Close()
 
-		cli, err := tezos.NewClient(server.URL + "/")
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
 		require.NoError(t, err)
 
 		_, err = cli.GetDelegationsSince(context.Background(), time.Time{})
 
 		assert.Error(t, err)
 	})
+
+	t.Run("streams delegation operations page by page", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			assert.Equal(t, "/v1/operations/delegations", r.URL.Path)
+			assert.Equal(t, "id,sender,amount,level,timestamp,block,hash,status,bakerFee,prevDelegate,newDelegate", r.URL.Query().Get("select"))
+			assert.Equal(t, "id", r.URL.Query().Get("sort.asc"))
+			assert.Equal(t, "1991-03-01T10:25:07Z", r.URL.Query().Get("timestamp.ge"))
+			assert.Equal(t, "2", r.URL.Query().Get("limit"))
+			w.WriteHeader(http.StatusOK)
+			switch r.URL.Query().Get("offset.cr") {
+			case "":
+				w.Write([]byte(`[{"id":42,"sender":{"address":"addr1"}},{"id":43,"sender":{"address":"addr2"}}]`))
+			case "43":
+				w.Write([]byte(`[{"id":44,"sender":{"address":"addr3"}}]`))
+			default:
+				t.Errorf("unexpected cursor: %s", r.URL.Query().Get("offset.cr"))
+			}
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithPageSize(2), noRetry)
+		require.NoError(t, err)
+
+		pages := [][]tezos.Delegation{}
+		err = cli.StreamDelegationsSince(context.Background(), time.Date(1991, 03, 01, 10, 25, 07, 0, time.UTC), func(dlgs []tezos.Delegation) error {
+			pages = append(pages, dlgs)
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		require.Len(t, pages, 2)
+		assert.Len(t, pages[0], 2)
+		assert.Len(t, pages[1], 1)
+		assert.Equal(t, int64(44), pages[1][0].ID)
+	})
+
+	t.Run("stops streaming on empty page", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusOK)
+			if r.URL.Query().Get("offset.cr") == "" {
+				w.Write([]byte(`[{"id":42},{"id":43}]`))
+				return
+			}
+			w.Write([]byte(`[]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithPageSize(2), noRetry)
+		require.NoError(t, err)
+
+		pageCount := 0
+		err = cli.StreamDelegationsSince(context.Background(), time.Time{}, func(dlgs []tezos.Delegation) error {
+			pageCount++
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, 1, pageCount) // empty pages are not passed
+	})
+
+	t.Run("stops streaming on page function error", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":42},{"id":43}]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithPageSize(2), noRetry)
+		require.NoError(t, err)
+
+		fnErr := errors.New("fake storage error")
+		err = cli.StreamDelegationsSince(context.Background(), time.Time{}, func(dlgs []tezos.Delegation) error {
+			return fnErr
+		})
+
+		assert.ErrorIs(t, err, fnErr)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("returns error on streaming bad status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		err = cli.StreamDelegationsSince(context.Background(), time.Time{}, func([]tezos.Delegation) error {
+			return nil
+		})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("calls blocks endpoint correctly", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/blocks", r.URL.Path)
+			assert.Equal(t, "level,hash", r.URL.Query().Get("select"))
+			assert.Equal(t, "242,243,244", r.URL.Query().Get("level.in"))
+			assert.Equal(t, "3", r.URL.Query().Get("limit"))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"level":242,"hash":"hash1"},{"level":243,"hash":"hash2"}]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		hashes, err := cli.GetBlockHashes(context.Background(), []int32{242, 243, 244})
+
+		assert.NoError(t, err)
+		assert.Equal(t, map[int32]string{242: "hash1", 243: "hash2"}, hashes)
+	})
+
+	t.Run("returns error on blocks fetch bad status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("streams delegation operations within level range", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/operations/delegations", r.URL.Path)
+			assert.Equal(t, "id", r.URL.Query().Get("sort.asc"))
+			assert.Equal(t, "100", r.URL.Query().Get("level.ge"))
+			assert.Equal(t, "200", r.URL.Query().Get("level.lt"))
+			assert.Empty(t, r.URL.Query().Get("timestamp.ge"))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":42,"level":142,"sender":{"address":"addr1"}}]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithPageSize(2), noRetry)
+		require.NoError(t, err)
+
+		pages := [][]tezos.Delegation{}
+		err = cli.StreamDelegationsInLevels(context.Background(), 100, 200, func(dlgs []tezos.Delegation) error {
+			pages = append(pages, dlgs)
+			return nil
+		})
+
+		assert.NoError(t, err)
+		require.Len(t, pages, 1)
+		assert.Equal(t, int32(142), pages[0][0].Level)
+	})
+
+	t.Run("streams delegation operations after operation ID", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/operations/delegations", r.URL.Path)
+			assert.Equal(t, "id", r.URL.Query().Get("sort.asc"))
+			assert.Equal(t, "41", r.URL.Query().Get("id.gt"))
+			assert.Empty(t, r.URL.Query().Get("timestamp.ge"))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":42,"level":142,"sender":{"address":"addr1"}}]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithPageSize(2), noRetry)
+		require.NoError(t, err)
+
+		pages := [][]tezos.Delegation{}
+		err = cli.StreamDelegationsAfter(context.Background(), 41, 141, func(dlgs []tezos.Delegation) error {
+			pages = append(pages, dlgs)
+			return nil
+		})
+
+		assert.NoError(t, err)
+		require.Len(t, pages, 1)
+		assert.Equal(t, int64(42), pages[0][0].ID)
+	})
+
+	t.Run("calls head endpoint correctly", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/head", r.URL.Path)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"chain":"mainnet","level":5242880}`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		level, err := cli.GetHeadLevel(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(5242880), level)
+	})
+
+	t.Run("returns error on head fetch bad status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		_, err = cli.GetHeadLevel(context.Background())
+
+		assert.Error(t, err)
+	})
+
+	t.Run("streams delegation operations from level", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/operations/delegations", r.URL.Path)
+			assert.Equal(t, "id", r.URL.Query().Get("sort.asc"))
+			assert.Equal(t, "142", r.URL.Query().Get("level.ge"))
+			assert.Empty(t, r.URL.Query().Get("id.gt"))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":42,"level":142,"sender":{"address":"addr1"}},{"id":43,"level":143,"sender":{"address":"addr2"}}]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithPageSize(3), noRetry)
+		require.NoError(t, err)
+
+		pages := [][]tezos.Delegation{}
+		err = cli.StreamDelegationsFromLevel(context.Background(), 142, func(dlgs []tezos.Delegation) error {
+			pages = append(pages, dlgs)
+			return nil
+		})
+
+		assert.NoError(t, err)
+		require.Len(t, pages, 1)
+		assert.Len(t, pages[0], 2)
+	})
+
+	t.Run("records request metrics", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		_, err = cli.GetHeadLevel(context.Background())
+		require.Error(t, err)
+
+		host := server.Listener.Addr().String()
+		assert.Equal(t, []map[string]string{{"host": host, "endpoint": "/v1/head", "code": "503"}}, requestLabels(t, host))
+	})
+
+	t.Run("records request metrics by route", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/tzkt/", noRetry)
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		require.NoError(t, err)
+
+		host := server.Listener.Addr().String()
+		assert.Equal(t, []map[string]string{{"host": host, "endpoint": "/v1/blocks", "code": "200"}}, requestLabels(t, host))
+		assert.Equal(t, "/v1/operations/delegations", tezos.TzktRoute("/v1/operations/delegations"))
+		assert.Equal(t, "other", tezos.TzktRoute("/v1/operations/delegations/42"))
+		assert.Equal(t, "other", tezos.TzktRoute("/v1/head/extra"))
+	})
+
+	t.Run("limits request rate", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRateLimiter(tezos.NewRateLimiter(20)), noRetry)
+		require.NoError(t, err)
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			_, err := cli.GetBlockHashes(context.Background(), []int32{242})
+			require.NoError(t, err)
+		}
+
+		// first request is immediate, the next ones are delayed by 50ms each
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("limits combined request rate of upstreams sharing options", func(t *testing.T) {
+		var calls atomic.Int32
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[]`))
+		})
+		first, second := httptest.NewServer(handler), httptest.NewServer(handler)
+		defer first.Close()
+		defer second.Close()
+
+		// options are applied to every upstream, as NewMultiClient does
+		opts := []tezos.ClientOption{tezos.WithRateLimiter(tezos.NewRateLimiter(20)), noRetry}
+		clis := make([]tezos.Client, 0, 2)
+		for _, baseURL := range []string{first.URL + "/", second.URL + "/"} {
+			cli, err := tezos.NewClient(baseURL, opts...)
+			require.NoError(t, err)
+			clis = append(clis, cli)
+		}
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for _, cli := range clis {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 5; i++ {
+					_, err := cli.GetBlockHashes(context.Background(), []int32{242})
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// 10 requests at 20 per second overall, not per upstream
+		assert.Equal(t, int32(10), calls.Load())
+		assert.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+	})
+
+	t.Run("returns error on rate limited request cancellation", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[]`))
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRateLimiter(tezos.NewRateLimiter(0.1)), noRetry)
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = cli.GetBlockHashes(ctx, []int32{242})
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+// requestLabels returns the labels of the request duration metrics recorded for the
+// given host.
+func requestLabels(t *testing.T, host string) []map[string]string {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	labels := []map[string]string{}
+	for _, family := range families {
+		if family.GetName() != "tezos_delegation_tzkt_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			ls := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				ls[label.GetName()] = label.GetValue()
+			}
+			if ls["host"] == host {
+				labels = append(labels, ls)
+			}
+		}
+	}
+	return labels
 }
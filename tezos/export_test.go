@@ -0,0 +1,37 @@
+package tezos
+
+import (
+	"testing"
+	"time"
+)
+
+// SetUpstreamCheck sets the interval and the timeout of upstreams head checks until
+// the end of the given test.
+func SetUpstreamCheck(t testing.TB, interval, timeout time.Duration) {
+	prevInterval, prevTimeout := upstreamCheckInterval, upstreamCheckTimeout
+	upstreamCheckInterval, upstreamCheckTimeout = interval, timeout
+	t.Cleanup(func() {
+		upstreamCheckInterval, upstreamCheckTimeout = prevInterval, prevTimeout
+	})
+}
+
+// SetNodeMaxBlockDelegations sets the number of delegations a block may hold for the
+// node client until the end of the given test.
+func SetNodeMaxBlockDelegations(t testing.TB, count int) {
+	prev := nodeMaxBlockDelegations
+	nodeMaxBlockDelegations = count
+	t.Cleanup(func() {
+		nodeMaxBlockDelegations = prev
+	})
+}
+
+// TzktRoute returns the endpoint the given URL path of the TzKT API is recorded by.
+func TzktRoute(path string) string {
+	return routeOf(path, tzktRoutes)
+}
+
+// SetHeadCheckInterval sets the interval of head checks while subscribed. It must be
+// called before running the streamer.
+func (s *Streamer) SetHeadCheckInterval(interval time.Duration) {
+	s.headCheckInterval = interval
+}
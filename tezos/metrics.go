@@ -0,0 +1,125 @@
+package tezos
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsNamespace prefixes the names of the Prometheus metrics of the component.
+const metricsNamespace = "tezos_delegation"
+
+var (
+	scrapeCycleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "scrape_cycle_duration_seconds",
+		Help:      "Duration of scraping cycles, by result.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"result"})
+	delegationsFetched = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "delegations_fetched_total",
+		Help:      "Number of delegations fetched from the Tezos data source.",
+	})
+	delegationsInserted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "delegations_inserted_total",
+		Help:      "Number of delegations inserted in storage.",
+	})
+	delegationsDuplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "delegations_duplicated_total",
+		Help:      "Number of fetched delegations skipped as already stored.",
+	})
+	lastScrapedLevel = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_scraped_level",
+		Help:      "Level of the last stored delegation.",
+	})
+	lastScrapedTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_scraped_timestamp_seconds",
+		Help:      "Block timestamp of the most recent delegation stored since start, in Unix seconds.",
+	})
+	headLevel = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "head_level",
+		Help:      "Level of the head block of the Tezos data source, as of the last check.",
+	})
+	headLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "head_lag_levels",
+		Help:      "Number of levels between the head block of the Tezos data source and the level up to which every delegation is stored.",
+	})
+	tzktRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tzkt_request_duration_seconds",
+		Help:      "Duration of TzKT API or node RPC requests, retries included separately, by host, endpoint and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "endpoint", "code"})
+)
+
+// tzktRoutes are the endpoints of the TzKT API called by Client.
+var tzktRoutes = []string{"/v1/protocols/current", "/v1/operations/delegations", "/v1/blocks", "/v1/head"}
+
+// nodeRoutes are the endpoints of the node RPC called by NodeClient.
+var nodeRoutes = []string{
+	"/chains/main/blocks/{block}/header",
+	"/chains/main/blocks/{block}/hash",
+	"/chains/main/blocks/{block}/operations",
+	"/chains/main/blocks/{block}/context/constants",
+	"/chains/main/blocks/{block}/context/contracts/{contract}/balance",
+	"/chains/main/blocks/{block}/context/contracts/{contract}/delegate",
+}
+
+// metricsTransport is an HTTP transport recording the duration and status code of
+// every request, by route. Transport errors are recorded with the "error" code.
+type metricsTransport struct {
+	next http.RoundTripper
+	// Routes requests are recorded by, any other path being recorded as "other"
+	routes []string
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	endpoint := routeOf(req.URL.Path, t.routes)
+	tzktRequestDuration.WithLabelValues(req.URL.Host, endpoint, code).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// routeOf returns the route among the given ones the given URL path ends with, so
+// that base URL prefixes are ignored, or "other" if none matches. Route segments
+// in braces match any value, keeping the number of recorded endpoints bounded.
+func routeOf(path string, routes []string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range routes {
+		rsegments := strings.Split(strings.Trim(route, "/"), "/")
+		if len(rsegments) > len(segments) {
+			continue
+		}
+		tail := segments[len(segments)-len(rsegments):]
+		if slices.EqualFunc(rsegments, tail, func(r, s string) bool {
+			return r == s || strings.HasPrefix(r, "{")
+		}) {
+			return route
+		}
+	}
+	return "other"
+}
+
+// observeCheckpoint records the level of the last stored delegation.
+func observeCheckpoint(level int32) {
+	lastScrapedLevel.Set(float64(level))
+}
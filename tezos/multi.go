@@ -0,0 +1,465 @@
+package tezos
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxLag is the number of levels an upstream may lag behind the most advanced
+	// one before failing over, unless configured otherwise with WithMaxLag.
+	DefaultMaxLag = 2
+)
+
+// variables for testing purposes
+var (
+	// upstreamCheckInterval is the delay between two checks of the upstreams heads.
+	upstreamCheckInterval = 30 * time.Second
+	// upstreamCheckTimeout is the timeout of the upstreams heads checks.
+	upstreamCheckTimeout = 5 * time.Second
+)
+
+// Divergence reports delegations which differ between two TzKT upstreams over the
+// same range of levels. Delegations are matched by operation hash and sender, since
+// operation IDs are internal to each TzKT instance, and an operation group may hold
+// delegations of several contracts.
+type Divergence struct {
+	// Base URLs of the upstream the delegations were fetched from, and of the one
+	// they were checked against
+	Primary   string
+	Secondary string
+	// Range of levels checked, inclusive
+	FirstLevel int32
+	LastLevel  int32
+	// Hashes of the operations only known by the primary upstream
+	Missing []string
+	// Hashes of the operations only known by the secondary upstream, within the levels
+	// strictly between the first and last ones
+	Extra []string
+	// Hashes of the operations having different contents
+	Mismatched []string
+}
+
+// DivergenceFunc is called on every divergence found while cross-checking.
+type DivergenceFunc func(Divergence)
+
+// MultiClientOption configures optional behaviour of a MultiClient.
+type MultiClientOption func(*MultiClient)
+
+// WithMaxLag sets the number of levels an upstream may lag behind the most advanced
+// one before failing over.
+func WithMaxLag(levels int32) MultiClientOption {
+	return func(m *MultiClient) {
+		m.maxLag = max(levels, 0)
+	}
+}
+
+// WithCrossCheck enables the cross-check of every page of delegations against another
+// upstream. Divergences are passed to the given function, or logged if it is nil.
+func WithCrossCheck(fn DivergenceFunc) MultiClientOption {
+	return func(m *MultiClient) {
+		m.crossCheck = true
+		m.onDivergence = fn
+	}
+}
+
+// upstream is a TzKT instance, with its health as of the last check.
+type upstream struct {
+	url     string
+	client  Client
+	level   int32
+	healthy bool
+}
+
+// MultiClient is a TzKT API client over several upstreams, by decreasing priority.
+// Calls go to the upstream of highest priority which is healthy and not lagging
+// behind the most advanced one, based on head levels checked regularly. Calls
+// failing with ErrUpstreamUnavailable or ErrRateLimited fail over to the next one.
+// It is safe from concurrency.
+type MultiClient struct {
+	upstreams    []*upstream
+	maxLag       int32
+	crossCheck   bool
+	onDivergence DivergenceFunc
+	logger       *slog.Logger
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	selected  *upstream
+	// upstream which passed the last delegation streamed, and its operation ID
+	lastUpstream *upstream
+	lastID       int64
+	// level of the last delegation streamed, and keys of the delegations of that level
+	lastLevel int32
+	lastKeys  map[delegationKey]struct{}
+}
+
+// NewMultiClient creates a client for each of the given base URLs, by decreasing
+// priority, with the given client options. It logs with the logger of the clients.
+// Returns an error if there is no base URL or if any is invalid.
+func NewMultiClient(baseURLs []string, clientOpts []ClientOption, opts ...MultiClientOption) (*MultiClient, error) {
+	if len(baseURLs) == 0 {
+		return nil, errors.New("no TzKT base URL")
+	}
+
+	m := &MultiClient{maxLag: DefaultMaxLag}
+	for _, baseURL := range baseURLs {
+		client, err := NewClient(baseURL, clientOpts...)
+		if err != nil {
+			return nil, err
+		}
+		m.upstreams = append(m.upstreams, &upstream{url: baseURL, client: client, healthy: true})
+	}
+	m.logger = m.upstreams[0].client.logger
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m, nil
+}
+
+// GetCurrentProtocolTimeBetweenBlocks returns the "timeBetweenBlocks" constant of the
+// current protocol, as Client does, failing over between upstreams.
+func (m *MultiClient) GetCurrentProtocolTimeBetweenBlocks(ctx context.Context) (time.Duration, error) {
+	var ret time.Duration
+	err := m.do(ctx, func(up *upstream) error {
+		var err error
+		ret, err = up.client.GetCurrentProtocolTimeBetweenBlocks(ctx)
+		return err
+	})
+	return ret, err
+}
+
+// StreamDelegationsSince passes delegations since the given time to the given function,
+// as Client does, failing over between upstreams. On fail over, streaming starts over
+// on the next upstream, so pages may be passed again.
+func (m *MultiClient) StreamDelegationsSince(ctx context.Context, since time.Time, fn DelegationPageFunc) error {
+	return m.do(ctx, func(up *upstream) error {
+		return up.client.StreamDelegationsSince(ctx, since, m.checked(ctx, up, m.tracked(up, fn)))
+	})
+}
+
+// StreamDelegationsAfter passes delegations after the given operation ID, included in
+// a block at the given level, to the given function, failing over between upstreams.
+// Operation IDs are internal to each TzKT instance: the given one is only trusted by
+// the upstream which passed it last. Otherwise, as on fail over, streaming resumes
+// from the given level. Delegations of that level already passed are dropped, by
+// operation hash and sender; the other ones, e.g. after a restart, are passed again.
+func (m *MultiClient) StreamDelegationsAfter(ctx context.Context, id int64, level int32, fn DelegationPageFunc) error {
+	return m.do(ctx, func(up *upstream) error {
+		if m.passedLast(up, id) {
+			return up.client.StreamDelegationsAfter(ctx, id, level, m.checked(ctx, up, m.tracked(up, fn)))
+		}
+		m.logger.InfoContext(ctx, "resuming from level on TzKT upstream", "upstream", up.url, "level", level)
+		return up.client.StreamDelegationsFromLevel(ctx, level, m.checked(ctx, up, m.unseen(level, m.tracked(up, fn))))
+	})
+}
+
+// StreamDelegationsInLevels passes delegations within the given level range to the
+// given function, as Client does, failing over between upstreams. On fail over,
+// streaming starts over on the next upstream, so pages may be passed again.
+func (m *MultiClient) StreamDelegationsInLevels(ctx context.Context, from, to int32, fn DelegationPageFunc) error {
+	return m.do(ctx, func(up *upstream) error {
+		return up.client.StreamDelegationsInLevels(ctx, from, to, m.checked(ctx, up, fn))
+	})
+}
+
+// GetBlockHashes returns the hashes of the blocks at the given levels, as Client does,
+// failing over between upstreams.
+func (m *MultiClient) GetBlockHashes(ctx context.Context, levels []int32) (map[int32]string, error) {
+	var ret map[int32]string
+	err := m.do(ctx, func(up *upstream) error {
+		var err error
+		ret, err = up.client.GetBlockHashes(ctx, levels)
+		return err
+	})
+	return ret, err
+}
+
+// GetHeadLevel returns the level of the last block indexed, as Client does, failing
+// over between upstreams.
+func (m *MultiClient) GetHeadLevel(ctx context.Context) (int32, error) {
+	var ret int32
+	err := m.do(ctx, func(up *upstream) error {
+		var err error
+		ret, err = up.client.GetHeadLevel(ctx)
+		return err
+	})
+	return ret, err
+}
+
+// do calls the given function with upstreams in order of preference, until it
+// succeeds or fails with an error which is not an upstream failure.
+// Returns the error of the last call.
+func (m *MultiClient) do(ctx context.Context, fn func(*upstream) error) error {
+	var err error
+	for _, up := range m.candidates(ctx) {
+		err = fn(up)
+		if err == nil || !(errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, ErrRateLimited)) {
+			return err
+		}
+		m.logger.WarnContext(ctx, "TzKT upstream failed", "upstream", up.url, "error", err)
+		m.markUnhealthy(up)
+	}
+	return err
+}
+
+// candidates returns the upstreams in order of preference: healthy ones not lagging
+// behind first, then the other ones as last resort, each by decreasing priority.
+// Upstreams heads are checked first if the last check is too old.
+func (m *MultiClient) candidates(ctx context.Context) []*upstream {
+	m.mu.Lock()
+	stale := time.Since(m.checkedAt) > upstreamCheckInterval
+	m.mu.Unlock()
+	if stale {
+		m.checkHeads(ctx)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	top := int32(0)
+	for _, up := range m.upstreams {
+		if up.healthy {
+			top = max(top, up.level)
+		}
+	}
+
+	preferred, others := []*upstream{}, []*upstream{}
+	for _, up := range m.upstreams {
+		if up.healthy && up.level >= top-m.maxLag {
+			preferred = append(preferred, up)
+		} else {
+			others = append(others, up)
+		}
+	}
+
+	ret := append(preferred, others...)
+	if m.selected != ret[0] {
+		if m.selected != nil {
+			m.logger.InfoContext(ctx, "switching TzKT upstream", "from", m.selected.url, "to", ret[0].url)
+		}
+		m.selected = ret[0]
+	}
+	return ret
+}
+
+// checkHeads fetches the head levels of every upstream concurrently, and records
+// which are healthy.
+func (m *MultiClient) checkHeads(ctx context.Context) {
+	cctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+
+	levels := make([]int32, len(m.upstreams))
+	errs := make([]error, len(m.upstreams))
+	var wg sync.WaitGroup
+	wg.Add(len(m.upstreams))
+	for i, up := range m.upstreams {
+		go func() {
+			defer wg.Done()
+			levels[i], errs[i] = up.client.GetHeadLevel(cctx)
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, up := range m.upstreams {
+		up.healthy = errs[i] == nil
+		if errs[i] == nil {
+			up.level = levels[i]
+		} else {
+			m.logger.WarnContext(ctx, "TzKT upstream head check failed", "upstream", up.url, "error", errs[i])
+		}
+	}
+	m.checkedAt = time.Now()
+}
+
+// markUnhealthy records that the given upstream failed, until the next head check.
+func (m *MultiClient) markUnhealthy(up *upstream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	up.healthy = false
+}
+
+// tracked wraps the given page function to record the last delegation passed by the
+// given upstream, once the function succeeded.
+func (m *MultiClient) tracked(up *upstream, fn DelegationPageFunc) DelegationPageFunc {
+	return func(dlgs []Delegation) error {
+		if err := fn(dlgs); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.lastUpstream, m.lastID = up, dlgs[len(dlgs)-1].ID
+		for i := range dlgs {
+			if dlgs[i].Level != m.lastLevel || m.lastKeys == nil {
+				m.lastLevel, m.lastKeys = dlgs[i].Level, map[delegationKey]struct{}{}
+			}
+			m.lastKeys[keyOf(dlgs[i])] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// unseen wraps the given page function to drop delegations of the given level which
+// were already passed, pages left empty being skipped.
+func (m *MultiClient) unseen(level int32, fn DelegationPageFunc) DelegationPageFunc {
+	m.mu.Lock()
+	seen := map[delegationKey]struct{}{}
+	if m.lastLevel == level {
+		seen = maps.Clone(m.lastKeys)
+	}
+	m.mu.Unlock()
+
+	return func(dlgs []Delegation) error {
+		dlgs = slices.DeleteFunc(slices.Clone(dlgs), func(dlg Delegation) bool {
+			_, ok := seen[keyOf(dlg)]
+			return ok && dlg.Level == level
+		})
+		if len(dlgs) == 0 {
+			return nil
+		}
+		return fn(dlgs)
+	}
+}
+
+// passedLast returns true if the given operation ID is the one of the last delegation
+// passed, by the given upstream.
+func (m *MultiClient) passedLast(up *upstream, id int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastUpstream == up && m.lastID == id
+}
+
+// checked wraps the given page function to cross-check every page fetched from the
+// given upstream against another upstream beforehand, if enabled.
+func (m *MultiClient) checked(ctx context.Context, primary *upstream, fn DelegationPageFunc) DelegationPageFunc {
+	if !m.crossCheck {
+		return fn
+	}
+	return func(dlgs []Delegation) error {
+		m.crossCheckPage(ctx, primary, dlgs)
+		return fn(dlgs)
+	}
+}
+
+// crossCheckPage fetches the delegations of the level range of the given page from the
+// healthy upstream of highest priority other than the primary one, which indexed these
+// levels, and reports any divergence. Pages cannot be checked when no other upstream
+// is available; failures are logged and do not stop ingestion.
+func (m *MultiClient) crossCheckPage(ctx context.Context, primary *upstream, dlgs []Delegation) {
+	if len(dlgs) == 0 {
+		return
+	}
+
+	first, last := dlgs[0].Level, dlgs[0].Level
+	for i := range dlgs {
+		first = min(first, dlgs[i].Level)
+		last = max(last, dlgs[i].Level)
+	}
+
+	m.mu.Lock()
+	var secondary *upstream
+	for _, up := range m.upstreams {
+		if up != primary && up.healthy && up.level >= last {
+			secondary = up
+			break
+		}
+	}
+	m.mu.Unlock()
+	if secondary == nil {
+		return
+	}
+
+	others := []Delegation{}
+	err := secondary.client.StreamDelegationsInLevels(ctx, first, last+1, func(page []Delegation) error {
+		others = append(others, page...)
+		return nil
+	})
+	if err != nil {
+		m.logger.WarnContext(ctx, "cross-check failed", "upstream", secondary.url, "error", err)
+		return
+	}
+
+	div := compareDelegations(dlgs, others, first, last)
+	if len(div.Missing) == 0 && len(div.Extra) == 0 && len(div.Mismatched) == 0 {
+		return
+	}
+	div.Primary, div.Secondary = primary.url, secondary.url
+	if m.onDivergence == nil {
+		m.logDivergence(ctx, div)
+		return
+	}
+	m.onDivergence(div)
+}
+
+// compareDelegations returns the operation hashes differing between the given sets of
+// delegations over the given level range, in ascending order. Operations of the
+// secondary set are only reported as extra within the levels strictly between the
+// first and last ones, since pages may end in the middle of a level.
+func compareDelegations(primary, secondary []Delegation, first, last int32) Divergence {
+	others := make(map[delegationKey]Delegation, len(secondary))
+	for i := range secondary {
+		others[keyOf(secondary[i])] = secondary[i]
+	}
+
+	div := Divergence{FirstLevel: first, LastLevel: last}
+	for i := range primary {
+		other, ok := others[keyOf(primary[i])]
+		switch {
+		case !ok:
+			div.Missing = append(div.Missing, primary[i].Hash)
+		case !sameDelegation(primary[i], other):
+			div.Mismatched = append(div.Mismatched, primary[i].Hash)
+		}
+		delete(others, keyOf(primary[i]))
+	}
+	for _, other := range others {
+		if other.Level > first && other.Level < last {
+			div.Extra = append(div.Extra, other.Hash)
+		}
+	}
+	slices.Sort(div.Missing)
+	slices.Sort(div.Extra)
+	slices.Sort(div.Mismatched)
+
+	return div
+}
+
+// delegationKey identifies a delegation across TzKT instances within its level, an
+// operation group holding at most one delegation per sender.
+type delegationKey struct {
+	hash   string
+	sender string
+}
+
+// keyOf returns the key of the given delegation.
+func keyOf(dlg Delegation) delegationKey {
+	return delegationKey{dlg.Hash, dlg.Sender.Address}
+}
+
+// sameDelegation returns true if the given delegations have the same contents.
+func sameDelegation(a, b Delegation) bool {
+	address := func(acc *Account) string {
+		if acc == nil {
+			return ""
+		}
+		return acc.Address
+	}
+	return a.Hash == b.Hash && a.Block == b.Block && a.Level == b.Level && a.Status == b.Status &&
+		a.Sender.Address == b.Sender.Address && a.Amount == b.Amount &&
+		address(a.PrevDelegate) == address(b.PrevDelegate) && address(a.NewDelegate) == address(b.NewDelegate)
+}
+
+// logDivergence logs divergences as errors, when no divergence function is set.
+func (m *MultiClient) logDivergence(ctx context.Context, div Divergence) {
+	m.logger.ErrorContext(ctx, "TzKT upstreams diverge",
+		"primary", div.Primary, "secondary", div.Secondary, "first_level", div.FirstLevel, "last_level", div.LastLevel,
+		"missing", div.Missing, "extra", div.Extra, "mismatched", div.Mismatched)
+}
@@ -0,0 +1,361 @@
+package tezos_test
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"kiln-tezos-delegation/tezos"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTzkt is a TzKT API serving a head level and delegations.
+type fakeTzkt struct {
+	head        int32
+	headStatus  int
+	delegations string
+	delegStatus int
+	delegCalls  atomic.Int32
+	// switched during tests: delegations reply with HTTP-503
+	delegFailing atomic.Bool
+	// queries of the delegations calls
+	mu           sync.Mutex
+	delegQueries []url.Values
+	// switched during tests: head replies with HTTP-502, or never replies
+	headFailing atomic.Bool
+	headHanging atomic.Bool
+}
+
+// start serves the fake API until the end of the test, and returns its base URL.
+func (f *fakeTzkt) start(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/head":
+			if f.headHanging.Load() {
+				<-r.Context().Done()
+				return
+			}
+			if f.headFailing.Load() {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			if f.headStatus != 0 {
+				w.WriteHeader(f.headStatus)
+				return
+			}
+			w.Write([]byte(`{"level":` + strconv.Itoa(int(f.head)) + `}`))
+		case "/v1/operations/delegations":
+			f.delegCalls.Add(1)
+			f.mu.Lock()
+			f.delegQueries = append(f.delegQueries, r.URL.Query())
+			f.mu.Unlock()
+			if f.delegStatus != 0 || f.delegFailing.Load() {
+				w.WriteHeader(cmp.Or(f.delegStatus, http.StatusServiceUnavailable))
+				return
+			}
+			w.Write([]byte(f.delegations))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/"
+}
+
+// queries returns the queries of the delegations calls.
+func (f *fakeTzkt) queries() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.delegQueries)
+}
+
+func TestMultiClient(t *testing.T) {
+	dlgs := `[{"id":42,"level":242,"hash":"op1","block":"hash1","sender":{"address":"addr1"}}]`
+	since := time.Date(2024, 06, 25, 10, 02, 33, 0, time.UTC)
+	opts := []tezos.ClientOption{noRetry}
+
+	stream := func(client *tezos.MultiClient) ([]tezos.Delegation, error) {
+		got := []tezos.Delegation{}
+		err := client.StreamDelegationsSince(context.Background(), since, func(page []tezos.Delegation) error {
+			got = append(got, page...)
+			return nil
+		})
+		return got, err
+	}
+
+	t.Run("uses upstream of highest priority when up to date", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegations: dlgs}
+		secondary := &fakeTzkt{head: 1001, delegations: dlgs}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts)
+		require.NoError(t, err)
+
+		got, err := stream(client)
+
+		assert.NoError(t, err)
+		assert.Len(t, got, 1)
+		assert.Equal(t, int32(1), primary.delegCalls.Load())
+		assert.Equal(t, int32(0), secondary.delegCalls.Load())
+	})
+
+	t.Run("fails over when upstream lags behind", func(t *testing.T) {
+		primary := &fakeTzkt{head: 990, delegations: dlgs}
+		secondary := &fakeTzkt{head: 1000, delegations: dlgs}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts, tezos.WithMaxLag(5))
+		require.NoError(t, err)
+
+		_, err = stream(client)
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), primary.delegCalls.Load())
+		assert.Equal(t, int32(1), secondary.delegCalls.Load())
+	})
+
+	t.Run("fails over when upstream head is unavailable", func(t *testing.T) {
+		primary := &fakeTzkt{headStatus: http.StatusBadGateway, delegations: dlgs}
+		secondary := &fakeTzkt{head: 1000, delegations: dlgs}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts)
+		require.NoError(t, err)
+
+		_, err = stream(client)
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), primary.delegCalls.Load())
+		assert.Equal(t, int32(1), secondary.delegCalls.Load())
+	})
+
+	t.Run("fails over when call fails", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegStatus: http.StatusServiceUnavailable}
+		secondary := &fakeTzkt{head: 1000, delegations: dlgs}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts)
+		require.NoError(t, err)
+
+		got, err := stream(client)
+		assert.NoError(t, err)
+		assert.Len(t, got, 1)
+
+		// failed upstream is avoided until next check
+		_, err = stream(client)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(1), primary.delegCalls.Load())
+		assert.Equal(t, int32(2), secondary.delegCalls.Load())
+	})
+
+	t.Run("returns last error when every upstream fails", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegStatus: http.StatusServiceUnavailable}
+		secondary := &fakeTzkt{head: 1000, delegStatus: http.StatusInternalServerError}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts)
+		require.NoError(t, err)
+
+		_, err = stream(client)
+
+		assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+		assert.Equal(t, int32(1), primary.delegCalls.Load())
+		assert.Equal(t, int32(1), secondary.delegCalls.Load())
+	})
+
+	t.Run("uses upstream again after head check timeout while circuit is half-open", func(t *testing.T) {
+		tezos.SetUpstreamCheck(t, 0, 50*time.Millisecond)
+		primary := &fakeTzkt{head: 1000, delegations: dlgs}
+		secondary := &fakeTzkt{head: 1000, delegations: dlgs}
+		primary.headFailing.Store(true)
+
+		breaker := tezos.WithRetryPolicy(tezos.RetryPolicy{
+			MaxAttempts:      1,
+			BreakerThreshold: 1,
+			BreakerCooldown:  50 * time.Millisecond,
+		})
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, []tezos.ClientOption{breaker})
+		require.NoError(t, err)
+
+		// head check fails, circuit opens
+		_, err = stream(client)
+		require.NoError(t, err)
+		require.Equal(t, int32(0), primary.delegCalls.Load())
+
+		// head check is the trial request after cooldown, and times out
+		time.Sleep(75 * time.Millisecond)
+		primary.headFailing.Store(false)
+		primary.headHanging.Store(true)
+		_, err = stream(client)
+		require.NoError(t, err)
+		require.Equal(t, int32(0), primary.delegCalls.Load())
+
+		// next head check is a trial request again, and closes the circuit
+		primary.headHanging.Store(false)
+		_, err = stream(client)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(1), primary.delegCalls.Load())
+	})
+
+	t.Run("does not fail over on page function error", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegations: dlgs}
+		secondary := &fakeTzkt{head: 1000, delegations: dlgs}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts)
+		require.NoError(t, err)
+
+		err = client.StreamDelegationsSince(context.Background(), since, func([]tezos.Delegation) error {
+			return errors.New("fake database error")
+		})
+
+		assert.Error(t, err)
+		assert.Equal(t, int32(0), secondary.delegCalls.Load())
+	})
+
+	t.Run("resumes from level on fail over", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegStatus: http.StatusServiceUnavailable}
+		secondary := &fakeTzkt{head: 1000, delegations: dlgs}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts)
+		require.NoError(t, err)
+
+		// operation ID of the checkpoint was not passed by the secondary upstream
+		got := []tezos.Delegation{}
+		err = client.StreamDelegationsAfter(context.Background(), 4242, 241, func(page []tezos.Delegation) error {
+			got = append(got, page...)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, got, 1)
+
+		// operation ID of the checkpoint was passed last by the secondary upstream
+		err = client.StreamDelegationsAfter(context.Background(), got[0].ID, got[0].Level, func([]tezos.Delegation) error {
+			return nil
+		})
+		require.NoError(t, err)
+
+		queries := secondary.queries()
+		require.Len(t, queries, 2)
+		assert.Equal(t, "241", queries[0].Get("level.ge"))
+		assert.False(t, queries[0].Has("id.gt"))
+		assert.Equal(t, "42", queries[1].Get("id.gt"))
+		assert.False(t, queries[1].Has("level.ge"))
+		assert.Equal(t, "241", primary.queries()[0].Get("level.ge"))
+	})
+
+	t.Run("skips delegations of checkpoint level already passed on fail over", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegations: `[
+			{"id":42,"level":241,"hash":"op1","block":"hash1","sender":{"address":"addr1"}},
+			{"id":43,"level":241,"hash":"op2","block":"hash1","sender":{"address":"addr2"}}
+		]`}
+		// operation IDs differ, op3 of the checkpoint level was not passed yet
+		secondary := &fakeTzkt{head: 1000, delegations: `[
+			{"id":1042,"level":241,"hash":"op1","block":"hash1","sender":{"address":"addr1"}},
+			{"id":1043,"level":241,"hash":"op2","block":"hash1","sender":{"address":"addr2"}},
+			{"id":1044,"level":241,"hash":"op3","block":"hash1","sender":{"address":"addr3"}},
+			{"id":1045,"level":242,"hash":"op4","block":"hash2","sender":{"address":"addr4"}}
+		]`}
+
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts)
+		require.NoError(t, err)
+
+		passed, err := stream(client)
+		require.NoError(t, err)
+		require.Len(t, passed, 2)
+
+		primary.delegFailing.Store(true)
+		got := []tezos.Delegation{}
+		err = client.StreamDelegationsAfter(context.Background(), 43, 241, func(page []tezos.Delegation) error {
+			got = append(got, page...)
+			return nil
+		})
+
+		require.NoError(t, err)
+		require.Len(t, got, 2)
+		assert.Equal(t, "op3", got[0].Hash)
+		assert.Equal(t, "op4", got[1].Hash)
+		assert.Equal(t, "241", secondary.queries()[0].Get("level.ge"))
+	})
+
+	t.Run("reports divergence on cross-check", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegations: `[
+			{"id":42,"level":241,"hash":"op1","block":"hash1","sender":{"address":"addr1"}},
+			{"id":43,"level":243,"hash":"op3","block":"hash3","sender":{"address":"addr3"}},
+			{"id":44,"level":243,"hash":"op3","block":"hash3","sender":{"address":"addr6"}},
+			{"id":45,"level":243,"hash":"op4","block":"hash3","sender":{"address":"addr4"}}
+		]`}
+		// operation IDs differ, and operations of boundary levels may be on other pages.
+		// Operation op3 holds delegations of two contracts.
+		secondary := &fakeTzkt{head: 1000, delegations: `[
+			{"id":1040,"level":240,"hash":"op0","block":"hash0","sender":{"address":"addr0"}},
+			{"id":1042,"level":241,"hash":"op1","block":"hash1bis","sender":{"address":"addr1"}},
+			{"id":1043,"level":242,"hash":"op2","block":"hash2","sender":{"address":"addr2"}},
+			{"id":1044,"level":243,"hash":"op3","block":"hash3","sender":{"address":"addr3"}},
+			{"id":1045,"level":243,"hash":"op3","block":"hash3","sender":{"address":"addr6"}},
+			{"id":1046,"level":243,"hash":"op5","block":"hash3","sender":{"address":"addr5"}}
+		]`}
+
+		divs := []tezos.Divergence{}
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts,
+			tezos.WithCrossCheck(func(div tezos.Divergence) { divs = append(divs, div) }))
+		require.NoError(t, err)
+
+		got, err := stream(client)
+
+		assert.NoError(t, err)
+		assert.Len(t, got, 4)
+		require.Len(t, divs, 1)
+		assert.Equal(t, int32(241), divs[0].FirstLevel)
+		assert.Equal(t, int32(243), divs[0].LastLevel)
+		assert.Equal(t, []string{"op1"}, divs[0].Mismatched)
+		assert.Equal(t, []string{"op2"}, divs[0].Extra)
+		assert.Equal(t, []string{"op4"}, divs[0].Missing)
+
+		queries := secondary.queries()
+		require.Len(t, queries, 1)
+		assert.Equal(t, "241", queries[0].Get("level.ge"))
+		assert.Equal(t, "244", queries[0].Get("level.lt"))
+	})
+
+	t.Run("reports no divergence on identical cross-check", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegations: dlgs}
+		secondary := &fakeTzkt{head: 1000, delegations: dlgs}
+
+		divs := []tezos.Divergence{}
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts,
+			tezos.WithCrossCheck(func(div tezos.Divergence) { divs = append(divs, div) }))
+		require.NoError(t, err)
+
+		_, err = stream(client)
+
+		assert.NoError(t, err)
+		assert.Empty(t, divs)
+		assert.Equal(t, int32(1), secondary.delegCalls.Load())
+	})
+
+	t.Run("skips cross-check when other upstream lags behind the page", func(t *testing.T) {
+		primary := &fakeTzkt{head: 1000, delegations: dlgs}
+		secondary := &fakeTzkt{head: 200, delegations: `[]`}
+
+		divs := []tezos.Divergence{}
+		client, err := tezos.NewMultiClient([]string{primary.start(t), secondary.start(t)}, opts,
+			tezos.WithMaxLag(1000), tezos.WithCrossCheck(func(div tezos.Divergence) { divs = append(divs, div) }))
+		require.NoError(t, err)
+
+		_, err = stream(client)
+
+		assert.NoError(t, err)
+		assert.Empty(t, divs)
+		assert.Equal(t, int32(0), secondary.delegCalls.Load())
+	})
+
+	t.Run("error without base URL", func(t *testing.T) {
+		_, err := tezos.NewMultiClient([]string{}, opts)
+		assert.Error(t, err)
+	})
+}
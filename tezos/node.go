@@ -0,0 +1,407 @@
+package tezos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// nodeIDLevelShift is the number of bits of operation IDs given by NodeClient holding
+// the position of delegations within their block, the higher bits holding the level.
+const nodeIDLevelShift = 20
+
+// variables for testing purposes
+var (
+	// nodeMaxBlockDelegations is the number of delegations within a block which operation
+	// IDs do not overlap the ones of the next level.
+	nodeMaxBlockDelegations = 1 << nodeIDLevelShift
+)
+
+// errNodeNotFound is returned by the node RPC for unknown blocks and contracts.
+var errNodeNotFound = errors.New("not found by Tezos node")
+
+// NodeClient is a Tezos node (Octez) RPC client, reading delegations from the blocks
+// of the main chain instead of relying on an indexer. It is swappable with Client.
+//
+// The node RPC has no operation IDs: delegations are given IDs made of their level
+// and of their position within their block, increasing the same way as TzKT ones
+// but not comparable with them. Amounts are the balances of the senders as of the
+// end of the block holding the delegation.
+type NodeClient struct {
+	// HTTP client
+	client http.Client
+	// Base URL of the node RPC
+	baseURL string
+	// Maximum number of delegations passed per page when streaming
+	pageSize int
+}
+
+// nodeBlockHeader is the header of a block, as returned by the node RPC.
+type nodeBlockHeader struct {
+	Hash        string    `json:"hash"`
+	Predecessor string    `json:"predecessor"`
+	Level       int32     `json:"level"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// nodeOperation is an operation of a block, as returned by the node RPC. Only fields
+// related to delegations are decoded.
+type nodeOperation struct {
+	Hash     string `json:"hash"`
+	Contents []struct {
+		Kind     string `json:"kind"`
+		Source   string `json:"source"`
+		Fee      string `json:"fee"`
+		Delegate string `json:"delegate"`
+		Metadata struct {
+			OperationResult struct {
+				Status string `json:"status"`
+			} `json:"operation_result"`
+			InternalOperationResults []struct {
+				Kind     string `json:"kind"`
+				Source   string `json:"source"`
+				Delegate string `json:"delegate"`
+				Result   struct {
+					Status string `json:"status"`
+				} `json:"result"`
+			} `json:"internal_operation_results"`
+		} `json:"metadata"`
+	} `json:"contents"`
+}
+
+// NewNodeClient creates a new node RPC client and returns an error if the base URL
+// passed is invalid. Client options apply the same way as for Client, the page size
+// being the maximum number of delegations passed per page when streaming.
+// The duration and status code of every attempt are recorded as metrics, as for Client.
+func NewNodeClient(baseURL string, opts ...ClientOption) (NodeClient, error) {
+	if _, err := url.Parse(baseURL + "chains/main/blocks/head/header"); err != nil {
+		return NodeClient{}, err
+	}
+
+	o := newClientOptions(metricsTransport{next: http.DefaultTransport, routes: nodeRoutes}, opts)
+
+	return NodeClient{
+		client:   o.httpClient(),
+		baseURL:  baseURL,
+		pageSize: o.pageSize,
+	}, nil
+}
+
+// GetCurrentProtocolTimeBetweenBlocks calls the "/context/constants" endpoint of the
+// head block and returns the "minimal_block_delay" constant.
+// Returns the underlying HTTP client errors, or any issues related to response processing.
+func (c NodeClient) GetCurrentProtocolTimeBetweenBlocks(ctx context.Context) (time.Duration, error) {
+	payload := struct {
+		MinimalBlockDelay string `json:"minimal_block_delay"`
+	}{}
+	if err := c.getJSON(ctx, c.blockURL("head", "context/constants"), &payload); err != nil {
+		return 0, err
+	}
+
+	secs, err := strconv.ParseInt(payload.MinimalBlockDelay, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid minimal block delay: %w", err)
+	}
+
+	return time.Duration(secs) * time.Second, nil
+}
+
+// GetHeadLevel calls the "/header" endpoint of the head block and returns its level.
+// Returns the underlying HTTP client errors, or any issues related to response processing.
+func (c NodeClient) GetHeadLevel(ctx context.Context) (int32, error) {
+	header, err := c.getHeader(ctx, "head")
+	if err != nil {
+		return 0, err
+	}
+	return header.Level, nil
+}
+
+// StreamDelegationsSince passes delegations of the blocks which timestamps are greater
+// or equal to the time passed as parameter to the given function, oldest first, until
+// the head block. The first block is found by binary search over block headers.
+// Returns the underlying HTTP client errors, any issues related to response processing,
+// or the error returned by the page function.
+func (c NodeClient) StreamDelegationsSince(ctx context.Context, since time.Time, fn DelegationPageFunc) error {
+	from, err := c.firstLevelSince(ctx, since)
+	if err != nil {
+		return err
+	}
+	return c.streamDelegations(ctx, from, math.MaxInt32, 0, fn)
+}
+
+// StreamDelegationsAfter passes delegations which operation IDs, as given by this
+// client, are greater than the one passed as parameter to the given function, oldest
+// first, until the head block. The level of the block of that operation is not needed,
+// since operation IDs start with it.
+// Returns the underlying HTTP client errors, any issues related to response processing,
+// or the error returned by the page function.
+func (c NodeClient) StreamDelegationsAfter(ctx context.Context, id int64, _ int32, fn DelegationPageFunc) error {
+	return c.streamDelegations(ctx, int32(id>>nodeIDLevelShift), math.MaxInt32, id, fn)
+}
+
+// StreamDelegationsInLevels passes delegations of the blocks within the [from, to[
+// level range to the given function, oldest first. Levels above the head block are
+// ignored.
+// Returns the underlying HTTP client errors, any issues related to response processing,
+// or the error returned by the page function.
+func (c NodeClient) StreamDelegationsInLevels(ctx context.Context, from, to int32, fn DelegationPageFunc) error {
+	return c.streamDelegations(ctx, from, to, 0, fn)
+}
+
+// GetBlockHashes calls the "/hash" endpoint of the blocks at the given levels and
+// returns their hashes, by level. Levels having no block are missing from the
+// returned map.
+// Returns the underlying HTTP client errors, or any issues related to response processing.
+func (c NodeClient) GetBlockHashes(ctx context.Context, levels []int32) (map[int32]string, error) {
+	hashes := make(map[int32]string, len(levels))
+	for _, level := range levels {
+		var hash string
+		err := c.getJSON(ctx, c.blockURL(strconv.Itoa(int(level)), "hash"), &hash)
+		if errors.Is(err, errNodeNotFound) {
+			continue
+		}
+		if err != nil {
+			return map[int32]string{}, err
+		}
+		hashes[level] = hash
+	}
+	return hashes, nil
+}
+
+// firstLevelSince returns the level of the first block which timestamp is greater or
+// equal to the given time, or the level following the head block if there is none.
+func (c NodeClient) firstLevelSince(ctx context.Context, since time.Time) (int32, error) {
+	head, err := c.getHeader(ctx, "head")
+	if err != nil {
+		return 0, err
+	}
+	if head.Timestamp.Before(since) {
+		return head.Level + 1, nil
+	}
+
+	// the block at level hi is always at or after the given time
+	lo, hi := int32(1), head.Level
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		header, err := c.getHeader(ctx, strconv.Itoa(int(mid)))
+		if err != nil {
+			return 0, err
+		}
+		if header.Timestamp.Before(since) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// streamDelegations reads the blocks within the [from, to[ level range, stopping at
+// the first level above the head block, and passes their delegations which IDs are
+// greater than the given one to the given function, by pages of at most the
+// configured page size. Blocks are never split across pages.
+// Returns an error if a block up to the head one is not available, e.g. pruned by a
+// node in rolling mode.
+func (c NodeClient) streamDelegations(ctx context.Context, from, to int32, after int64, fn DelegationPageFunc) error {
+	page := []Delegation{}
+	for level := max(from, 1); level < to; level++ {
+		dlgs, err := c.getBlockDelegations(ctx, level)
+		if errors.Is(err, errNodeNotFound) {
+			head, herr := c.GetHeadLevel(ctx)
+			if herr != nil {
+				return herr
+			}
+			if level <= head {
+				return fmt.Errorf("block at level %d not available below head level %d, node may be pruned: %w", level, head, err)
+			}
+			// caught up with the head block
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range dlgs {
+			if dlgs[i].ID > after {
+				page = append(page, dlgs[i])
+			}
+		}
+
+		if len(page) >= c.pageSize {
+			if err := fn(page); err != nil {
+				return err
+			}
+			page = []Delegation{}
+		}
+	}
+
+	if len(page) > 0 {
+		return fn(page)
+	}
+	return nil
+}
+
+// getBlockDelegations returns the delegations of the block at the given level, top
+// level ones and the ones emitted by smart contracts, in the order of the block.
+// Balances and previous delegates of senders are resolved from the context of the
+// block and of its predecessor.
+// Returns errNodeNotFound if there is no block at this level.
+func (c NodeClient) getBlockDelegations(ctx context.Context, level int32) ([]Delegation, error) {
+	header, err := c.getHeader(ctx, strconv.Itoa(int(level)))
+	if err != nil {
+		return []Delegation{}, err
+	}
+
+	// further calls address the block by hash to stay consistent over reorganisations
+	passes := [][]nodeOperation{}
+	if err := c.getJSON(ctx, c.blockURL(header.Hash, "operations"), &passes); err != nil {
+		return []Delegation{}, err
+	}
+
+	dlgs := []Delegation{}
+	for _, ops := range passes {
+		for _, op := range ops {
+			for _, content := range op.Contents {
+				if content.Kind == "delegation" {
+					fee, err := strconv.ParseInt(content.Fee, 10, 64)
+					if err != nil {
+						return []Delegation{}, fmt.Errorf("invalid fee of operation %s: %w", op.Hash, err)
+					}
+					dlgs = append(dlgs, Delegation{
+						Hash:        op.Hash,
+						Status:      content.Metadata.OperationResult.Status,
+						Sender:      Account{Address: content.Source},
+						BakerFee:    fee,
+						NewDelegate: nodeAccount(content.Delegate),
+					})
+				}
+				for _, internal := range content.Metadata.InternalOperationResults {
+					if internal.Kind == "delegation" {
+						dlgs = append(dlgs, Delegation{
+							Hash:        op.Hash,
+							Status:      internal.Result.Status,
+							Sender:      Account{Address: internal.Source},
+							NewDelegate: nodeAccount(internal.Delegate),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	if len(dlgs) > nodeMaxBlockDelegations {
+		return []Delegation{}, fmt.Errorf("block %s holds %d delegations, operation IDs are only available for %d",
+			header.Hash, len(dlgs), nodeMaxBlockDelegations)
+	}
+
+	// delegates of senders which already delegated within the block
+	delegates := map[string]*Account{}
+	for i := range dlgs {
+		dlgs[i].ID = int64(level)<<nodeIDLevelShift | int64(i)
+		dlgs[i].Level = header.Level
+		dlgs[i].Block = header.Hash
+		dlgs[i].Timestamp = header.Timestamp
+
+		sender := dlgs[i].Sender.Address
+		dlgs[i].Amount, err = c.getBalance(ctx, header.Hash, sender)
+		if err != nil {
+			return []Delegation{}, err
+		}
+
+		if prev, ok := delegates[sender]; ok {
+			dlgs[i].PrevDelegate = prev
+		} else {
+			dlgs[i].PrevDelegate, err = c.getDelegate(ctx, header.Predecessor, sender)
+			if err != nil {
+				return []Delegation{}, err
+			}
+		}
+		if dlgs[i].Status == "applied" {
+			delegates[sender] = dlgs[i].NewDelegate
+		} else {
+			delegates[sender] = dlgs[i].PrevDelegate
+		}
+	}
+
+	return dlgs, nil
+}
+
+// getHeader returns the header of the given block, by level, hash or alias.
+func (c NodeClient) getHeader(ctx context.Context, block string) (nodeBlockHeader, error) {
+	header := nodeBlockHeader{}
+	if err := c.getJSON(ctx, c.blockURL(block, "header"), &header); err != nil {
+		return nodeBlockHeader{}, err
+	}
+	return header, nil
+}
+
+// getBalance returns the balance of the given contract as of the given block, zero if
+// the contract does not exist.
+func (c NodeClient) getBalance(ctx context.Context, block, address string) (int64, error) {
+	var balance string
+	err := c.getJSON(ctx, c.blockURL(block, "context/contracts/"+address+"/balance"), &balance)
+	if errors.Is(err, errNodeNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(balance, 10, 64)
+}
+
+// getDelegate returns the delegate of the given contract as of the given block, nil if
+// it has none or does not exist.
+func (c NodeClient) getDelegate(ctx context.Context, block, address string) (*Account, error) {
+	var delegate string
+	err := c.getJSON(ctx, c.blockURL(block, "context/contracts/"+address+"/delegate"), &delegate)
+	if errors.Is(err, errNodeNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nodeAccount(delegate), nil
+}
+
+// blockURL returns the URL of the given endpoint of the given block of the main chain.
+func (c NodeClient) blockURL(block, endpoint string) string {
+	return c.baseURL + "chains/main/blocks/" + block + "/" + endpoint
+}
+
+// getJSON calls the given URL and decodes the JSON response into the given value.
+// Returns errNodeNotFound on HTTP-404 responses.
+func (c NodeClient) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusNotFound:
+		return errNodeNotFound
+	default:
+		return fmt.Errorf("bad HTTP status: %d", resp.StatusCode)
+	}
+}
+
+// nodeAccount returns a reference to the given account, nil if the address is empty.
+func nodeAccount(address string) *Account {
+	if address == "" {
+		return nil
+	}
+	return &Account{Address: address}
+}
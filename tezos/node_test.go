@@ -0,0 +1,227 @@
+package tezos_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/tezos"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNodeStub serves the node RPC responses recorded under testdata/node, by request
+// path, and responds with HTTP-404 to other requests, and to the ones which paths
+// start with any of the given prefixes.
+func newNodeStub(t *testing.T, missing ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := os.ReadFile(filepath.Join("testdata", "node", filepath.FromSlash(r.URL.Path)+".json"))
+		if slices.ContainsFunc(missing, func(prefix string) bool { return strings.HasPrefix(r.URL.Path, prefix) }) {
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNodeClient(t *testing.T) {
+	const (
+		baker1   = "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx"
+		baker2   = "tz1gjaF81ZRRvdzjobyfVNsAeSC6PScjfQwN"
+		alice    = "tz1b7tUupMgCNw2cCLpKTkSD1NZzB5TkP2sv"
+		bob      = "tz1ddb9NMYHZi5UzPdzTZMYQQZoMub195zgv"
+		contract = "KT1BEqzn5Wx8uJrZNvuS9DVHmLvG9td3fDLi"
+		block2   = "BMUe8zLHwbQmXvfE7kT9XUDmzT8RqEgoLhCbGscnMPTumgqkDG5"
+		block4   = "BM4xVt1q5VRVTBHZbKMs6HpmD2yG5QtPj3qDBRBZGN1pV9S8xYa"
+	)
+	// delegations recorded from a sandbox chain of 4 blocks
+	all := []tezos.Delegation{
+		{
+			ID: 2 << 20, Level: 2, Block: block2, Timestamp: time.Date(2024, 06, 25, 10, 0, 8, 0, time.UTC),
+			Hash: "onyUK7dTVCGGFgrLmUy2cvdDvpxNSK8GTYqzzHtCakfs8pfpHSw", Status: "applied",
+			Sender: tezos.Account{Address: alice}, Amount: 4000999272, BakerFee: 397,
+			NewDelegate: &tezos.Account{Address: baker1},
+		},
+		{
+			ID: 4 << 20, Level: 4, Block: block4, Timestamp: time.Date(2024, 06, 25, 10, 0, 24, 0, time.UTC),
+			Hash: "oo2iYKaZQrDj8j4zrBcTE2TN5Rmqe8eSoHqFkhYBMfbEXkL3yzU", Status: "applied",
+			Sender: tezos.Account{Address: alice}, Amount: 4000998972, BakerFee: 300,
+			PrevDelegate: &tezos.Account{Address: baker1}, NewDelegate: &tezos.Account{Address: baker2},
+		},
+		{
+			ID: 4<<20 | 1, Level: 4, Block: block4, Timestamp: time.Date(2024, 06, 25, 10, 0, 24, 0, time.UTC),
+			Hash: "opBeWMsHZHwvLvMC6ndJVJbNr2xpFQdpBrMbvR5AEHw5xZ9fdVJ", Status: "failed",
+			Sender: tezos.Account{Address: bob}, Amount: 3998997978, BakerFee: 283,
+		},
+		{
+			ID: 4<<20 | 2, Level: 4, Block: block4, Timestamp: time.Date(2024, 06, 25, 10, 0, 24, 0, time.UTC),
+			Hash: "ooVxBVQsGXqzHcdPFAz5h6ibTWNqxXqFUKrZxvsBq5q9XUoNpMd", Status: "applied",
+			Sender: tezos.Account{Address: contract}, Amount: 25000000,
+			NewDelegate: &tezos.Account{Address: baker1},
+		},
+	}
+
+	// collect returns a page function appending pages to the given slice.
+	collect := func(pages *[][]tezos.Delegation) tezos.DelegationPageFunc {
+		return func(dlgs []tezos.Delegation) error {
+			*pages = append(*pages, dlgs)
+			return nil
+		}
+	}
+
+	server := newNodeStub(t)
+	cli, err := tezos.NewNodeClient(server.URL+"/", noRetry)
+	require.NoError(t, err)
+
+	t.Run("gets minimal block delay of head block", func(t *testing.T) {
+		delay, err := cli.GetCurrentProtocolTimeBetweenBlocks(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, 8*time.Second, delay)
+	})
+
+	t.Run("gets head level", func(t *testing.T) {
+		level, err := cli.GetHeadLevel(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(4), level)
+	})
+
+	t.Run("streams delegations within level range", func(t *testing.T) {
+		pages := [][]tezos.Delegation{}
+		err := cli.StreamDelegationsInLevels(context.Background(), 1, 100, collect(&pages))
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]tezos.Delegation{all}, pages)
+	})
+
+	t.Run("streams delegations within level range excluding upper bound", func(t *testing.T) {
+		pages := [][]tezos.Delegation{}
+		err := cli.StreamDelegationsInLevels(context.Background(), 2, 4, collect(&pages))
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]tezos.Delegation{all[:1]}, pages)
+	})
+
+	t.Run("returns error when block below head is missing", func(t *testing.T) {
+		pruned := newNodeStub(t, "/chains/main/blocks/2/")
+		cli, err := tezos.NewNodeClient(pruned.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		pages := [][]tezos.Delegation{}
+		err = cli.StreamDelegationsInLevels(context.Background(), 1, 100, collect(&pages))
+
+		assert.ErrorContains(t, err, "block at level 2 not available below head level 4")
+		assert.Empty(t, pages)
+	})
+
+	t.Run("returns error when block holds too many delegations", func(t *testing.T) {
+		tezos.SetNodeMaxBlockDelegations(t, 2)
+
+		pages := [][]tezos.Delegation{}
+		err := cli.StreamDelegationsInLevels(context.Background(), 4, 5, collect(&pages))
+
+		assert.ErrorContains(t, err, "block "+block4+" holds 3 delegations")
+		assert.Empty(t, pages)
+	})
+
+	t.Run("records request metrics by route", func(t *testing.T) {
+		stub := newNodeStub(t)
+		cli, err := tezos.NewNodeClient(stub.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{2})
+		require.NoError(t, err)
+		_, err = cli.GetHeadLevel(context.Background())
+		require.NoError(t, err)
+
+		host := stub.Listener.Addr().String()
+		assert.ElementsMatch(t, []map[string]string{
+			{"host": host, "endpoint": "/chains/main/blocks/{block}/hash", "code": "200"},
+			{"host": host, "endpoint": "/chains/main/blocks/{block}/header", "code": "200"},
+		}, requestLabels(t, host))
+	})
+
+	t.Run("streams delegations after operation ID", func(t *testing.T) {
+		pages := [][]tezos.Delegation{}
+		err := cli.StreamDelegationsAfter(context.Background(), all[1].ID, all[1].Level, collect(&pages))
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]tezos.Delegation{all[2:]}, pages)
+	})
+
+	t.Run("streams delegations since time", func(t *testing.T) {
+		pages := [][]tezos.Delegation{}
+		err := cli.StreamDelegationsSince(context.Background(), time.Date(2024, 06, 25, 10, 0, 9, 0, time.UTC), collect(&pages))
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]tezos.Delegation{all[1:]}, pages)
+	})
+
+	t.Run("streams nothing since time after head block", func(t *testing.T) {
+		pages := [][]tezos.Delegation{}
+		err := cli.StreamDelegationsSince(context.Background(), time.Date(2024, 06, 25, 10, 1, 0, 0, time.UTC), collect(&pages))
+
+		assert.NoError(t, err)
+		assert.Empty(t, pages)
+	})
+
+	t.Run("does not split blocks across pages", func(t *testing.T) {
+		cli, err := tezos.NewNodeClient(server.URL+"/", tezos.WithPageSize(1), noRetry)
+		require.NoError(t, err)
+
+		pages := [][]tezos.Delegation{}
+		err = cli.StreamDelegationsInLevels(context.Background(), 1, 100, collect(&pages))
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]tezos.Delegation{all[:1], all[1:]}, pages)
+	})
+
+	t.Run("stops streaming on page function error", func(t *testing.T) {
+		cli, err := tezos.NewNodeClient(server.URL+"/", tezos.WithPageSize(1), noRetry)
+		require.NoError(t, err)
+
+		calls := 0
+		err = cli.StreamDelegationsInLevels(context.Background(), 1, 100, func([]tezos.Delegation) error {
+			calls++
+			return errors.New("fake database error")
+		})
+
+		assert.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("gets block hashes", func(t *testing.T) {
+		hashes, err := cli.GetBlockHashes(context.Background(), []int32{2, 4, 5})
+
+		assert.NoError(t, err)
+		assert.Equal(t, map[int32]string{2: block2, 4: block4}, hashes)
+	})
+
+	t.Run("returns error on bad status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		cli, err := tezos.NewNodeClient(server.URL+"/", noRetry)
+		require.NoError(t, err)
+
+		err = cli.StreamDelegationsInLevels(context.Background(), 1, 100, collect(&[][]tezos.Delegation{}))
+
+		assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+	})
+}
@@ -0,0 +1,89 @@
+package tezos
+
+import (
+	"sync"
+	"time"
+)
+
+// progress is the progress of ingestion, reported while ingesting. Changes are
+// recorded as metrics. It is safe from concurrency.
+type progress struct {
+	mu sync.Mutex
+	// End time of the last successful cycle, zero if none
+	lastSuccess time.Time
+	// Level up to which every delegation is stored, zero if unknown
+	synced int32
+	// Head level of the data source as of the last check, zero if unknown
+	head int32
+}
+
+// reset forgets the levels known from a previous run, which may be outdated. The end
+// time of the last successful cycle is kept.
+func (p *progress) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.synced = 0
+	p.head = 0
+}
+
+// start sets the level up to which every delegation is known to be stored.
+func (p *progress) start(level int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.synced = level
+	p.observe()
+}
+
+// observeHead records the head level of the data source.
+func (p *progress) observeHead(head int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.head = head
+	p.observe()
+}
+
+// succeed records a successful cycle, after which every delegation up to the given
+// level is stored.
+func (p *progress) succeed(level int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSuccess = time.Now()
+	p.synced = max(p.synced, level)
+	p.observe()
+}
+
+// rewind records that delegations from the given level were deleted.
+func (p *progress) rewind(level int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.synced = max(min(p.synced, level-1), 0)
+	p.observe()
+}
+
+// lag returns the number of levels between the head of the data source and the
+// level up to which every delegation is stored, false if either is unknown.
+func (p *progress) lag() (int32, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.head == 0 || p.synced == 0 {
+		return 0, false
+	}
+	return max(p.head-p.synced, 0), true
+}
+
+// success returns the end time of the last successful cycle, zero if none.
+func (p *progress) success() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSuccess
+}
+
+// observe records the progress as metrics. The mutex must be held.
+func (p *progress) observe() {
+	if p.head != 0 {
+		headLevel.Set(float64(p.head))
+	}
+	if p.head != 0 && p.synced != 0 {
+		headLag.Set(float64(max(p.head-p.synced, 0)))
+	}
+}
@@ -0,0 +1,67 @@
+package tezos
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of requests so that at most one request starts per
+// interval, whatever the number of concurrent callers and of clients sharing it.
+type RateLimiter struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// Earliest start time of the next request
+	slot time.Time
+}
+
+// NewRateLimiter creates a rate limiter allowing the given number of requests per
+// second. Returns nil, which disables the limit, for non-positive values.
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait waits for the next free slot, or for context to be cancelled. Returns the
+// context error in that later case.
+func (l *RateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.slot
+	if start.Before(now) {
+		start = now
+	}
+	l.slot = start.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay := time.Until(start); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// rateLimitedTransport is an HTTP transport delaying requests with a rate limiter,
+// possibly shared with other transports.
+type rateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *RateLimiter
+}
+
+// RoundTrip waits for the next free slot, or for the request context to be cancelled,
+// then executes the request with the underlying transport.
+func (t rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,81 @@
+package tezos
+
+import (
+	"kiln-tezos-delegation/repository"
+	"slices"
+)
+
+// reorgWindow is the number of most recent levels, holding stored delegations,
+// checked for chain reorganisations.
+const reorgWindow = 16
+
+// reorgTracker keeps the blocks of the most recent levels holding stored
+// delegations, in order to detect that they were reorganised away.
+// It is not safe from concurrency.
+type reorgTracker struct {
+	size   int
+	blocks map[int32]repository.Block
+}
+
+func newReorgTracker(size int) *reorgTracker {
+	return &reorgTracker{
+		size:   size,
+		blocks: make(map[int32]repository.Block, size),
+	}
+}
+
+// track records the given block, then forgets the lowest levels exceeding the
+// tracker size.
+func (t *reorgTracker) track(blk repository.Block) {
+	t.blocks[blk.Level] = blk
+	if len(t.blocks) <= t.size {
+		return
+	}
+	levels := t.levels()
+	for _, level := range levels[:len(levels)-t.size] {
+		delete(t.blocks, level)
+	}
+}
+
+// levels returns the tracked levels in ascending order.
+func (t *reorgTracker) levels() []int32 {
+	levels := make([]int32, 0, len(t.blocks))
+	for level := range t.blocks {
+		levels = append(levels, level)
+	}
+	slices.Sort(levels)
+	return levels
+}
+
+// conflicts returns true if the given block is tracked with a different hash at its level.
+func (t *reorgTracker) conflicts(level int32, hash string) bool {
+	blk, ok := t.blocks[level]
+	return ok && blk.Hash != hash
+}
+
+// forkPoint compares the tracked blocks with the given hashes by level, and returns
+// the lowest level which hash differs or is missing. Returns false if there is none.
+func (t *reorgTracker) forkPoint(hashes map[int32]string) (int32, bool) {
+	for _, level := range t.levels() {
+		if hashes[level] != t.blocks[level].Hash {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// rollback forgets the blocks at the given level or above, and returns the oldest
+// of them. Returns false if no block was tracked at these levels.
+func (t *reorgTracker) rollback(level int32) (repository.Block, bool) {
+	oldest, found := repository.Block{}, false
+	for _, lvl := range t.levels() {
+		if lvl < level {
+			continue
+		}
+		if !found {
+			oldest, found = t.blocks[lvl], true
+		}
+		delete(t.blocks, lvl)
+	}
+	return oldest, found
+}
@@ -0,0 +1,289 @@
+package tezos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is matched by errors returned while the TzKT API rejects requests
+	// for exceeding its rate limit.
+	ErrRateLimited = errors.New("rate limited by TzKT API")
+	// ErrUpstreamUnavailable is matched by errors returned while the TzKT API is
+	// unreachable or failing.
+	ErrUpstreamUnavailable = errors.New("TzKT API unavailable")
+)
+
+// UpstreamError is returned when the TzKT API cannot serve requests for a while,
+// once retries are exhausted or while the circuit breaker is open.
+// It matches ErrRateLimited or ErrUpstreamUnavailable with errors.Is.
+type UpstreamError struct {
+	// ErrRateLimited or ErrUpstreamUnavailable
+	Kind error
+	// Delay before the API is expected to serve requests again, zero if unknown
+	RetryAfter time.Duration
+	// Failure of the last attempt, nil if none was made
+	Cause error
+}
+
+func (e *UpstreamError) Error() string {
+	msg := e.Kind.Error()
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(" (retry after %s)", e.RetryAfter)
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *UpstreamError) Unwrap() []error {
+	if e.Cause == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Cause}
+}
+
+// RetryPolicy configures how requests to the TzKT API are retried, and when the
+// circuit breaker opens.
+type RetryPolicy struct {
+	// Maximum number of attempts per request, including the first one
+	MaxAttempts int
+	// Delay before the first retry, doubled at each retry
+	BaseDelay time.Duration
+	// Maximum delay between two attempts; a longer Retry-After is not waited for
+	MaxDelay time.Duration
+	// Number of consecutive failed attempts to a host opening its circuit, 0 to disable
+	BreakerThreshold int
+	// Duration requests to a host fail fast once its circuit opened
+	BreakerCooldown time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of clients, unless configured otherwise
+// with WithRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:      4,
+	BaseDelay:        500 * time.Millisecond,
+	MaxDelay:         30 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// retryTransport is an HTTP transport retrying idempotent requests on transport
+// errors, 429 and 5xx responses with a jittered exponential backoff, honouring the
+// Retry-After header. Hosts failing repeatedly are cut off by a circuit breaker.
+// Retries are logged as warnings.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newRetryTransport(next http.RoundTripper, policy RetryPolicy, logger *slog.Logger) *retryTransport {
+	return &retryTransport{
+		next:     next,
+		policy:   policy,
+		logger:   logger,
+		breakers: map[string]*circuitBreaker{},
+	}
+}
+
+// RoundTrip executes the request, retrying it as configured. Returns an *UpstreamError
+// once retries are exhausted, when the Retry-After delay is too long, or when the
+// circuit of the host is open. Other responses are returned as is.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := t.breaker(req.URL.Host)
+	retryable := (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Body == nil
+
+	attempts := max(t.policy.MaxAttempts, 1)
+	if !retryable {
+		attempts = 1
+	}
+
+	var lastErr *UpstreamError
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := t.backoff(attempt)
+			if lastErr.RetryAfter > 0 {
+				delay = lastErr.RetryAfter
+			}
+			if delay > t.policy.MaxDelay {
+				return nil, lastErr
+			}
+			t.logger.WarnContext(req.Context(), "retrying request",
+				"host", req.URL.Host, "path", req.URL.Path, "attempt", attempt+1, "delay", delay, "error", lastErr)
+			if err := sleep(req, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		if wait, ok := breaker.allow(); !ok {
+			return nil, &UpstreamError{Kind: ErrUpstreamUnavailable, RetryAfter: wait, Cause: errors.New("circuit open")}
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil {
+				// says nothing about the host, a trial request is to be sent again
+				breaker.abort()
+				return nil, err
+			}
+			breaker.failure()
+			lastErr = &UpstreamError{Kind: ErrUpstreamUnavailable, Cause: err}
+		case resp.StatusCode == http.StatusTooManyRequests:
+			// the host is alive, it only asks to slow down
+			breaker.success()
+			lastErr = &UpstreamError{
+				Kind:       ErrRateLimited,
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+				Cause:      fmt.Errorf("bad HTTP status: %d", resp.StatusCode),
+			}
+			drain(resp)
+		case resp.StatusCode >= http.StatusInternalServerError:
+			breaker.failure()
+			lastErr = &UpstreamError{
+				Kind:  ErrUpstreamUnavailable,
+				Cause: fmt.Errorf("bad HTTP status: %d", resp.StatusCode),
+			}
+			drain(resp)
+		default:
+			breaker.success()
+			return resp, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// breaker returns the circuit breaker of the given host.
+func (t *retryTransport) breaker(host string) *circuitBreaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		b = &circuitBreaker{threshold: t.policy.BreakerThreshold, cooldown: t.policy.BreakerCooldown}
+		t.breakers[host] = b
+	}
+	return b
+}
+
+// backoff returns the delay before the given retry attempt: the exponential delay
+// with a random jitter of up to half of it.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.policy.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > t.policy.MaxDelay {
+		delay = t.policy.MaxDelay
+	}
+	if half := delay / 2; half > 0 {
+		delay = half + rand.N(half)
+	}
+	return delay
+}
+
+// circuitBreaker cuts off a host after consecutive failures. Once open, it lets a
+// single trial request through after the cooldown: the circuit closes again if it
+// succeeds, and opens for another cooldown otherwise.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow returns true if a request may be sent, or the remaining cooldown otherwise.
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	if b.threshold <= 0 {
+		return 0, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return 0, true
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait, false
+	}
+	if b.trial {
+		// a trial request is already in flight
+		return b.cooldown, false
+	}
+	b.trial = true
+	return 0, true
+}
+
+// success closes the circuit.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+// abort releases the trial request slot of a request which outcome is unknown, e.g.
+// cancelled, without counting a failure.
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// failure records a failed request, and opens the circuit once the threshold is reached.
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number of
+// seconds or an HTTP date. Returns zero if it is missing or invalid.
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(val); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// sleep waits for the given delay, or for the request context to be cancelled.
+func sleep(req *http.Request, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// drain discards and closes the body of a response which is not returned, so that
+// its connection can be reused.
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+}
@@ -0,0 +1,228 @@
+package tezos_test
+
+import (
+	"context"
+	"errors"
+	"kiln-tezos-delegation/tezos"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRetry(t *testing.T) {
+	policy := tezos.RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    1500 * time.Millisecond,
+	}
+
+	// newServer starts a server responding with the given statuses in turn, then with
+	// HTTP-200, and counting calls.
+	newServer := func(t *testing.T, calls *atomic.Int32, statuses ...int) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			call := int(calls.Add(1))
+			if call <= len(statuses) {
+				if statuses[call-1] == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "1")
+				}
+				w.WriteHeader(statuses[call-1])
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"level":242,"hash":"hash1"}]`))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("retries on server errors", func(t *testing.T) {
+		var calls atomic.Int32
+		server := newServer(t, &calls, http.StatusBadGateway, http.StatusServiceUnavailable)
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(policy))
+		require.NoError(t, err)
+
+		hashes, err := cli.GetBlockHashes(context.Background(), []int32{242})
+
+		assert.NoError(t, err)
+		assert.Equal(t, map[int32]string{242: "hash1"}, hashes)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("retries on rate limit after Retry-After delay", func(t *testing.T) {
+		var calls atomic.Int32
+		server := newServer(t, &calls, http.StatusTooManyRequests)
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(policy))
+		require.NoError(t, err)
+
+		start := time.Now()
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	})
+
+	t.Run("returns rate limit error when Retry-After is too long", func(t *testing.T) {
+		var calls atomic.Int32
+		server := newServer(t, &calls, http.StatusTooManyRequests)
+
+		shortPolicy := policy
+		shortPolicy.MaxDelay = 100 * time.Millisecond
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(shortPolicy))
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+
+		assert.ErrorIs(t, err, tezos.ErrRateLimited)
+		var uerr *tezos.UpstreamError
+		require.ErrorAs(t, err, &uerr)
+		assert.Equal(t, time.Second, uerr.RetryAfter)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("returns unavailable error once retries are exhausted", func(t *testing.T) {
+		var calls atomic.Int32
+		server := newServer(t, &calls, 500, 500, 500, 500)
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(policy))
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+
+		assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("returns unavailable error on transport error", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(policy))
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+
+		assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+	})
+
+	t.Run("does not retry on client errors", func(t *testing.T) {
+		var calls atomic.Int32
+		server := newServer(t, &calls, http.StatusNotFound)
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(policy))
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, tezos.ErrUpstreamUnavailable))
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("stops retrying on context cancellation", func(t *testing.T) {
+		var calls atomic.Int32
+		server := newServer(t, &calls, http.StatusTooManyRequests)
+
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(policy))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = cli.GetBlockHashes(ctx, []int32{242})
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("opens circuit after consecutive failures", func(t *testing.T) {
+		var calls atomic.Int32
+		server := newServer(t, &calls, 500, 500, 500)
+
+		breakerPolicy := tezos.RetryPolicy{
+			MaxAttempts:      1,
+			BreakerThreshold: 2,
+			BreakerCooldown:  100 * time.Millisecond,
+		}
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(breakerPolicy))
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+			assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+		}
+		require.Equal(t, int32(2), calls.Load())
+
+		// circuit is open: fails fast without calling the server
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		var uerr *tezos.UpstreamError
+		require.ErrorAs(t, err, &uerr)
+		assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+		assert.Greater(t, uerr.RetryAfter, time.Duration(0))
+		assert.Equal(t, int32(2), calls.Load())
+
+		// trial request after cooldown fails, circuit opens again
+		time.Sleep(150 * time.Millisecond)
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+		assert.Equal(t, int32(3), calls.Load())
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		assert.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+		assert.Equal(t, int32(3), calls.Load())
+
+		// trial request after cooldown succeeds, circuit closes
+		time.Sleep(150 * time.Millisecond)
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		assert.NoError(t, err)
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(5), calls.Load())
+	})
+
+	t.Run("sends trial request again after cancelled one", func(t *testing.T) {
+		var calls atomic.Int32
+		var slow atomic.Bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch call := calls.Add(1); {
+			case call == 1:
+				w.WriteHeader(http.StatusInternalServerError)
+			case slow.Load():
+				<-r.Context().Done()
+			default:
+				w.Write([]byte(`[{"level":242,"hash":"hash1"}]`))
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		breakerPolicy := tezos.RetryPolicy{
+			MaxAttempts:      1,
+			BreakerThreshold: 1,
+			BreakerCooldown:  50 * time.Millisecond,
+		}
+		cli, err := tezos.NewClient(server.URL+"/", tezos.WithRetryPolicy(breakerPolicy))
+		require.NoError(t, err)
+
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		require.ErrorIs(t, err, tezos.ErrUpstreamUnavailable)
+
+		// trial request after cooldown times out
+		time.Sleep(75 * time.Millisecond)
+		slow.Store(true)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = cli.GetBlockHashes(ctx, []int32{242})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// the next request is a trial again, and closes the circuit
+		slow.Store(false)
+		_, err = cli.GetBlockHashes(context.Background(), []int32{242})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+}
@@ -3,40 +3,57 @@ package tezos
 import (
 	"context"
 	"errors"
+	"kiln-tezos-delegation/logging"
 	"kiln-tezos-delegation/repository"
-	"log"
+	"log/slog"
 	"time"
-
-	"github.com/jackc/pgx/v5"
 )
 
 type TezosClient interface {
 	GetCurrentProtocolTimeBetweenBlocks(context.Context) (time.Duration, error)
-	GetDelegationsSince(context.Context, time.Time) ([]Delegation, error)
+	StreamDelegationsSince(context.Context, time.Time, DelegationPageFunc) error
+	StreamDelegationsAfter(context.Context, int64, int32, DelegationPageFunc) error
+	GetBlockHashes(context.Context, []int32) (map[int32]string, error)
+	GetHeadLevel(context.Context) (int32, error)
 }
 
 type TezosRepository interface {
-	AddNewDelegations(context.Context, []repository.Delegation) error
+	AddNewDelegationsAndCheckpoint(context.Context, []repository.Delegation, repository.Checkpoint) (repository.InsertStats, error)
+	GetCheckpoint(context.Context) (repository.Checkpoint, error)
 	GetLatestBlockTimestamp(context.Context) (time.Time, error)
+	GetLatestBlocks(context.Context, int) ([]repository.Block, error)
+	DeleteDelegationsFromLevel(context.Context, int32) (int64, error)
 }
 
+// Scraper stores delegation operations fetched periodically from the TzKT REST API.
+// Scraping resumes right after the last stored operation, recorded as a checkpoint
+// along with every stored page. Without checkpoint, scraping starts from a point in time.
 type Scraper struct {
-	client TezosClient
-	repo   TezosRepository
+	client  TezosClient
+	repo    TezosRepository
+	tracker *reorgTracker
+	// Last stored operation, zero if none
+	checkpoint repository.Checkpoint
+	progress   progress
+	logger     *slog.Logger
 }
 
-func NewScraper(client TezosClient, repo TezosRepository) *Scraper {
+func NewScraper(client TezosClient, repo TezosRepository, logger *slog.Logger) *Scraper {
 	return &Scraper{
-		client: client,
-		repo:   repo,
+		client:  client,
+		repo:    repo,
+		tracker: newReorgTracker(reorgWindow),
+		logger:  logger,
 	}
 }
 
 // Run fetches the execution interval from the TzKT client then starts
-// scraping periodically until context is cancelled, or any non-recoverable
-// error occurs. An error is returned in that later case.
-// If a time is passed as parameter, it will be used as an override of
-// the starting time of scraping. It is mostly for testing purposes.
+// scraping periodically from the stored checkpoint until context is cancelled,
+// or any non-recoverable error occurs. An error is returned in that later case.
+// If a time is passed as parameter, it will be used as an override of the
+// checkpoint for the first cycle. It is mostly for testing purposes.
+// When the TzKT API is rate limiting or unavailable for longer than the interval,
+// the next cycle is delayed accordingly. Lines logged during a cycle hold its ID.
 func (s *Scraper) Run(ctx context.Context, beginning time.Time) error {
 	interval, err := s.client.GetCurrentProtocolTimeBetweenBlocks(ctx)
 	if err != nil {
@@ -46,78 +63,326 @@ func (s *Scraper) Run(ctx context.Context, beginning time.Time) error {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	if beginning.IsZero() {
-		beginning, err = s.getStartingTime(ctx)
-		if err != nil {
-			return err
-		}
+	if beginning, err = s.init(ctx, beginning); err != nil {
+		return err
 	}
 
+	paused := false
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			log.Default().Println("scraping since", beginning)
-			beginning, err = s.scrapDelegations(ctx, beginning)
+			if paused {
+				ticker.Reset(interval)
+				paused = false
+			}
+			cctx := logging.With(ctx, "cycle_id", logging.NewID())
+			if s.checkpoint.OperationID != 0 {
+				s.logger.DebugContext(cctx, "scraping after operation", "operation_id", s.checkpoint.OperationID, "level", s.checkpoint.Level)
+			} else {
+				s.logger.DebugContext(cctx, "scraping since time", "since", beginning)
+			}
+			beginning, err = s.scrapDelegations(cctx, beginning)
 			if err != nil {
 				// do not return, instead log and try again
-				log.Default().Println("error during scraping cycle:", err)
+				s.logger.ErrorContext(cctx, "scraping cycle failed", "error", err)
+			}
+
+			// let the TzKT API recover when it asks for more than an interval
+			var uerr *UpstreamError
+			if errors.As(err, &uerr) && uerr.RetryAfter > interval {
+				s.logger.WarnContext(cctx, "pausing scraping", "delay", uerr.RetryAfter)
+				ticker.Reset(uerr.RetryAfter)
+				paused = true
 			}
 		}
 	}
 }
 
-// scrapDelegations gets the delegation operations from TzKT API starting from
-// the time passed as parameter then stores them in storage.
-// Returns the time suitable for the next cycle to start with, or an error.
-// The returned time is guaranteed to be equal to the one passed as parameter
-// whenever the fetched delegations could not be put in storage.
-func (s *Scraper) scrapDelegations(ctx context.Context, beginning time.Time) (time.Time, error) {
-	// get delegations since the desired beginning from TzKT API
-	dlgs, err := s.client.GetDelegationsSince(ctx, beginning)
+// init loads the tracked blocks and the checkpoint from storage, and returns the
+// time to start scraping from when there is no checkpoint. A non-zero time passed
+// as parameter overrides the checkpoint and is returned as is.
+// State left by a previous run is dropped first, since another instance may have
+// ingested in between, e.g. while this one was not the leader.
+func (s *Scraper) init(ctx context.Context, beginning time.Time) (time.Time, error) {
+	s.tracker = newReorgTracker(reorgWindow)
+	s.checkpoint = repository.Checkpoint{}
+	s.progress.reset()
+
+	if err := s.loadLatestBlocks(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	if !beginning.IsZero() {
+		return beginning, nil
+	}
+
+	if err := s.loadCheckpoint(ctx); err != nil {
+		return time.Time{}, err
+	}
+	s.progress.start(s.checkpoint.Level)
+	return s.getStartingTime(ctx)
+}
+
+// LastSuccess returns the end time of the last successful scraping cycle, zero if none.
+// It is safe from concurrency.
+func (s *Scraper) LastSuccess() time.Time {
+	return s.progress.success()
+}
+
+// Lag returns the number of levels between the head of the TzKT API, as of the last
+// cycle, and the level up to which every delegation is stored. Returns false until
+// both are known. It is safe from concurrency.
+func (s *Scraper) Lag() (int32, bool) {
+	return s.progress.lag()
+}
+
+// scrapDelegations gets the delegation operations from TzKT API following the
+// checkpoint, or starting from the time passed as parameter if there is none,
+// then stores them in storage, page by page, until the scraper caught up with
+// the TzKT API. The checkpoint moves forward with every stored page, so that no
+// operation is ever missed nor fetched twice.
+// Returns the time suitable for the next cycle to start with when there is still
+// no checkpoint, or an error. The returned time is guaranteed to be equal to the
+// one passed as parameter whenever no fetched delegations could be put in storage.
+// The head level is checked beforehand: once the cycle succeeds, every delegation up
+// to it is stored. The cycle duration is recorded as a metric.
+func (s *Scraper) scrapDelegations(ctx context.Context, beginning time.Time) (_ time.Time, err error) {
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		scrapeCycleDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
+	head, herr := s.client.GetHeadLevel(ctx)
+	if herr != nil {
+		// not fatal, only progress is unknown
+		s.logger.WarnContext(ctx, "cannot get head level", "error", herr)
+	} else {
+		s.progress.observeHead(head)
+	}
+
+	// re-scrape from the fork point if recently stored blocks were reorganised
+	beginning, err = s.checkReorg(ctx, beginning)
 	if err != nil {
 		return beginning, err
 	}
 
-	log.Default().Println("fetched", len(dlgs), "delegation(s) from TzKT API")
+	fetched := 0
+	newest := time.Time{}
+
+	// get delegations after the checkpoint, or since the desired beginning, from
+	// TzKT API, and save them page by page
+	stream := func(fn DelegationPageFunc) error {
+		return s.client.StreamDelegationsSince(ctx, beginning, fn)
+	}
+	if s.checkpoint.OperationID != 0 {
+		stream = func(fn DelegationPageFunc) error {
+			return s.client.StreamDelegationsAfter(ctx, s.checkpoint.OperationID, s.checkpoint.Level, fn)
+		}
+	}
+
+	err = stream(func(dlgs []Delegation) error {
+		fetched += len(dlgs)
+
+		pageNewest, err := s.storeDelegations(ctx, dlgs)
+		if err != nil {
+			return err
+		}
+
+		if pageNewest.After(newest) {
+			newest = pageNewest
+		}
+		return nil
+	})
+
+	s.logger.InfoContext(ctx, "fetched delegations", "count", fetched)
+
+	if err == nil {
+		s.progress.succeed(max(s.checkpoint.Level, head))
+	}
 
-	if len(dlgs) == 0 {
+	switch {
+	case err != nil && newest.IsZero():
+		return beginning, err
+	case err != nil:
+		return newest, err
+	case fetched == 0:
 		// no new delegation, lets start next cycle from now
 		return time.Now().UTC(), nil
+	default:
+		return newest.Add(time.Second), nil
 	}
+}
+
+// storeDelegations converts the given delegations and saves them in storage, along
+// with the checkpoint of the last one. Returns the most recent timestamp of the
+// stored delegations.
+func (s *Scraper) storeDelegations(ctx context.Context, dlgs []Delegation) (time.Time, error) {
+	delegationsFetched.Add(float64(len(dlgs)))
 
-	// convert BOMs and find oldest timestamp from new delegations
-	oldest := beginning
+	// convert BOMs and find most recent timestamp from new delegations
+	newest := time.Time{}
+	cp := repository.Checkpoint{}
 	rdlgs := make([]repository.Delegation, len(dlgs))
 	for i := range dlgs {
-		rdlgs[i].Amount = dlgs[i].Amount
-		rdlgs[i].BlockHash = dlgs[i].Block
-		rdlgs[i].OperationID = dlgs[i].ID
-		rdlgs[i].BlockTimestamp = dlgs[i].Timestamp
-		rdlgs[i].Level = dlgs[i].Level
-		rdlgs[i].Sender = dlgs[i].Sender.Address
-		if rdlgs[i].BlockTimestamp.After(oldest) {
-			oldest = rdlgs[i].BlockTimestamp
+		rdlgs[i] = toRepositoryDelegation(dlgs[i])
+		if rdlgs[i].BlockTimestamp.After(newest) {
+			newest = rdlgs[i].BlockTimestamp
+		}
+		if rdlgs[i].OperationID > cp.OperationID {
+			cp = repository.Checkpoint{OperationID: rdlgs[i].OperationID, Level: rdlgs[i].Level}
+		}
+	}
+
+	// an already stored level is reported in a different block
+	for i := range rdlgs {
+		if s.tracker.conflicts(rdlgs[i].Level, rdlgs[i].BlockHash) {
+			if _, err := s.rollback(ctx, rdlgs[i].Level); err != nil {
+				return time.Time{}, err
+			}
 		}
 	}
 
 	// save in repository
-	if err := s.repo.AddNewDelegations(ctx, rdlgs); err != nil {
+	stats, err := s.repo.AddNewDelegationsAndCheckpoint(ctx, rdlgs, cp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	delegationsInserted.Add(float64(stats.Inserted))
+	delegationsDuplicated.Add(float64(stats.Skipped))
+	if s.checkpoint.Before(cp) {
+		s.checkpoint = cp
+		observeCheckpoint(cp.Level)
+	}
+	if !newest.IsZero() {
+		lastScrapedTimestamp.Set(float64(newest.Unix()))
+	}
+	if stats.Skipped > 0 {
+		s.logger.InfoContext(ctx, "skipped delegations already stored", "inserted", stats.Inserted, "skipped", stats.Skipped)
+	}
+
+	for i := range rdlgs {
+		s.tracker.track(repository.Block{
+			Level:     rdlgs[i].Level,
+			Hash:      rdlgs[i].BlockHash,
+			Timestamp: rdlgs[i].BlockTimestamp,
+		})
+	}
+
+	return newest, nil
+}
+
+// loadLatestBlocks starts tracking the most recent blocks holding stored
+// delegations, to detect their reorganisation.
+func (s *Scraper) loadLatestBlocks(ctx context.Context) error {
+	blks, err := s.repo.GetLatestBlocks(ctx, reorgWindow)
+	if err != nil {
+		return err
+	}
+	for i := range blks {
+		s.tracker.track(blks[i])
+	}
+	return nil
+}
+
+// loadCheckpoint loads the checkpoint from storage, if any.
+func (s *Scraper) loadCheckpoint(ctx context.Context) error {
+	cp, err := s.repo.GetCheckpoint(ctx)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return err
+	}
+	s.checkpoint = cp
+	observeCheckpoint(cp.Level)
+	return nil
+}
+
+// checkReorg compares the tracked blocks with the ones currently known by the TzKT
+// API. On any difference, delegations from the fork point are deleted from storage.
+// Returns the time suitable for scraping to start with, which is the one of the
+// oldest deleted block if it is older than the time passed as parameter.
+func (s *Scraper) checkReorg(ctx context.Context, beginning time.Time) (time.Time, error) {
+	levels := s.tracker.levels()
+	if len(levels) == 0 {
+		return beginning, nil
+	}
+
+	hashes, err := s.client.GetBlockHashes(ctx, levels)
+	if err != nil {
+		return beginning, err
+	}
+
+	level, forked := s.tracker.forkPoint(hashes)
+	if !forked {
+		return beginning, nil
+	}
+
+	oldest, err := s.rollback(ctx, level)
+	if err != nil {
 		return beginning, err
 	}
+	if !oldest.IsZero() && oldest.Before(beginning) {
+		return oldest, nil
+	}
+	return beginning, nil
+}
 
-	return oldest.Add(time.Second), nil
+// rollback deletes delegations stored at the given level or above from storage,
+// stops tracking their blocks, and reloads the checkpoint moved back by storage.
+// Returns the timestamp of the oldest block which was tracked at these levels,
+// or the zero time if there was none.
+func (s *Scraper) rollback(ctx context.Context, level int32) (time.Time, error) {
+	count, err := s.repo.DeleteDelegationsFromLevel(ctx, level)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	s.logger.WarnContext(ctx, "chain reorganisation", "level", level, "deleted", count)
+	s.progress.rewind(level)
+
+	if err := s.loadCheckpoint(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	blk, _ := s.tracker.rollback(level)
+	return blk.Timestamp, nil
+}
+
+// toRepositoryDelegation converts a TzKT delegation into a storage delegation.
+func toRepositoryDelegation(dlg Delegation) repository.Delegation {
+	rdlg := repository.Delegation{
+		Amount:         dlg.Amount,
+		BlockHash:      dlg.Block,
+		OperationID:    dlg.ID,
+		BlockTimestamp: dlg.Timestamp,
+		Level:          dlg.Level,
+		Sender:         dlg.Sender.Address,
+		OperationHash:  dlg.Hash,
+		Status:         dlg.Status,
+		Fee:            dlg.BakerFee,
+	}
+	if dlg.PrevDelegate != nil {
+		rdlg.PrevDelegate = dlg.PrevDelegate.Address
+	}
+	if dlg.NewDelegate != nil {
+		rdlg.NewDelegate = dlg.NewDelegate.Address
+	}
+	return rdlg
 }
 
 // getStartingTime fetches the timestamp of the delegation operation most
 // recent first, from storage, and returns it with one second added. This
 // is to avoid scraping delegation operations having their timestamp equal
 // to the most recent timestamp being in storage twice at each cycle.
-// If storage contains no operation, the current time is used.
+// If storage contains no operation, the current time is used. It is only
+// relevant when there is no checkpoint.
 func (s *Scraper) getStartingTime(ctx context.Context) (time.Time, error) {
 	latest, err := s.repo.GetLatestBlockTimestamp(ctx)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
 		return time.Time{}, err
 	}
 	if latest.IsZero() {
@@ -1,14 +1,16 @@
 package tezos_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"kiln-tezos-delegation/logging"
 	"kiln-tezos-delegation/repository"
 	"kiln-tezos-delegation/tezos"
+	"log/slog"
 	"testing"
 	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,10 +18,27 @@ type clientMock struct {
 	GetCurrentProtocolTimeBetweenBlocksRet   time.Duration
 	GetCurrentProtocolTimeBetweenBlocksErr   error
 	GetCurrentProtocolTimeBetweenBlocksCount int
-	GetDelegationsSinceRet                   []tezos.Delegation
-	GetDelegationsSinceErr                   error
-	GetDelegationsSinceCount                 int
-	GetDelegationsSinceIn                    time.Time
+	StreamDelegationsSinceRet                [][]tezos.Delegation
+	StreamDelegationsSinceErr                error
+	StreamDelegationsSinceCount              int
+	StreamDelegationsSinceIn                 time.Time
+	StreamDelegationsAfterRet                [][]tezos.Delegation
+	StreamDelegationsAfterErr                error
+	StreamDelegationsAfterCount              int
+	StreamDelegationsAfterIn                 int64
+	StreamDelegationsAfterLevelIn            int32
+	GetBlockHashesRet                        map[int32]string
+	GetBlockHashesErr                        error
+	GetBlockHashesCount                      int
+	GetBlockHashesIn                         []int32
+	GetHeadLevelRet                          int32
+	GetHeadLevelErr                          error
+	GetHeadLevelCount                        int
+}
+
+func (m *clientMock) GetHeadLevel(context.Context) (int32, error) {
+	m.GetHeadLevelCount++
+	return m.GetHeadLevelRet, m.GetHeadLevelErr
 }
 
 func (m *clientMock) GetCurrentProtocolTimeBetweenBlocks(context.Context) (time.Duration, error) {
@@ -27,25 +46,70 @@ func (m *clientMock) GetCurrentProtocolTimeBetweenBlocks(context.Context) (time.
 	return m.GetCurrentProtocolTimeBetweenBlocksRet, m.GetCurrentProtocolTimeBetweenBlocksErr
 }
 
-func (m *clientMock) GetDelegationsSince(_ context.Context, since time.Time) ([]tezos.Delegation, error) {
-	m.GetDelegationsSinceIn = since
-	m.GetDelegationsSinceCount++
-	return m.GetDelegationsSinceRet, m.GetDelegationsSinceErr
+func (m *clientMock) StreamDelegationsSince(_ context.Context, since time.Time, fn tezos.DelegationPageFunc) error {
+	m.StreamDelegationsSinceIn = since
+	m.StreamDelegationsSinceCount++
+	for _, page := range m.StreamDelegationsSinceRet {
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+	return m.StreamDelegationsSinceErr
+}
+
+func (m *clientMock) StreamDelegationsAfter(_ context.Context, id int64, level int32, fn tezos.DelegationPageFunc) error {
+	m.StreamDelegationsAfterIn = id
+	m.StreamDelegationsAfterLevelIn = level
+	m.StreamDelegationsAfterCount++
+	for _, page := range m.StreamDelegationsAfterRet {
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+	return m.StreamDelegationsAfterErr
+}
+
+func (m *clientMock) GetBlockHashes(_ context.Context, levels []int32) (map[int32]string, error) {
+	m.GetBlockHashesIn = levels
+	m.GetBlockHashesCount++
+	return m.GetBlockHashesRet, m.GetBlockHashesErr
 }
 
 type repoMock struct {
-	AddNewDelegationsErr         error
-	AddNewDelegationsCount       int
-	AddNewDelegationsIn          []repository.Delegation
-	GetLatestBlockTimestampRet   time.Time
-	GetLatestBlockTimestampErr   error
-	GetLatestBlockTimestampCount int
+	AddNewDelegationsAndCheckpointErr          error
+	AddNewDelegationsAndCheckpointErrAt        int // call number from which AddNewDelegationsAndCheckpointErr is returned, 0 meaning any
+	AddNewDelegationsAndCheckpointCount        int
+	AddNewDelegationsAndCheckpointIn           []repository.Delegation
+	AddNewDelegationsAndCheckpointInCheckpoint repository.Checkpoint
+	GetCheckpointRet                           repository.Checkpoint
+	GetCheckpointErr                           error
+	GetCheckpointCount                         int
+	GetLatestBlockTimestampRet                 time.Time
+	GetLatestBlockTimestampErr                 error
+	GetLatestBlockTimestampCount               int
+	GetLatestBlocksRet                         []repository.Block
+	GetLatestBlocksErr                         error
+	DeleteDelegationsFromLevelErr              error
+	DeleteDelegationsFromLevelCount            int
+	DeleteDelegationsFromLevelIn               int32
 }
 
-func (m *repoMock) AddNewDelegations(_ context.Context, tezosDlgs []repository.Delegation) error {
-	m.AddNewDelegationsIn = tezosDlgs
-	m.AddNewDelegationsCount++
-	return m.AddNewDelegationsErr
+func (m *repoMock) AddNewDelegationsAndCheckpoint(_ context.Context, tezosDlgs []repository.Delegation, cp repository.Checkpoint) (repository.InsertStats, error) {
+	m.AddNewDelegationsAndCheckpointCount++
+	if m.AddNewDelegationsAndCheckpointErr != nil && m.AddNewDelegationsAndCheckpointCount >= m.AddNewDelegationsAndCheckpointErrAt {
+		return repository.InsertStats{}, m.AddNewDelegationsAndCheckpointErr
+	}
+	m.AddNewDelegationsAndCheckpointIn = append(m.AddNewDelegationsAndCheckpointIn, tezosDlgs...)
+	m.AddNewDelegationsAndCheckpointInCheckpoint = cp
+	return repository.InsertStats{Inserted: int64(len(tezosDlgs))}, nil
+}
+
+func (m *repoMock) GetCheckpoint(context.Context) (repository.Checkpoint, error) {
+	m.GetCheckpointCount++
+	if m.GetCheckpointErr == nil && m.GetCheckpointRet.OperationID == 0 {
+		return repository.Checkpoint{}, repository.ErrNotFound
+	}
+	return m.GetCheckpointRet, m.GetCheckpointErr
 }
 
 func (m *repoMock) GetLatestBlockTimestamp(context.Context) (time.Time, error) {
@@ -53,6 +117,16 @@ func (m *repoMock) GetLatestBlockTimestamp(context.Context) (time.Time, error) {
 	return m.GetLatestBlockTimestampRet, m.GetLatestBlockTimestampErr
 }
 
+func (m *repoMock) GetLatestBlocks(context.Context, int) ([]repository.Block, error) {
+	return m.GetLatestBlocksRet, m.GetLatestBlocksErr
+}
+
+func (m *repoMock) DeleteDelegationsFromLevel(_ context.Context, level int32) (int64, error) {
+	m.DeleteDelegationsFromLevelIn = level
+	m.DeleteDelegationsFromLevelCount++
+	return 1, m.DeleteDelegationsFromLevelErr
+}
+
 func TestScraper(t *testing.T) {
 	scrapInterval := 200 * time.Millisecond
 	waitTime := 300 * time.Millisecond
@@ -65,8 +139,13 @@ func TestScraper(t *testing.T) {
 			Sender: struct {
 				Address string `json:"address"`
 			}{Address: "addr1"},
-			Level:  242,
-			Amount: 342,
+			Level:        242,
+			Amount:       342,
+			Hash:         "op1",
+			Status:       "applied",
+			BakerFee:     442,
+			PrevDelegate: &tezos.Account{Address: "baker1"},
+			NewDelegate:  &tezos.Account{Address: "baker2"},
 		},
 		{
 			ID:        43,
@@ -75,8 +154,13 @@ func TestScraper(t *testing.T) {
 			Sender: struct {
 				Address string `json:"address"`
 			}{Address: "addr2"},
-			Level:  243,
-			Amount: 343,
+			Level:        243,
+			Amount:       343,
+			Hash:         "op2",
+			Status:       "applied",
+			BakerFee:     443,
+			PrevDelegate: &tezos.Account{Address: "baker2"},
+			NewDelegate:  nil, // undelegation
 		},
 	}
 
@@ -85,12 +169,12 @@ func TestScraper(t *testing.T) {
 		begin := time.Time{}
 		cliMock := clientMock{
 			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
-			GetDelegationsSinceRet:                 tezosDlgs,
+			StreamDelegationsSinceRet:              [][]tezos.Delegation{tezosDlgs},
 		}
 		repoMock := repoMock{
 			GetLatestBlockTimestampRet: lastBlockTs,
 		}
-		scraper := tezos.NewScraper(&cliMock, &repoMock)
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -101,13 +185,13 @@ func TestScraper(t *testing.T) {
 		cancel()
 
 		// tezos client & repo have been called
-		assert.Equal(t, 1, cliMock.GetDelegationsSinceCount)
+		assert.Equal(t, 1, cliMock.StreamDelegationsSinceCount)
 		assert.Equal(t, 1, repoMock.GetLatestBlockTimestampCount)
-		assert.Equal(t, 1, repoMock.AddNewDelegationsCount)
+		assert.Equal(t, 1, repoMock.AddNewDelegationsAndCheckpointCount)
 		// all data has been passed around to repository layer
-		assert.Len(t, repoMock.AddNewDelegationsIn, 2)
-		assert.Equal(t, cliMock.GetDelegationsSinceRet[0].ID, repoMock.AddNewDelegationsIn[0].OperationID)
-		assert.Equal(t, cliMock.GetDelegationsSinceRet[1].ID, repoMock.AddNewDelegationsIn[1].OperationID)
+		assert.Len(t, repoMock.AddNewDelegationsAndCheckpointIn, 2)
+		assert.Equal(t, tezosDlgs[0].ID, repoMock.AddNewDelegationsAndCheckpointIn[0].OperationID)
+		assert.Equal(t, tezosDlgs[1].ID, repoMock.AddNewDelegationsAndCheckpointIn[1].OperationID)
 		// tezos & repository BOMs are equivalent in any aspect
 		expBOM := repository.Delegation{
 			OperationID:    tezosDlgs[0].ID,
@@ -116,22 +200,29 @@ func TestScraper(t *testing.T) {
 			Sender:         tezosDlgs[0].Sender.Address,
 			Level:          tezosDlgs[0].Level,
 			Amount:         tezosDlgs[0].Amount,
+			OperationHash:  tezosDlgs[0].Hash,
+			Status:         tezosDlgs[0].Status,
+			Fee:            tezosDlgs[0].BakerFee,
+			PrevDelegate:   tezosDlgs[0].PrevDelegate.Address,
+			NewDelegate:    tezosDlgs[0].NewDelegate.Address,
 		}
-		assert.Equal(t, repoMock.AddNewDelegationsIn[0], expBOM)
+		assert.Equal(t, repoMock.AddNewDelegationsAndCheckpointIn[0], expBOM)
+		// undelegation has no new delegate
+		assert.Equal(t, "", repoMock.AddNewDelegationsAndCheckpointIn[1].NewDelegate)
 		// scraper started from (latest block timestamp + 1 second)(since TzKT precision is one second)
-		assert.Equal(t, lastBlockTs, cliMock.GetDelegationsSinceIn.Add(-time.Second))
+		assert.Equal(t, lastBlockTs, cliMock.StreamDelegationsSinceIn.Add(-time.Second))
 	})
 
 	t.Run("happy case without initial data", func(t *testing.T) {
 		begin := time.Time{}
 		cliMock := clientMock{
 			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
-			GetDelegationsSinceRet:                 tezosDlgs,
+			StreamDelegationsSinceRet:              [][]tezos.Delegation{tezosDlgs},
 		}
 		repoMock := repoMock{
-			GetLatestBlockTimestampErr: pgx.ErrNoRows, // no initial data in db
+			GetLatestBlockTimestampErr: repository.ErrNotFound, // no initial data in db
 		}
-		scraper := tezos.NewScraper(&cliMock, &repoMock)
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -142,26 +233,26 @@ func TestScraper(t *testing.T) {
 		cancel()
 
 		// tezos client & repo have been called
-		assert.Equal(t, 1, cliMock.GetDelegationsSinceCount)
+		assert.Equal(t, 1, cliMock.StreamDelegationsSinceCount)
 		assert.Equal(t, 1, repoMock.GetLatestBlockTimestampCount)
-		assert.Equal(t, 1, repoMock.AddNewDelegationsCount)
+		assert.Equal(t, 1, repoMock.AddNewDelegationsAndCheckpointCount)
 		// data has been passed to repository layer as expected
-		assert.Len(t, repoMock.AddNewDelegationsIn, 2)
-		assert.Equal(t, cliMock.GetDelegationsSinceRet[0].ID, repoMock.AddNewDelegationsIn[0].OperationID)
+		assert.Len(t, repoMock.AddNewDelegationsAndCheckpointIn, 2)
+		assert.Equal(t, tezosDlgs[0].ID, repoMock.AddNewDelegationsAndCheckpointIn[0].OperationID)
 		// scraper started from since less than one second from now
-		assert.WithinDuration(t, time.Now(), cliMock.GetDelegationsSinceIn, time.Second)
+		assert.WithinDuration(t, time.Now(), cliMock.StreamDelegationsSinceIn, time.Second)
 	})
 
 	t.Run("starts from expected forced time", func(t *testing.T) {
 		begin := time.Date(1991, 01, 03, 10, 02, 33, 0, time.UTC) // desired date-time (force)
 		cliMock := clientMock{
 			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
-			GetDelegationsSinceRet:                 tezosDlgs,
+			StreamDelegationsSinceRet:              [][]tezos.Delegation{tezosDlgs},
 		}
 		repoMock := repoMock{
-			GetLatestBlockTimestampErr: pgx.ErrNoRows, // no initial data in db
+			GetLatestBlockTimestampErr: repository.ErrNotFound, // no initial data in db
 		}
-		scraper := tezos.NewScraper(&cliMock, &repoMock)
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -174,7 +265,7 @@ func TestScraper(t *testing.T) {
 		// latest block timestamp has not been fetched from database
 		assert.Equal(t, 0, repoMock.GetLatestBlockTimestampCount)
 		// scraper started from the expected (forced) time
-		assert.Equal(t, begin, cliMock.GetDelegationsSinceIn)
+		assert.Equal(t, begin, cliMock.StreamDelegationsSinceIn)
 	})
 
 	t.Run("return error on protocol request failure", func(t *testing.T) {
@@ -182,7 +273,7 @@ func TestScraper(t *testing.T) {
 		cliMock := clientMock{
 			GetCurrentProtocolTimeBetweenBlocksErr: errors.New("fake http error"),
 		}
-		scraper := tezos.NewScraper(&cliMock, &repoMock{})
+		scraper := tezos.NewScraper(&cliMock, &repoMock{}, slog.Default())
 
 		gotErr := scraper.Run(context.Background(), begin)
 
@@ -198,7 +289,7 @@ func TestScraper(t *testing.T) {
 		repoMock := repoMock{
 			GetLatestBlockTimestampErr: errors.New("fake database error"),
 		}
-		scraper := tezos.NewScraper(&cliMock, &repoMock)
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
 
 		err := scraper.Run(context.Background(), time.Time{})
 
@@ -211,9 +302,9 @@ func TestScraper(t *testing.T) {
 		begin := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
 		cliMock := clientMock{
 			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
-			GetDelegationsSinceErr:                 errors.New("fake TzKT error"),
+			StreamDelegationsSinceErr:              errors.New("fake TzKT error"),
 		}
-		scraper := tezos.NewScraper(&cliMock, &repoMock{})
+		scraper := tezos.NewScraper(&cliMock, &repoMock{}, slog.Default())
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -225,19 +316,19 @@ func TestScraper(t *testing.T) {
 		cancel()
 
 		// delegations were fetched twice ...
-		assert.Equal(t, 2, cliMock.GetDelegationsSinceCount)
+		assert.Equal(t, 2, cliMock.StreamDelegationsSinceCount)
 		// ... and at the second call the same begin time was used
-		assert.Equal(t, begin, cliMock.GetDelegationsSinceIn)
+		assert.Equal(t, begin, cliMock.StreamDelegationsSinceIn)
 	})
 
 	t.Run("starts from now when no new delegations", func(t *testing.T) {
 		begin := time.Date(2020, 06, 26, 10, 02, 33, 0, time.UTC)
 		cliMock := clientMock{
 			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
-			GetDelegationsSinceRet:                 []tezos.Delegation{}, // nothing new
+			StreamDelegationsSinceRet:              nil, // nothing new
 		}
 		repoMock := repoMock{}
-		scraper := tezos.NewScraper(&cliMock, &repoMock)
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -249,8 +340,336 @@ func TestScraper(t *testing.T) {
 		cancel()
 
 		// delegations were fetched twice ...
-		assert.Equal(t, 2, cliMock.GetDelegationsSinceCount)
+		assert.Equal(t, 2, cliMock.StreamDelegationsSinceCount)
 		// ... and at the second call the begin time was within a second to now
-		assert.WithinDuration(t, time.Now(), cliMock.GetDelegationsSinceIn, time.Second)
+		assert.WithinDuration(t, time.Now(), cliMock.StreamDelegationsSinceIn, time.Second)
+	})
+
+	t.Run("stores delegations page by page", func(t *testing.T) {
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			StreamDelegationsSinceRet:              [][]tezos.Delegation{tezosDlgs[:1], tezosDlgs[1:]},
+		}
+		repoMock := repoMock{}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, begin)
+
+		time.Sleep(waitTime)
+		cancel()
+
+		// delegations were fetched once but stored in two batches
+		assert.Equal(t, 1, cliMock.StreamDelegationsSinceCount)
+		assert.Equal(t, 2, repoMock.AddNewDelegationsAndCheckpointCount)
+		assert.Len(t, repoMock.AddNewDelegationsAndCheckpointIn, 2)
+	})
+
+	t.Run("resumes after last stored page on storage error", func(t *testing.T) {
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			StreamDelegationsSinceRet:              [][]tezos.Delegation{tezosDlgs[:1], tezosDlgs[1:]},
+			GetBlockHashesRet:                      map[int32]string{242: "hash1"},
+		}
+		repoMock := repoMock{
+			AddNewDelegationsAndCheckpointErr:   errors.New("fake database error"),
+			AddNewDelegationsAndCheckpointErrAt: 2, // second page fails
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, begin)
+
+		// wait a bit more than two cycles
+		time.Sleep(2*scrapInterval + scrapInterval/4)
+		cancel()
+
+		// delegations were fetched twice ...
+		assert.Equal(t, 1, cliMock.StreamDelegationsSinceCount)
+		assert.Equal(t, 1, cliMock.StreamDelegationsAfterCount)
+		// ... and at the second call the checkpoint of the last stored delegation was used
+		assert.Equal(t, tezosDlgs[0].ID, cliMock.StreamDelegationsAfterIn)
+		assert.Equal(t, tezosDlgs[0].Level, cliMock.StreamDelegationsAfterLevelIn)
+		assert.Equal(t, 0, repoMock.DeleteDelegationsFromLevelCount)
+	})
+
+	t.Run("deletes orphaned delegations and starts from fork point", func(t *testing.T) {
+		begin := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			GetBlockHashesRet:                      map[int32]string{242: "hash1", 243: "hash2bis"},
+		}
+		repoMock := repoMock{
+			GetLatestBlocksRet: []repository.Block{
+				{Level: 243, Hash: "hash2", Timestamp: tezosDlgs[1].Timestamp},
+				{Level: 242, Hash: "hash1", Timestamp: tezosDlgs[0].Timestamp},
+			},
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, begin)
+
+		time.Sleep(waitTime)
+		cancel()
+
+		// tracked levels have been checked against TzKT API
+		assert.Equal(t, []int32{242, 243}, cliMock.GetBlockHashesIn)
+		// delegations from the reorganised level have been deleted ...
+		assert.Equal(t, 1, repoMock.DeleteDelegationsFromLevelCount)
+		assert.Equal(t, int32(243), repoMock.DeleteDelegationsFromLevelIn)
+		// ... and scraping started from the reorganised block
+		assert.Equal(t, tezosDlgs[1].Timestamp, cliMock.StreamDelegationsSinceIn)
+	})
+
+	t.Run("keeps delegations when blocks are unchanged", func(t *testing.T) {
+		begin := time.Date(2024, 06, 26, 10, 02, 33, 0, time.UTC)
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			GetBlockHashesRet:                      map[int32]string{242: "hash1", 243: "hash2"},
+		}
+		repoMock := repoMock{
+			GetLatestBlocksRet: []repository.Block{
+				{Level: 243, Hash: "hash2", Timestamp: tezosDlgs[1].Timestamp},
+				{Level: 242, Hash: "hash1", Timestamp: tezosDlgs[0].Timestamp},
+			},
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, begin)
+
+		time.Sleep(waitTime)
+		cancel()
+
+		assert.Equal(t, 1, cliMock.GetBlockHashesCount)
+		assert.Equal(t, 0, repoMock.DeleteDelegationsFromLevelCount)
+		assert.Equal(t, begin, cliMock.StreamDelegationsSinceIn)
+	})
+
+	t.Run("drops state of previous run", func(t *testing.T) {
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			GetBlockHashesRet:                      map[int32]string{242: "hash1", 243: "hash2"},
+			GetHeadLevelRet:                        1000,
+		}
+		repoMock := repoMock{
+			GetLatestBlocksRet: []repository.Block{
+				{Level: 243, Hash: "hash2", Timestamp: tezosDlgs[1].Timestamp},
+				{Level: 242, Hash: "hash1", Timestamp: tezosDlgs[0].Timestamp},
+			},
+			GetCheckpointRet: repository.Checkpoint{OperationID: 43, Level: 243},
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		run := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), waitTime)
+			defer cancel()
+			scraper.Run(ctx, time.Time{})
+		}
+		run()
+		_, ok := scraper.Lag()
+		assert.True(t, ok)
+
+		// another instance ingested in between
+		cliMock.GetBlockHashesRet = map[int32]string{244: "hash4", 245: "hash5"}
+		cliMock.GetHeadLevelErr = errors.New("fake client error")
+		repoMock.GetLatestBlocksRet = []repository.Block{
+			{Level: 245, Hash: "hash5", Timestamp: tezosDlgs[1].Timestamp.Add(time.Minute)},
+			{Level: 244, Hash: "hash4", Timestamp: tezosDlgs[1].Timestamp},
+		}
+		repoMock.GetCheckpointRet = repository.Checkpoint{OperationID: 45, Level: 245}
+		run()
+
+		// blocks of the previous run are not checked again ...
+		assert.Equal(t, []int32{244, 245}, cliMock.GetBlockHashesIn)
+		assert.Equal(t, 0, repoMock.DeleteDelegationsFromLevelCount)
+		assert.Equal(t, int64(45), cliMock.StreamDelegationsAfterIn)
+		// ... and the head level of the previous run is forgotten
+		_, ok = scraper.Lag()
+		assert.False(t, ok)
+	})
+
+	t.Run("deletes orphaned delegations when a stored level is fetched in another block", func(t *testing.T) {
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		reorgDlg := tezosDlgs[1]
+		reorgDlg.ID = 44
+		reorgDlg.Block = "hash2bis"
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			StreamDelegationsSinceRet:              [][]tezos.Delegation{tezosDlgs, {reorgDlg}},
+		}
+		repoMock := repoMock{}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, begin)
+
+		time.Sleep(waitTime)
+		cancel()
+
+		// nothing tracked at first, blocks have not been checked ...
+		assert.Equal(t, 0, cliMock.GetBlockHashesCount)
+		// ... but the level stored from the first page was deleted before storing the second one
+		assert.Equal(t, 1, repoMock.DeleteDelegationsFromLevelCount)
+		assert.Equal(t, int32(243), repoMock.DeleteDelegationsFromLevelIn)
+		assert.Equal(t, 2, repoMock.AddNewDelegationsAndCheckpointCount)
+	})
+
+	t.Run("resumes after stored checkpoint", func(t *testing.T) {
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			StreamDelegationsAfterRet:              [][]tezos.Delegation{tezosDlgs},
+		}
+		repoMock := repoMock{
+			GetCheckpointRet: repository.Checkpoint{OperationID: 41, Level: 241},
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, time.Time{})
+
+		time.Sleep(waitTime)
+		cancel()
+
+		assert.Equal(t, 0, cliMock.StreamDelegationsSinceCount)
+		assert.Equal(t, 1, cliMock.StreamDelegationsAfterCount)
+		assert.Equal(t, int64(41), cliMock.StreamDelegationsAfterIn)
+		assert.Len(t, repoMock.AddNewDelegationsAndCheckpointIn, 2)
+		// checkpoint moved forward to the last stored delegation
+		assert.Equal(t, repository.Checkpoint{OperationID: 43, Level: 243}, repoMock.AddNewDelegationsAndCheckpointInCheckpoint)
+	})
+
+	t.Run("reloads checkpoint after rollback", func(t *testing.T) {
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			GetBlockHashesRet:                      map[int32]string{242: "hash1", 243: "hash2bis"},
+		}
+		repoMock := repoMock{
+			GetCheckpointRet: repository.Checkpoint{OperationID: 43, Level: 243},
+			GetLatestBlocksRet: []repository.Block{
+				{Level: 243, Hash: "hash2", Timestamp: tezosDlgs[1].Timestamp},
+				{Level: 242, Hash: "hash1", Timestamp: tezosDlgs[0].Timestamp},
+			},
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, time.Time{})
+
+		time.Sleep(waitTime)
+		cancel()
+
+		assert.Equal(t, int32(243), repoMock.DeleteDelegationsFromLevelIn)
+		// checkpoint is loaded at start, then after rollback
+		assert.Equal(t, 2, repoMock.GetCheckpointCount)
+		assert.Equal(t, 1, cliMock.StreamDelegationsAfterCount)
+	})
+
+	t.Run("pauses when TzKT API asks for more than an interval", func(t *testing.T) {
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			StreamDelegationsSinceErr:              &tezos.UpstreamError{Kind: tezos.ErrRateLimited, RetryAfter: time.Second},
+		}
+		repoMock := repoMock{}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, begin)
+
+		// wait a bit more than three intervals
+		time.Sleep(3*scrapInterval + scrapInterval/4)
+		cancel()
+
+		// first cycle failed, next ones were delayed
+		assert.Equal(t, 1, cliMock.StreamDelegationsSinceCount)
+	})
+
+	t.Run("reports lag behind head level", func(t *testing.T) {
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			GetHeadLevelRet:                        250,
+		}
+		repoMock := repoMock{
+			GetCheckpointRet: repository.Checkpoint{OperationID: 41, Level: 241},
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, time.Time{})
+
+		time.Sleep(waitTime)
+		cancel()
+
+		// levels up to the head checked before the successful cycle are stored
+		lag, ok := scraper.Lag()
+		assert.True(t, ok)
+		assert.Equal(t, int32(0), lag)
+		assert.False(t, scraper.LastSuccess().IsZero())
+	})
+
+	t.Run("reports lag growing on failed cycles", func(t *testing.T) {
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			GetHeadLevelRet:                        250,
+			StreamDelegationsAfterErr:              errors.New("fake client error"),
+		}
+		repoMock := repoMock{
+			GetCheckpointRet: repository.Checkpoint{OperationID: 41, Level: 241},
+		}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, slog.Default())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, time.Time{})
+
+		time.Sleep(waitTime)
+		cancel()
+
+		lag, ok := scraper.Lag()
+		assert.True(t, ok)
+		assert.Equal(t, int32(9), lag)
+		assert.True(t, scraper.LastSuccess().IsZero())
+	})
+	t.Run("logs scraping cycle ID", func(t *testing.T) {
+		cliMock := clientMock{
+			GetCurrentProtocolTimeBetweenBlocksRet: scrapInterval,
+			StreamDelegationsSinceRet:              [][]tezos.Delegation{tezosDlgs},
+		}
+		repoMock := repoMock{}
+		logs := bytes.Buffer{}
+		scraper := tezos.NewScraper(&cliMock, &repoMock, logging.New(&logs, slog.LevelInfo, logging.FormatText))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go scraper.Run(ctx, time.Time{})
+
+		time.Sleep(waitTime)
+		cancel()
+
+		assert.Regexp(t, `msg="fetched delegations" .*cycle_id=[0-9a-f]{16}`, logs.String())
 	})
 }
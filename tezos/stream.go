@@ -0,0 +1,364 @@
+package tezos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kiln-tezos-delegation/logging"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SignalR JSON hub protocol message types, as used by the TzKT WebSocket API.
+// See https://github.com/dotnet/aspnetcore/blob/main/src/SignalR/docs/specs/HubProtocol.md
+const (
+	signalrInvocation = 1
+	signalrCompletion = 3
+	signalrPing       = 6
+	signalrClose      = 7
+)
+
+// signalrSeparator terminates every SignalR JSON message.
+const signalrSeparator = 0x1e
+
+// TzKT "operations" channel message types.
+const (
+	streamState = 0
+	streamData  = 1
+	streamReorg = 2
+)
+
+const (
+	// streamPingInterval is the delay between two keep-alive pings sent to the hub.
+	// It must be lower than the server timeout, which is 30 seconds by default.
+	streamPingInterval = 15 * time.Second
+	// streamMinReconnectDelay is the delay before the first reconnection attempt.
+	streamMinReconnectDelay = time.Second
+	// streamMaxReconnectDelay caps the exponential reconnection delay.
+	streamMaxReconnectDelay = time.Minute
+	// streamHeadCheckInterval is the delay between two checks of the head level while
+	// subscribed, also used as the timeout of the checks.
+	streamHeadCheckInterval = 30 * time.Second
+)
+
+// signalrMessage is a SignalR JSON hub protocol message.
+type signalrMessage struct {
+	Type         int               `json:"type"`
+	Target       string            `json:"target,omitempty"`
+	InvocationID string            `json:"invocationId,omitempty"`
+	Arguments    []json.RawMessage `json:"arguments,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// operationsMessage is the argument of the messages sent on the TzKT "operations" channel.
+type operationsMessage struct {
+	Type  int          `json:"type"`
+	State int32        `json:"state"`
+	Data  []Delegation `json:"data"`
+}
+
+// Streamer ingests delegation operations in real time from the TzKT WebSocket API.
+// It subscribes to the "operations" channel for delegations and stores every
+// received operation. Each time the subscription is (re-)established, the gap
+// since the last stored operation is backfilled over the REST API with the scraper.
+type Streamer struct {
+	wsURL   string
+	scraper *Scraper
+	dialer  websocket.Dialer
+	logger  *slog.Logger
+	// Delay between two checks of the head level while subscribed
+	headCheckInterval time.Duration
+}
+
+// NewStreamer creates a new streamer connecting to the WebSocket API of the TzKT
+// instance at the given base URL, and backfilling with the given REST client.
+// Returns an error if the base URL passed is invalid.
+func NewStreamer(baseURL string, client TezosClient, repo TezosRepository, logger *slog.Logger) (*Streamer, error) {
+	wsURL, err := url.Parse(baseURL + "v1/ws")
+	if err != nil {
+		return nil, err
+	}
+
+	switch wsURL.Scheme {
+	case "http":
+		wsURL.Scheme = "ws"
+	case "https":
+		wsURL.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme: %q", wsURL.Scheme)
+	}
+
+	return &Streamer{
+		wsURL:   wsURL.String(),
+		scraper: NewScraper(client, repo, logger),
+		dialer:  websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+		logger:  logger,
+
+		headCheckInterval: streamHeadCheckInterval,
+	}, nil
+}
+
+// LastSuccess returns the end time of the last successful backfill or storage of
+// received delegations, zero if none. It is safe from concurrency.
+func (s *Streamer) LastSuccess() time.Time {
+	return s.scraper.LastSuccess()
+}
+
+// Lag returns the number of levels between the head of the TzKT API, as of the last
+// backfill, received delegations or periodic check, and the level up to which every
+// delegation is stored. Returns false until both are known. It is safe from concurrency.
+func (s *Streamer) Lag() (int32, bool) {
+	return s.scraper.Lag()
+}
+
+// Run subscribes to delegation operations until context is cancelled, or any
+// non-recoverable error occurs. An error is returned in that later case.
+// Connection losses are recovered by reconnecting with an exponential delay,
+// or after the delay the TzKT API asks for when it is rate limiting or unavailable.
+// If a time is passed as parameter, it will be used as an override of the
+// checkpoint for the first backfill. It is mostly for testing purposes.
+func (s *Streamer) Run(ctx context.Context, beginning time.Time) error {
+	beginning, err := s.scraper.init(ctx, beginning)
+	if err != nil {
+		return err
+	}
+
+	delay := streamMinReconnectDelay
+	for {
+		var subscribed bool
+		beginning, subscribed, err = s.session(ctx, beginning)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if subscribed {
+			delay = streamMinReconnectDelay
+		}
+		// let the TzKT API recover when it asks for more
+		var uerr *UpstreamError
+		if errors.As(err, &uerr) {
+			delay = max(delay, uerr.RetryAfter)
+		}
+
+		// do not return, instead log and try again
+		s.logger.WarnContext(ctx, "stream session ended", "error", err, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, streamMaxReconnectDelay)
+	}
+}
+
+// session connects to the hub, subscribes to delegation operations and processes
+// messages until an error occurs. Returns the time suitable for the next backfill
+// to start with, whether the subscription has been established, and the error
+// which ended the session.
+func (s *Streamer) session(ctx context.Context, beginning time.Time) (time.Time, bool, error) {
+	conn, _, err := s.dialer.DialContext(ctx, s.wsURL, nil)
+	if err != nil {
+		return beginning, false, err
+	}
+	defer conn.Close()
+
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// writes are not safe from concurrency with gorilla/websocket
+	var wmu sync.Mutex
+	send := func(msg any) error {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		wmu.Lock()
+		defer wmu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, append(payload, signalrSeparator))
+	}
+
+	// unblock pending reads on cancellation, and keep the connection alive meanwhile
+	go func() {
+		ticker := time.NewTicker(streamPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				_ = send(signalrMessage{Type: signalrPing})
+			}
+		}
+	}()
+
+	// keep the lag up to date while no delegation is received
+	go s.checkHead(sctx)
+
+	if err := s.handshake(conn, send); err != nil {
+		return beginning, false, err
+	}
+
+	subscription := signalrMessage{
+		Type:         signalrInvocation,
+		Target:       "SubscribeToOperations",
+		InvocationID: "0",
+		Arguments:    []json.RawMessage{json.RawMessage(`{"types":"delegation"}`)},
+	}
+	if err := send(subscription); err != nil {
+		return beginning, false, err
+	}
+
+	subscribed := false
+	for {
+		msgs, err := readMessages(conn)
+		if err != nil {
+			return beginning, subscribed, err
+		}
+
+		for _, msg := range msgs {
+			switch msg.Type {
+			case signalrClose:
+				return beginning, subscribed, fmt.Errorf("closed by server: %s", msg.Error)
+			case signalrCompletion:
+				if msg.Error != "" {
+					return beginning, subscribed, fmt.Errorf("subscription failed: %s", msg.Error)
+				}
+			case signalrInvocation:
+				if msg.Target != "operations" || len(msg.Arguments) == 0 {
+					continue
+				}
+				var opMsg operationsMessage
+				if err := json.Unmarshal(msg.Arguments[0], &opMsg); err != nil {
+					return beginning, subscribed, err
+				}
+				if opMsg.Type == streamState {
+					subscribed = true
+				}
+				beginning, err = s.handleOperations(ctx, beginning, opMsg)
+				if err != nil {
+					return beginning, subscribed, err
+				}
+			}
+		}
+	}
+}
+
+// checkHead records the head level of the TzKT API periodically until context is
+// cancelled. State messages only report the head level along with delegations, so
+// the lag would not grow otherwise when the subscription stalls. Failures are only
+// logged, the head level being unknown until the next check.
+func (s *Streamer) checkHead(ctx context.Context) {
+	ticker := time.NewTicker(s.headCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cctx, cancel := context.WithTimeout(ctx, s.headCheckInterval)
+			head, err := s.scraper.client.GetHeadLevel(cctx)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					s.logger.WarnContext(ctx, "cannot get head level", "error", err)
+				}
+				continue
+			}
+			s.scraper.progress.observeHead(head)
+		}
+	}
+}
+
+// handshake negotiates the SignalR JSON protocol with the hub.
+func (s *Streamer) handshake(conn *websocket.Conn, send func(any) error) error {
+	if err := send(map[string]any{"protocol": "json", "version": 1}); err != nil {
+		return err
+	}
+
+	msgs, err := readMessages(conn)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 || msgs[0].Error != "" {
+		return errors.New("handshake failed")
+	}
+
+	return nil
+}
+
+// handleOperations processes a message of the "operations" channel. State messages,
+// sent right after subscription, trigger a backfill over the REST API. Data messages
+// are stored. Returns the time suitable for the next backfill to start with. Lines
+// logged while processing a message hold a cycle ID, as scraping cycles do.
+func (s *Streamer) handleOperations(ctx context.Context, beginning time.Time, msg operationsMessage) (time.Time, error) {
+	ctx = logging.With(ctx, "cycle_id", logging.NewID())
+	switch msg.Type {
+	case streamState:
+		s.logger.InfoContext(ctx, "subscribed, backfilling", "level", msg.State)
+		return s.scraper.scrapDelegations(ctx, beginning)
+	case streamData:
+		dlgs := make([]Delegation, 0, len(msg.Data))
+		for i := range msg.Data {
+			if msg.Data[i].ID != 0 {
+				dlgs = append(dlgs, msg.Data[i])
+			}
+		}
+		if len(dlgs) == 0 {
+			return beginning, nil
+		}
+		s.logger.InfoContext(ctx, "received delegations", "count", len(dlgs))
+		newest, err := s.scraper.storeDelegations(ctx, dlgs)
+		if err != nil {
+			return beginning, err
+		}
+		// state is the level of the received delegations, now stored as any before
+		s.scraper.progress.observeHead(msg.State)
+		s.scraper.progress.succeed(msg.State)
+		if next := newest.Add(time.Second); next.After(beginning) {
+			return next, nil
+		}
+		return beginning, nil
+	case streamReorg:
+		// state is the level the chain was reverted to; delegations above are orphaned
+		oldest, err := s.scraper.rollback(ctx, msg.State+1)
+		if err != nil {
+			return beginning, err
+		}
+		if !oldest.IsZero() && oldest.Before(beginning) {
+			return oldest, nil
+		}
+		return beginning, nil
+	default:
+		return beginning, nil
+	}
+}
+
+// readMessages reads one WebSocket message and splits it into SignalR messages.
+func readMessages(conn *websocket.Conn) ([]signalrMessage, error) {
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := []signalrMessage{}
+	for _, record := range bytes.Split(payload, []byte{signalrSeparator}) {
+		if len(strings.TrimSpace(string(record))) == 0 {
+			continue
+		}
+		var msg signalrMessage
+		if err := json.Unmarshal(record, &msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
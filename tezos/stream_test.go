@@ -0,0 +1,251 @@
+package tezos_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kiln-tezos-delegation/repository"
+	"kiln-tezos-delegation/tezos"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHub is a minimal SignalR hub mimicking the TzKT WebSocket API.
+// Once a client subscribed, it sends a state message followed by the given messages,
+// then closes the connection if required to.
+type fakeHub struct {
+	messages    []string
+	closeAfter  bool
+	connections atomic.Int32
+	subscribed  atomic.Int32
+}
+
+func (h *fakeHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/ws" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	h.connections.Add(1)
+
+	// handshake
+	if _, msg, err := conn.ReadMessage(); err != nil || !strings.Contains(string(msg), `"protocol":"json"`) {
+		return
+	}
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("{}\x1e"))
+
+	// subscription
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	var sub struct {
+		Target       string            `json:"target"`
+		InvocationID string            `json:"invocationId"`
+		Arguments    []json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(string(msg), "\x1e")), &sub); err != nil ||
+		sub.Target != "SubscribeToOperations" || !strings.Contains(string(sub.Arguments[0]), `"delegation"`) {
+		return
+	}
+	h.subscribed.Add(1)
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":3,"invocationId":"`+sub.InvocationID+`","result":1000}`+"\x1e"))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"type":1,"target":"operations","arguments":[{"type":0,"state":1000}]}`+"\x1e"))
+
+	for _, msg := range h.messages {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(msg+"\x1e"))
+	}
+
+	if h.closeAfter {
+		return
+	}
+
+	// wait for client to leave
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// headClientMock returns the stored head level, safe from concurrency, and mocks
+// other calls with clientMock.
+type headClientMock struct {
+	*clientMock
+	head atomic.Int32
+}
+
+func (m *headClientMock) GetHeadLevel(context.Context) (int32, error) {
+	return m.head.Load(), nil
+}
+
+func TestStreamer(t *testing.T) {
+	backfillDlgs := []tezos.Delegation{
+		{
+			ID:        42,
+			Timestamp: time.Date(2024, 06, 25, 10, 02, 33, 0, time.UTC),
+			Block:     "hash1",
+			Sender:    tezos.Account{Address: "addr1"},
+			Level:     242,
+			Amount:    342,
+		},
+	}
+	dataMsg := `{"type":1,"target":"operations","arguments":[{"type":1,"state":1001,"data":[` +
+		`{"type":"delegation","id":43,"timestamp":"2024-06-25T14:02:33Z","block":"hash2","hash":"op2","status":"applied",` +
+		`"sender":{"address":"addr2"},"level":1001,"amount":343,"bakerFee":443,"newDelegate":{"address":"baker1"}}` +
+		`]}]}`
+
+	t.Run("backfills then stores received delegations", func(t *testing.T) {
+		hub := &fakeHub{messages: []string{dataMsg}}
+		server := httptest.NewServer(hub)
+		defer server.Close()
+
+		cliMock := clientMock{
+			StreamDelegationsSinceRet: [][]tezos.Delegation{backfillDlgs},
+		}
+		repoMock := repoMock{}
+		streamer, err := tezos.NewStreamer(server.URL+"/", &cliMock, &repoMock, slog.Default())
+		require.NoError(t, err)
+
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- streamer.Run(ctx, begin) }()
+
+		time.Sleep(300 * time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+
+		// gap has been backfilled over REST from the starting time
+		assert.Equal(t, 1, cliMock.StreamDelegationsSinceCount)
+		assert.Equal(t, begin, cliMock.StreamDelegationsSinceIn)
+		// backfilled and streamed delegations have been stored in order
+		require.Len(t, repoMock.AddNewDelegationsAndCheckpointIn, 2)
+		assert.Equal(t, int64(42), repoMock.AddNewDelegationsAndCheckpointIn[0].OperationID)
+		assert.Equal(t, int64(43), repoMock.AddNewDelegationsAndCheckpointIn[1].OperationID)
+		assert.Equal(t, "baker1", repoMock.AddNewDelegationsAndCheckpointIn[1].NewDelegate)
+		assert.Equal(t, int32(1001), repoMock.AddNewDelegationsAndCheckpointIn[1].Level)
+	})
+
+	t.Run("reconnects and backfills after last stored delegation", func(t *testing.T) {
+		hub := &fakeHub{messages: []string{dataMsg}, closeAfter: true}
+		server := httptest.NewServer(hub)
+		defer server.Close()
+
+		cliMock := clientMock{
+			StreamDelegationsSinceRet: [][]tezos.Delegation{backfillDlgs},
+			GetBlockHashesRet:         map[int32]string{242: "hash1", 1001: "hash2"},
+		}
+		repoMock := repoMock{}
+		streamer, err := tezos.NewStreamer(server.URL+"/", &cliMock, &repoMock, slog.Default())
+		require.NoError(t, err)
+
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- streamer.Run(ctx, begin) }()
+
+		// first reconnection happens after one second
+		time.Sleep(1300 * time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+
+		assert.Equal(t, int32(2), hub.subscribed.Load())
+		assert.Equal(t, 1, cliMock.StreamDelegationsSinceCount)
+		// second backfill started right after the checkpoint of the streamed delegation
+		assert.Equal(t, 1, cliMock.StreamDelegationsAfterCount)
+		assert.Equal(t, int64(43), cliMock.StreamDelegationsAfterIn)
+		assert.Equal(t, repository.Checkpoint{OperationID: 43, Level: 1001}, repoMock.AddNewDelegationsAndCheckpointInCheckpoint)
+	})
+
+	t.Run("updates lag while no delegation is received", func(t *testing.T) {
+		hub := &fakeHub{}
+		server := httptest.NewServer(hub)
+		defer server.Close()
+
+		cliMock := headClientMock{clientMock: &clientMock{}}
+		cliMock.head.Store(1000)
+		repoMock := repoMock{}
+		streamer, err := tezos.NewStreamer(server.URL+"/", &cliMock, &repoMock, slog.Default())
+		require.NoError(t, err)
+		streamer.SetHeadCheckInterval(50 * time.Millisecond)
+
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- streamer.Run(ctx, begin) }()
+
+		time.Sleep(200 * time.Millisecond)
+		lag, ok := streamer.Lag()
+		require.True(t, ok)
+		assert.Equal(t, int32(0), lag)
+
+		// chain moves on while the subscription stalls
+		cliMock.head.Store(1020)
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+
+		lag, ok = streamer.Lag()
+		require.True(t, ok)
+		assert.Equal(t, int32(20), lag)
+	})
+
+	t.Run("deletes orphaned delegations on reorg message", func(t *testing.T) {
+		reorgMsg := `{"type":1,"target":"operations","arguments":[{"type":2,"state":1000}]}`
+		hub := &fakeHub{messages: []string{dataMsg, reorgMsg}}
+		server := httptest.NewServer(hub)
+		defer server.Close()
+
+		cliMock := clientMock{}
+		repoMock := repoMock{}
+		streamer, err := tezos.NewStreamer(server.URL+"/", &cliMock, &repoMock, slog.Default())
+		require.NoError(t, err)
+
+		begin := time.Date(2024, 06, 20, 10, 02, 33, 0, time.UTC)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- streamer.Run(ctx, begin) }()
+
+		time.Sleep(300 * time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+
+		// delegations above the level the chain was reverted to have been deleted
+		assert.Equal(t, 1, repoMock.DeleteDelegationsFromLevelCount)
+		assert.Equal(t, int32(1001), repoMock.DeleteDelegationsFromLevelIn)
+	})
+
+	t.Run("return error on timestamp fetch failure", func(t *testing.T) {
+		repoMock := repoMock{
+			GetLatestBlockTimestampErr: errors.New("fake database error"),
+		}
+		streamer, err := tezos.NewStreamer("http://localhost/", &clientMock{}, &repoMock, slog.Default())
+		require.NoError(t, err)
+
+		err = streamer.Run(context.Background(), time.Time{})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("return error on unsupported URL scheme", func(t *testing.T) {
+		_, err := tezos.NewStreamer("ftp://localhost/", &clientMock{}, &repoMock{}, slog.Default())
+
+		assert.Error(t, err)
+	})
+}